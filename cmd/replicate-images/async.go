@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/cache"
+	"github.com/kevinmichaelchen/replicate-images/internal/client"
+	"github.com/kevinmichaelchen/replicate-images/internal/pending"
+	"github.com/kevinmichaelchen/replicate-images/internal/retry"
+	"github.com/spf13/cobra"
+)
+
+var flagWait bool
+
+const (
+	// fetchPollInterval is how often `fetch --wait` re-checks running predictions.
+	fetchPollInterval = 5 * time.Second
+	// fetchMaxLookupFailures is how many polls in a row `fetch --wait` lets a
+	// prediction's lookup fail transiently before giving up on it.
+	fetchMaxLookupFailures = 5
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the status of pending async predictions",
+	Long: `Check every prediction submitted with --async that hasn't been fetched yet.
+
+Pending predictions are tracked in pending.json in the output directory.`,
+	Args: cobra.NoArgs,
+	RunE: runStatus,
+}
+
+var fetchCmd = &cobra.Command{
+	Use:   "fetch",
+	Short: "Download finished async predictions",
+	Long: `Download the images of every finished prediction submitted with --async,
+convert them to the output format and record them in the cache.
+
+Predictions that are still running are left pending; use --wait to keep
+polling until all of them have finished.`,
+	Args: cobra.NoArgs,
+	RunE: runFetch,
+}
+
+func init() {
+	fetchCmd.Flags().BoolVar(&flagWait, "wait", false, "Wait for running predictions to finish")
+
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(fetchCmd)
+}
+
+// asyncGenerator returns gen, the generator for provider, as an
+// AsyncGenerator, or an error if it can't run predictions asynchronously.
+func asyncGenerator(gen client.Generator, provider string) (client.AsyncGenerator, error) {
+	ag, ok := gen.(client.AsyncGenerator)
+	if !ok {
+		return nil, &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("provider %q does not support async predictions", provider)}
+	}
+	return ag, nil
+}
+
+// asyncGenerators creates the generator for each provider that pending
+// predictions were submitted to, once. --provider-url only applies to the
+// --provider one.
+type asyncGenerators map[string]client.AsyncGenerator
+
+// get returns the generator for provider.
+func (g asyncGenerators) get(provider string) (client.AsyncGenerator, error) {
+	if provider == "" {
+		provider = client.ProviderReplicate
+	}
+	if ag, ok := g[provider]; ok {
+		return ag, nil
+	}
+	cfg, err := clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if provider != flagProvider {
+		cfg.Provider, cfg.BaseURL = provider, ""
+	}
+	gen, err := client.NewGenerator(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ag, err := asyncGenerator(gen, provider)
+	if err != nil {
+		return nil, err
+	}
+	g[provider] = ag
+	return ag, nil
+}
+
+// submitAsync creates a prediction for req, keyed by key, unless one is
+// already pending, and records it in store with the prompt names to save its
+// images under. mu guards store and is held while saving.
+func submitAsync(ctx context.Context, ag client.AsyncGenerator, store *pending.Store, mu *sync.Mutex, key cache.Key, req client.Request, names []string, sizes []int) GenerateResult {
+	hash := key.Hash()
+	result := GenerateResult{
+		Prompt: req.Prompt,
+		Model:  req.Model,
+		Params: req.Params,
+		Image:  req.Image,
+		Mask:   req.Mask,
+		Hash:   hash,
+	}
+
+	// Reserve the hash before creating the prediction, so a concurrent
+	// submission of the same key doesn't create (and pay for) another.
+	mu.Lock()
+	if existing := store.LookupHash(hash); existing != nil {
+		defer mu.Unlock()
+		added := false
+		for _, name := range names {
+			added = existing.AddName(name) || added
+		}
+		result.Status = "pending"
+		result.PredictionID = existing.ID
+		if added && existing.ID != "" {
+			if err := store.Save(); err != nil {
+				result.Status = "error"
+				result.Error = fmt.Sprintf("failed to record the names of prediction %s: %v", existing.ID, err)
+			}
+		}
+		return result
+	}
+	store.Reserve(pending.Prediction{
+		Hash:      hash,
+		Key:       key,
+		Provider:  flagProvider,
+		Names:     slices.Clone(names),
+		Sizes:     sizes,
+		CreatedAt: time.Now(),
+	})
+	mu.Unlock()
+
+	p, err := ag.CreatePrediction(ctx, req)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		store.Release(hash)
+		result.Status = "error"
+		result.Error = err.Error()
+		return result
+	}
+	store.Created(hash, p.ID, p.Status)
+	if err := store.Save(); err != nil {
+		result.Status = "error"
+		result.Error = fmt.Sprintf("prediction %s created but not recorded: %v", p.ID, err)
+		return result
+	}
+
+	result.Status = "submitted"
+	result.PredictionID = p.ID
+	result.Attempts = p.Attempts
+	return result
+}
+
+// printSubmitResult reports the outcome of submitAsync.
+func printSubmitResult(r GenerateResult) {
+	if flagJSON {
+		outputJSON(r)
+		return
+	}
+	switch r.Status {
+	case "error":
+		fmt.Printf("Error [%s]: %s\n", r.Prompt, r.Error)
+	case "pending":
+		if shouldOutput() && r.PredictionID == "" {
+			fmt.Printf("Already submitting: %s\n", r.Prompt)
+		} else if shouldOutput() {
+			fmt.Printf("Already pending: %s (%s)\n", r.Prompt, r.PredictionID)
+		}
+	default:
+		if shouldOutput() {
+			fmt.Printf("Submitted: %s (%s)\n", r.Prompt, r.PredictionID)
+		}
+	}
+}
+
+func runStatus(cmd *cobra.Command, _ []string) error {
+	ctx := cmd.Context()
+
+	store, err := pending.Load(flagOutput)
+	if err != nil {
+		return fmt.Errorf("failed to load pending predictions: %w", err)
+	}
+	if len(store.Predictions) == 0 {
+		if shouldOutput() {
+			fmt.Println("No pending predictions.")
+		}
+		return nil
+	}
+
+	gens := asyncGenerators{}
+	for i := range store.Predictions {
+		rec := &store.Predictions[i]
+		result := GenerateResult{
+			Prompt:       rec.Key.Prompt,
+			Model:        rec.Key.Model,
+			Params:       rec.Key.Params,
+			Hash:         rec.Hash,
+			PredictionID: rec.ID,
+		}
+
+		ag, err := gens.get(rec.Provider)
+		var p *client.Prediction
+		if err == nil {
+			p, err = ag.GetPrediction(ctx, rec.ID)
+		}
+		if err != nil {
+			result.Status = "error"
+			result.Error = err.Error()
+		} else {
+			rec.Status = p.Status
+			result.Status = p.Status
+			result.Error = p.Error
+			result.Attempts = p.Attempts
+		}
+
+		if flagJSON {
+			outputJSON(result)
+		} else if shouldOutput() {
+			fmt.Printf("[%s] %s\n", result.Status, result.Prompt)
+			fmt.Printf("         ID:    %s\n", result.PredictionID)
+			fmt.Printf("         Model: %s\n", result.Model)
+			if result.Error != "" {
+				fmt.Printf("         Error: %s\n", result.Error)
+			}
+		}
+	}
+
+	if err := store.Save(); err != nil {
+		return fmt.Errorf("failed to save pending predictions: %w", err)
+	}
+	return nil
+}
+
+func runFetch(cmd *cobra.Command, _ []string) error {
+	ctx := cmd.Context()
+
+	store, err := pending.Load(flagOutput)
+	if err != nil {
+		return fmt.Errorf("failed to load pending predictions: %w", err)
+	}
+	if len(store.Predictions) == 0 {
+		if shouldOutput() {
+			fmt.Println("No pending predictions.")
+		}
+		return nil
+	}
+	total := len(store.Predictions)
+
+	c, err := loadCache()
+	if err != nil {
+		return err
+	}
+	canonicalizeCache(c)
+
+	var (
+		gens     = asyncGenerators{}
+		fetched  int
+		errored  int
+		failed   = make(map[string]bool) // Predictions not to check again in this run
+		failures = make(map[string]int)  // Consecutive transient lookup errors
+	)
+	for ctx.Err() == nil {
+		// Iterate over a copy, since finished predictions are removed.
+		for _, rec := range append([]pending.Prediction(nil), store.Predictions...) {
+			if ctx.Err() != nil {
+				// Interrupted; unfetched predictions stay pending.
+				break
+			}
+			if failed[rec.ID] {
+				continue
+			}
+			result := GenerateResult{
+				Prompt:       rec.Key.Prompt,
+				Model:        rec.Key.Model,
+				Params:       rec.Key.Params,
+				Hash:         rec.Hash,
+				PredictionID: rec.ID,
+			}
+
+			ag, err := gens.get(rec.Provider)
+			var p *client.Prediction
+			if err == nil {
+				p, err = ag.GetPrediction(ctx, rec.ID)
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				// Keep it pending; a later fetch can still download it. While
+				// waiting, transient errors are retried on the next poll.
+				failures[rec.ID]++
+				if flagWait && retry.IsTransient(err) && failures[rec.ID] < fetchMaxLookupFailures {
+					continue
+				}
+				result.Status = "error"
+				result.Error = err.Error()
+				printFetchResult(result)
+				failed[rec.ID] = true
+				continue
+			}
+			delete(failures, rec.ID)
+			if !p.Done() {
+				continue
+			}
+
+			if !p.Succeeded() {
+				result.Status = "error"
+				result.Error = fmt.Sprintf("prediction %s: %s", p.Status, p.Error)
+			} else if filenames, attempts, err := fetchImages(ctx, ag, c, p, rec); err != nil {
+				// The prediction succeeded and is paid for: keep it pending,
+				// so a later fetch can still download it. Its output URLs
+				// may have expired, so don't wait for it.
+				result.Status = "error"
+				result.Attempts = attempts
+				result.Error = err.Error()
+				printFetchResult(result)
+				failed[rec.ID] = true
+				continue
+			} else {
+				result.Attempts = attempts
+				relinkAliases(c, c.Upsert(rec.Key, filenames).Hash)
+				paths, variants := nameOutputs(c, rec, filenames)
+				result.Variants = variants
+				entry := *c.Lookup(rec.Hash)
+				if err := c.Append(&entry); err != nil {
+					return fmt.Errorf("failed to journal cache entry: %w", err)
+				}
+				pushEntry(ctx, c, entry)
+				result.Status = "generated"
+				result.OutputFile = paths[0]
+				result.OutputFiles = paths
+			}
+
+			if result.Status == "error" {
+				errored++
+			} else {
+				fetched++
+			}
+			printFetchResult(result)
+
+			store.Remove(rec.ID)
+			if err := store.Save(); err != nil {
+				return fmt.Errorf("failed to save pending predictions: %w", err)
+			}
+		}
+
+		// Stop waiting once only predictions that failed are left.
+		if !flagWait || len(store.Predictions) == len(failed) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(fetchPollInterval):
+		}
+	}
+	errored += len(failed)
+
+	if err := evictCache(c); err != nil {
+		return err
+	}
+	if err := c.Save(); err != nil {
+		return fmt.Errorf("failed to save cache: %w", err)
+	}
+
+	if shouldOutput() {
+		fmt.Printf("\nFetched %d, still pending %d.\n", fetched, len(store.Predictions))
+	}
+
+	if errored > 0 {
+		msg := fmt.Sprintf("%d prediction(s) failed", errored)
+		if errored == total {
+			return &ExitError{Code: ExitTotalFail, Message: msg}
+		}
+		return &ExitError{Code: ExitPartialFail, Message: msg}
+	}
+	return nil
+}
+
+// nameOutputs links the names of a fetched prediction to its images, saved
+// as filenames, and writes its scaled-down copies. It returns the paths and
+// variants to report: the names', or the images' own if it has none.
+func nameOutputs(c *cache.Cache, rec pending.Prediction, filenames []string) ([]string, []cache.Variant) {
+	if len(rec.Names) == 0 {
+		return outputPaths(filenames), ensureVariants(c, rec.Hash, "", rec.Sizes)
+	}
+	var (
+		paths    []string
+		variants []cache.Variant
+	)
+	for _, name := range rec.Names {
+		paths = append(paths, linkAlias(c, rec.Hash, name, outputPaths(filenames))...)
+		variants = append(variants, ensureVariants(c, rec.Hash, name, rec.Sizes)...)
+	}
+	return paths, variants
+}
+
+// fetchImages downloads a finished prediction's images and saves them in the
+// format of its key, keeping any previous images of its entry in c as a
+// revision. It also returns the number of download attempts. A download in
+// progress finishes even if ctx is canceled.
+func fetchImages(ctx context.Context, ag client.AsyncGenerator, c *cache.Cache, p *client.Prediction, rec pending.Prediction) ([]string, int, error) {
+	dl, err := ag.Download(context.WithoutCancel(ctx), p.URLs)
+	if err != nil {
+		return nil, dl.Attempts, err
+	}
+	archiveEntry(c, rec.Hash)
+	filenames, err := saveImages(dl.Images, rec.Key)
+	if err != nil {
+		return nil, dl.Attempts, fmt.Errorf("failed to save image: %w", err)
+	}
+	return filenames, dl.Attempts, nil
+}
+
+// printFetchResult reports the outcome of fetching a single prediction.
+func printFetchResult(r GenerateResult) {
+	if flagJSON {
+		outputJSON(r)
+		return
+	}
+	if r.Status == "error" {
+		fmt.Printf("Error [%s]: %s\n", r.Prompt, r.Error)
+	} else if shouldOutput() {
+		fmt.Printf("Fetched: %s -> %v\n", r.Prompt, r.OutputFiles)
+	}
+}
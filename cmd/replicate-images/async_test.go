@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/cache"
+	"github.com/kevinmichaelchen/replicate-images/internal/client"
+	"github.com/kevinmichaelchen/replicate-images/internal/pending"
+	"github.com/spf13/cobra"
+)
+
+// slowGenerator creates fake predictions and images slowly, counting them,
+// so that concurrent requests overlap.
+type slowGenerator struct {
+	client.Fake
+	created atomic.Int32
+	err     error
+	started chan struct{} // Signaled as each generation starts, if set
+}
+
+func (g *slowGenerator) CreatePrediction(ctx context.Context, req client.Request) (*client.Prediction, error) {
+	g.created.Add(1)
+	time.Sleep(20 * time.Millisecond)
+	if g.err != nil {
+		return nil, g.err
+	}
+	return g.Fake.CreatePrediction(ctx, req)
+}
+
+// GenerateImages finishes even once ctx is canceled, like a prediction that
+// was already running.
+func (g *slowGenerator) GenerateImages(ctx context.Context, req client.Request) (client.Result, error) {
+	g.created.Add(1)
+	if g.started != nil {
+		g.started <- struct{}{}
+	}
+	time.Sleep(50 * time.Millisecond)
+	return g.Fake.GenerateImages(context.WithoutCancel(ctx), req)
+}
+
+// command returns a command to run a subcommand's RunE with.
+func command(ctx context.Context) *cobra.Command {
+	cmd := &cobra.Command{}
+	cmd.SetContext(ctx)
+	return cmd
+}
+
+func TestSubmitAsyncDedupe(t *testing.T) {
+	setFlag(t, &flagProvider, client.ProviderFake)
+	dir := t.TempDir()
+	store, err := pending.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := &slowGenerator{}
+	key := cache.NewKey("a red fox", "black-forest-labs/flux-schnell", nil)
+	req := client.Request{Model: key.Model, Prompt: key.Prompt}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		names   = []string{"hero", "thumb", "hero"}
+		results = make([]GenerateResult, len(names))
+	)
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = submitAsync(context.Background(), gen, store, &mu, key, req, []string{name}, nil)
+		}()
+	}
+	wg.Wait()
+
+	if n := gen.created.Load(); n != 1 {
+		t.Errorf("created %d predictions, want 1", n)
+	}
+	submitted := 0
+	for _, r := range results {
+		switch r.Status {
+		case "submitted":
+			submitted++
+		case "pending":
+		default:
+			t.Errorf("submitAsync = %+v, want submitted or pending", r)
+		}
+	}
+	if submitted != 1 {
+		t.Errorf("%d submissions reported submitted, want 1", submitted)
+	}
+
+	saved, err := pending.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Predictions) != 1 {
+		t.Fatalf("saved %+v, want one prediction", saved.Predictions)
+	}
+	p := saved.Predictions[0]
+	slices.Sort(p.Names)
+	if p.ID == "" || p.Provider != client.ProviderFake || !slices.Equal(p.Names, []string{"hero", "thumb"}) {
+		t.Errorf("saved %+v, want a fake prediction named hero and thumb", p)
+	}
+}
+
+func TestSubmitAsyncFailure(t *testing.T) {
+	dir := t.TempDir()
+	store, err := pending.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := &slowGenerator{err: errors.New("invalid token")}
+	key := cache.NewKey("a red fox", "black-forest-labs/flux-schnell", nil)
+	req := client.Request{Model: key.Model, Prompt: key.Prompt}
+	var mu sync.Mutex
+
+	if r := submitAsync(context.Background(), gen, store, &mu, key, req, nil, nil); r.Status != "error" {
+		t.Fatalf("submitAsync = %+v, want an error", r)
+	}
+	if p := store.LookupHash(key.Hash()); p != nil {
+		t.Fatalf("failed submission left %+v reserved", p)
+	}
+
+	// Released, so it can be submitted again.
+	gen.err = nil
+	if r := submitAsync(context.Background(), gen, store, &mu, key, req, nil, nil); r.Status != "submitted" {
+		t.Errorf("submitAsync after a failure = %+v, want submitted", r)
+	}
+}
+
+// savePending writes predictions to dir's pending.json.
+func savePending(t *testing.T, dir string, predictions ...pending.Prediction) {
+	t.Helper()
+	store, err := pending.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range predictions {
+		store.Add(p)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pendingPrediction returns a pending prediction for prompt on provider.
+func pendingPrediction(id, prompt, provider string, names ...string) pending.Prediction {
+	key := cache.NewKey(prompt, "black-forest-labs/flux-schnell", nil)
+	if provider != client.ProviderReplicate {
+		key.Provider = provider
+	}
+	return pending.Prediction{ID: id, Hash: key.Hash(), Key: key, Provider: provider, Names: names, Status: "starting"}
+}
+
+func TestFetchNames(t *testing.T) {
+	dir := t.TempDir()
+	setFlag(t, &flagOutput, dir)
+	setFlag(t, &flagQuiet, true)
+
+	// Submitted to the fake provider, fetched with the default one selected
+	gen := client.Fake{}
+	p, err := gen.CreatePrediction(context.Background(), client.Request{Model: "black-forest-labs/flux-schnell", Prompt: "a red fox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	savePending(t, dir, pendingPrediction(p.ID, "a red fox", client.ProviderFake, "hero", "thumb"))
+
+	if err := runFetch(command(context.Background()), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"hero.webp", "thumb.webp"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s wasn't saved: %v", name, err)
+		}
+	}
+	if store, _ := pending.Load(dir); len(store.Predictions) != 0 {
+		t.Errorf("still pending: %+v", store.Predictions)
+	}
+}
+
+func TestFetchKeepsFailed(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/predictions/done":
+			// Succeeded, but its output has expired.
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"id": "done", "status": "succeeded", "output": [%q]}`, srv.URL+"/expired.png")
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"detail": "Not found."}`))
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("REPLICATE_API_TOKEN", "test")
+	setFlag(t, &flagOutput, dir)
+	setFlag(t, &flagProviderURL, srv.URL)
+	setFlag(t, &flagQuiet, true)
+	setFlag(t, &flagRetries, 0)
+	setFlag(t, &flagWait, true)
+	savePending(t, dir,
+		pendingPrediction("done", "a red fox", client.ProviderReplicate),
+		pendingPrediction("deleted", "a blue fox", client.ProviderReplicate))
+
+	// Neither error is worth waiting for, so fetch returns rather than
+	// polling until the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := runFetch(command(ctx), nil)
+	if ctx.Err() != nil {
+		t.Fatal("fetch --wait kept polling predictions that can't be fetched")
+	}
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != ExitTotalFail {
+		t.Errorf("runFetch = %v, want a total failure", err)
+	}
+
+	store, err := pending.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Predictions) != 2 {
+		t.Errorf("pending %+v, want both predictions kept", store.Predictions)
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/cache"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagPruneBefore string
+	flagPruneModel  string
+)
+
+// imageExts are the extensions of files `cache gc` considers output images.
+var imageExts = map[string]bool{".webp": true, ".png": true, ".jpg": true, ".jpeg": true}
+
+// CacheEntryResult represents the JSON output for a cache entry.
+type CacheEntryResult struct {
+	cache.Entry
+	Status       string           `json:"status,omitempty"`
+	MissingFiles []string         `json:"missing_files,omitempty"`
+	Mismatches   []cache.Mismatch `json:"mismatches,omitempty"` // Files changed since they were cached
+}
+
+// ExportResult represents the JSON output for `cache export`.
+type ExportResult struct {
+	Archive string `json:"archive"`
+	cache.ExportStats
+}
+
+// ImportResult represents the JSON output for `cache import`.
+type ImportResult struct {
+	Archive string `json:"archive"`
+	cache.ImportStats
+}
+
+// GCResult represents the JSON output for a file removed by `cache gc`.
+type GCResult struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"`
+}
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect and maintain the image cache",
+	Long: `Inspect and maintain the cache of generated images in the output directory.
+
+Every subcommand supports --json; list, verify, prune and gc write one JSON
+object per line. prune and gc honor --dry-run.`,
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List cache entries",
+	Args:  cobra.NoArgs,
+	RunE:  runCacheList,
+}
+
+var cacheShowCmd = &cobra.Command{
+	Use:   "show <hash|name>",
+	Short: "Show a single cache entry",
+	Long: `Show the cache entry with the given hash (or unique hash prefix), or whose
+output file has the given name, with or without its extension.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runCacheShow,
+}
+
+var cacheVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Report cache entries whose output files are missing or changed",
+	Long: `Check that every output file recorded in the cache exists and still has the
+size and SHA-256 checksum it was cached with.
+
+Entries with missing files are reported as missing, and entries with changed
+files as corrupt; the exit code is 1 if there are any. Such entries are
+regenerated by the next run that needs them. Entries cached before checksums
+were recorded are only checked for missing files.`,
+	Args: cobra.NoArgs,
+	RunE: runCacheVerify,
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove cache entries by age or model",
+	Long: `Remove cache entries created before a date, for a model, or both.
+
+Output files are kept; run 'cache gc' afterwards to delete the ones no
+remaining entry references.`,
+	Args: cobra.NoArgs,
+	RunE: runCachePrune,
+}
+
+var cacheGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Delete image files that no cache entry references",
+	Long: `Delete images in the output directory that no cache entry references,
+such as files left behind by 'cache prune'.
+
+Don't run it while a batch is writing to the same output directory: an image
+is saved just before its entry is recorded.`,
+	Args: cobra.NoArgs,
+	RunE: runCacheGC,
+}
+
+var cacheExportCmd = &cobra.Command{
+	Use:   "export <archive.tar.gz>",
+	Short: "Bundle cache entries and their images into an archive",
+	Long: `Write every cache entry whose images exist, along with those images, to a
+gzipped tarball that 'cache import' can merge into another output directory.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runCacheExport,
+}
+
+var cacheImportCmd = &cobra.Command{
+	Use:   "import <archive.tar.gz>",
+	Short: "Merge an exported archive into the cache",
+	Long: `Merge the entries and images of an archive written by 'cache export' into
+the output directory's cache.
+
+When both have an entry for the same hash, the newer one wins. An imported
+image whose name is taken by a different entry is saved under its hash
+instead.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runCacheImport,
+}
+
+func init() {
+	cachePruneCmd.Flags().StringVar(&flagPruneBefore, "before", "", "Remove entries created before this date (YYYY-MM-DD or RFC 3339)")
+	cachePruneCmd.Flags().StringVar(&flagPruneModel, "model", "", "Remove entries for this model")
+
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cacheShowCmd)
+	cacheCmd.AddCommand(cacheVerifyCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+	cacheCmd.AddCommand(cacheGCCmd)
+	cacheCmd.AddCommand(cacheExportCmd)
+	cacheCmd.AddCommand(cacheImportCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
+
+// printEntry prints an entry's details in human-readable form.
+func printEntry(e *cache.Entry, missing []string, mismatches []cache.Mismatch) {
+	fmt.Printf("Hash:     %s\n", e.Hash)
+	fmt.Printf("Prompt:   %s\n", e.Prompt)
+	fmt.Printf("Model:    %s\n", e.Model)
+	if e.Provider != "" {
+		fmt.Printf("Provider: %s\n", e.Provider)
+	}
+	if len(e.Params) > 0 {
+		params, _ := json.Marshal(e.Params)
+		fmt.Printf("Params:   %s\n", params)
+	}
+	if e.Image != "" {
+		fmt.Printf("Image:    %s\n", e.Image)
+	}
+	if e.Mask != "" {
+		fmt.Printf("Mask:     %s\n", e.Mask)
+	}
+	fmt.Printf("Created:  %s\n", e.CreatedAt.Local().Format(time.DateTime))
+	for _, p := range outputPaths(e.Files()) {
+		marker := ""
+		for _, m := range missing {
+			if m == p {
+				marker = " (missing)"
+			}
+		}
+		for _, m := range mismatches {
+			if m.File == p {
+				marker = fmt.Sprintf(" (%s mismatch)", m.Reason)
+			}
+		}
+		fmt.Printf("File:     %s%s\n", p, marker)
+	}
+	for _, a := range e.Aliases {
+		fmt.Printf("Alias:    %s\n", strings.Join(outputPaths(a.Files), ", "))
+	}
+	for _, v := range e.Variants {
+		fmt.Printf("Variant:  %s (%dw)\n", strings.Join(outputPaths(v.Files), ", "), v.Width)
+	}
+	if len(e.Revisions) > 0 {
+		fmt.Printf("History:  %d earlier revisions (see 'history %s')\n", len(e.Revisions), e.Hash)
+	}
+}
+
+func runCacheList(_ *cobra.Command, _ []string) error {
+	c, err := loadCache()
+	if err != nil {
+		return err
+	}
+
+	for i := range c.Entries {
+		e := &c.Entries[i]
+		if flagJSON {
+			outputJSON(CacheEntryResult{Entry: *e})
+		} else if shouldOutput() {
+			prompt := e.Prompt
+			if runes := []rune(prompt); len(runes) > 60 {
+				prompt = string(runes[:57]) + "..." // By rune, not to split a character
+			}
+			fmt.Printf("%s  %s  %-32s  %s\n", e.Hash, e.CreatedAt.Local().Format(time.DateOnly), e.Model, prompt)
+		}
+	}
+	if shouldOutput() {
+		fmt.Printf("\n%d entries\n", len(c.Entries))
+	}
+	return nil
+}
+
+// findEntries returns the entries matching a hash, hash prefix or output
+// name. An exact hash match wins over everything else.
+func findEntries(c *cache.Cache, ref string) []*cache.Entry {
+	if e := c.Lookup(ref); e != nil {
+		return []*cache.Entry{e}
+	}
+	var matches []*cache.Entry
+	for i := range c.Entries {
+		e := &c.Entries[i]
+		if strings.HasPrefix(e.Hash, ref) {
+			matches = append(matches, e)
+			continue
+		}
+		if slices.ContainsFunc(e.Aliases, func(a cache.Alias) bool { return a.Name == ref }) {
+			matches = append(matches, e)
+			continue
+		}
+		for _, f := range e.Files() {
+			if f == ref || strings.TrimSuffix(f, filepath.Ext(f)) == ref {
+				matches = append(matches, e)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// findEntry returns the single entry matching ref, as findEntries does.
+func findEntry(c *cache.Cache, ref string) (*cache.Entry, error) {
+	matches := findEntries(c, ref)
+	switch len(matches) {
+	case 0:
+		return nil, &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("no cache entry matches %q", ref)}
+	case 1:
+		return matches[0], nil
+	default:
+		hashes := make([]string, len(matches))
+		for i, e := range matches {
+			hashes[i] = e.Hash
+		}
+		return nil, &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("%q matches %d entries: %s", ref, len(matches), strings.Join(hashes, ", "))}
+	}
+}
+
+func runCacheShow(_ *cobra.Command, args []string) error {
+	c, err := loadCache()
+	if err != nil {
+		return err
+	}
+
+	e, err := findEntry(c, args[0])
+	if err != nil {
+		return err
+	}
+	missing, mismatches := c.Check(e)
+	if flagJSON {
+		outputJSON(CacheEntryResult{Entry: *e, MissingFiles: missing, Mismatches: mismatches})
+	} else if !flagQuiet {
+		printEntry(e, missing, mismatches)
+	}
+	return nil
+}
+
+func runCacheVerify(_ *cobra.Command, _ []string) error {
+	c, err := loadCache()
+	if err != nil {
+		return err
+	}
+
+	var broken int
+	for i := range c.Entries {
+		e := &c.Entries[i]
+		missing, mismatches := c.Check(e)
+		if len(missing) == 0 && len(mismatches) == 0 {
+			continue
+		}
+		broken++
+		status := "missing"
+		if len(mismatches) > 0 {
+			status = "corrupt"
+		}
+		if flagJSON {
+			outputJSON(CacheEntryResult{Entry: *e, Status: status, MissingFiles: missing, Mismatches: mismatches})
+		} else if shouldOutput() {
+			fmt.Printf("[%s] %s\n", status, e.Prompt)
+			fmt.Printf("         Hash:  %s\n", e.Hash)
+			for _, p := range missing {
+				fmt.Printf("         File:  %s (missing)\n", p)
+			}
+			for _, m := range mismatches {
+				fmt.Printf("         File:  %s (%s mismatch)\n", m.File, m.Reason)
+			}
+		}
+	}
+
+	if shouldOutput() {
+		fmt.Printf("\nVerified %d entries, %d with missing or changed files.\n", len(c.Entries), broken)
+	}
+	if broken > 0 {
+		return &ExitError{Code: ExitPartialFail, Message: fmt.Sprintf("%d cache entries have missing or changed files", broken)}
+	}
+	return nil
+}
+
+// parseDate parses a YYYY-MM-DD date in local time, or an RFC 3339 timestamp.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func runCachePrune(_ *cobra.Command, _ []string) error {
+	if flagPruneBefore == "" && flagPruneModel == "" {
+		return &ExitError{Code: ExitInvalidInput, Message: "prune needs --before, --model or both"}
+	}
+	var before time.Time
+	if flagPruneBefore != "" {
+		t, err := parseDate(flagPruneBefore)
+		if err != nil {
+			return &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("invalid --before %q: want YYYY-MM-DD or RFC 3339", flagPruneBefore)}
+		}
+		before = t
+	}
+
+	c, err := loadCache()
+	if err != nil {
+		return err
+	}
+
+	status := "pruned"
+	if flagDryRun {
+		status = "would_prune"
+	}
+	var hashes []string
+	for i := range c.Entries {
+		e := &c.Entries[i]
+		if flagPruneModel != "" && e.Model != flagPruneModel {
+			continue
+		}
+		if !before.IsZero() && !e.CreatedAt.Before(before) {
+			continue
+		}
+		hashes = append(hashes, e.Hash)
+		if flagJSON {
+			outputJSON(CacheEntryResult{Entry: *e, Status: status})
+		} else if shouldOutput() {
+			fmt.Printf("[%s] %s (%s)\n", status, e.Prompt, e.Hash)
+		}
+	}
+
+	if !flagDryRun && len(hashes) > 0 {
+		c.Remove(hashes...)
+		if err := c.Save(); err != nil {
+			return fmt.Errorf("failed to save cache: %w", err)
+		}
+	}
+
+	if shouldOutput() {
+		if flagDryRun {
+			fmt.Printf("\nWould remove %d of %d entries.\n", len(hashes), len(c.Entries))
+		} else {
+			fmt.Printf("\nRemoved %d entries, %d left.\n", len(hashes), len(c.Entries))
+		}
+	}
+	return nil
+}
+
+func runCacheGC(_ *cobra.Command, _ []string) error {
+	c, err := loadCache()
+	if err != nil {
+		return err
+	}
+
+	referenced := make(map[string]bool)
+	for i := range c.Entries {
+		for _, f := range c.Entries[i].AllFiles() {
+			referenced[f] = true
+		}
+	}
+
+	files, err := os.ReadDir(flagOutput)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read output directory: %w", err)
+	}
+
+	status := "deleted"
+	if flagDryRun {
+		status = "would_delete"
+	}
+	var count int
+	var freed int64
+	for _, f := range files {
+		if !f.Type().IsRegular() || !imageExts[strings.ToLower(filepath.Ext(f.Name()))] || referenced[f.Name()] {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(flagOutput, f.Name())
+		if !flagDryRun {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", path, err)
+			}
+		}
+		count++
+		freed += info.Size()
+
+		if flagJSON {
+			outputJSON(GCResult{File: path, Size: info.Size(), Status: status})
+		} else if shouldOutput() {
+			fmt.Printf("[%s] %s\n", status, path)
+		}
+	}
+
+	if shouldOutput() {
+		verb := "Deleted"
+		if flagDryRun {
+			verb = "Would delete"
+		}
+		fmt.Printf("\n%s %d files (%s).\n", verb, count, formatSize(freed))
+	}
+	return nil
+}
+
+func runCacheExport(_ *cobra.Command, args []string) error {
+	c, err := loadCache()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	stats, err := c.Export(f, flagOutput)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(args[0])
+		return fmt.Errorf("failed to export cache: %w", err)
+	}
+
+	if flagJSON {
+		outputJSON(ExportResult{Archive: args[0], ExportStats: stats})
+	} else if shouldOutput() {
+		fmt.Printf("Exported %d entries (%d files) to %s.\n", stats.Entries, stats.Files, args[0])
+		if stats.Skipped > 0 {
+			fmt.Printf("Skipped %d entries with missing files; see 'cache verify'.\n", stats.Skipped)
+		}
+	}
+	return nil
+}
+
+func runCacheImport(_ *cobra.Command, args []string) error {
+	f, err := os.Open(args[0])
+	if err != nil {
+		return &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("failed to read archive: %v", err)}
+	}
+	defer func() { _ = f.Close() }()
+
+	if err := os.MkdirAll(flagOutput, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	c, err := loadCache()
+	if err != nil {
+		return err
+	}
+
+	stats, err := c.Import(f, flagOutput)
+	if err != nil {
+		return &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("failed to import %s: %v", args[0], err)}
+	}
+	if err := c.Save(); err != nil {
+		return fmt.Errorf("failed to save cache: %w", err)
+	}
+
+	if flagJSON {
+		outputJSON(ImportResult{Archive: args[0], ImportStats: stats})
+	} else if shouldOutput() {
+		fmt.Printf("Imported %s: %d added, %d updated, %d already up to date.\n", args[0], stats.Added, stats.Updated, stats.Skipped)
+	}
+	return nil
+}
+
+// formatSize formats a byte count for humans, e.g. "1.5 MB".
+func formatSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/cache"
+)
+
+// captureStdout returns what fn prints to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(stdout *os.File) { os.Stdout = stdout }(os.Stdout)
+	os.Stdout = w
+
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	fn()
+	_ = w.Close()
+	return <-out
+}
+
+// cachedBatch generates a batch of a cat and a dog, named after them, with
+// the fake provider, and returns the cache.
+func cachedBatch(t *testing.T) *cache.Cache {
+	t.Helper()
+	_, prompts := batchDir(t, `prompts:
+  - prompt: a cat
+    name: cat
+  - prompt: a dog
+    name: dog
+    model: stability-ai/sdxl
+`)
+	if err := runBatch(command(context.Background()), []string{prompts}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := cache.Load(flagOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCacheVerify(t *testing.T) {
+	c := cachedBatch(t)
+	if err := runCacheVerify(nil, nil); err != nil {
+		t.Fatalf("verify of a fresh cache = %v", err)
+	}
+
+	var cat, dog string
+	for _, e := range c.Entries {
+		if e.Prompt == "a cat" {
+			cat = e.OutputFile
+		} else {
+			dog = e.OutputFile
+		}
+	}
+	// Replaced rather than written in place, so the alias keeps the original.
+	if err := os.Remove(filepath.Join(flagOutput, cat)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(flagOutput, cat), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(flagOutput, dog)); err != nil {
+		t.Fatal(err)
+	}
+
+	setFlag(t, &flagJSON, true)
+	var err error
+	out := captureStdout(t, func() { err = runCacheVerify(nil, nil) })
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != ExitPartialFail {
+		t.Errorf("verify = %v, want a partial failure", err)
+	}
+
+	statuses := map[string]string{}
+	dec := json.NewDecoder(strings.NewReader(out))
+	for dec.More() {
+		var r CacheEntryResult
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		statuses[r.Prompt] = r.Status
+	}
+	if want := map[string]string{"a cat": "corrupt", "a dog": "missing"}; !maps.Equal(statuses, want) {
+		t.Errorf("verify reported %v, want %v", statuses, want)
+	}
+}
+
+func TestCachePruneGC(t *testing.T) {
+	c := cachedBatch(t)
+	var catFiles, dogFiles []string
+	for _, e := range c.Entries {
+		if e.Prompt == "a cat" {
+			catFiles = e.AllFiles()
+		} else {
+			dogFiles = e.AllFiles()
+		}
+	}
+	for name, content := range map[string]string{"stray.webp": "stray", "notes.txt": "notes"} {
+		if err := os.WriteFile(filepath.Join(flagOutput, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setFlag(t, &flagPruneModel, "black-forest-labs/flux-schnell")
+	if err := runCachePrune(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Pruning removes entries, not files.
+	if c, err := cache.Load(flagOutput); err != nil || len(c.Entries) != 1 || c.Entries[0].Prompt != "a dog" {
+		t.Fatalf("after prune, cache = %+v, %v; want only the dog", c, err)
+	}
+
+	// Files only the pruned entry referenced, its alias included, are orphans.
+	orphans := append(slices.Clone(catFiles), "stray.webp")
+	slices.Sort(orphans)
+	setFlag(t, &flagQuiet, false)
+	setFlag(t, &flagDryRun, true)
+	out := captureStdout(t, func() {
+		if err := runCacheGC(nil, nil); err != nil {
+			t.Error(err)
+		}
+	})
+	var listed []string
+	for _, line := range strings.Split(out, "\n") {
+		if path, ok := strings.CutPrefix(line, "[would_delete] "); ok {
+			listed = append(listed, filepath.Base(path))
+		}
+	}
+	slices.Sort(listed)
+	if !slices.Equal(listed, orphans) {
+		t.Errorf("gc --dry-run listed %v, want %v", listed, orphans)
+	}
+	if !strings.Contains(out, "Would delete 3 files") {
+		t.Errorf("gc --dry-run summary missing from %q", out)
+	}
+	for _, f := range orphans {
+		if _, err := os.Stat(filepath.Join(flagOutput, f)); err != nil {
+			t.Errorf("gc --dry-run deleted %s", f)
+		}
+	}
+
+	setFlag(t, &flagDryRun, false)
+	captureStdout(t, func() {
+		if err := runCacheGC(nil, nil); err != nil {
+			t.Error(err)
+		}
+	})
+	for _, f := range orphans {
+		if _, err := os.Stat(filepath.Join(flagOutput, f)); err == nil {
+			t.Errorf("gc kept %s", f)
+		}
+	}
+	for _, f := range append(dogFiles, "notes.txt") {
+		if _, err := os.Stat(filepath.Join(flagOutput, f)); err != nil {
+			t.Errorf("gc deleted %s", f)
+		}
+	}
+}
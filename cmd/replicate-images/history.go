@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/cache"
+	"github.com/spf13/cobra"
+)
+
+// HistoryResult represents the JSON output for one generation of an entry.
+type HistoryResult struct {
+	Hash        string    `json:"hash"`
+	Revision    int       `json:"revision,omitempty"` // Unset for the current images
+	Current     bool      `json:"current"`
+	OutputFile  string    `json:"output_file"`
+	OutputFiles []string  `json:"output_files,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history <hash|name>",
+	Short: "List earlier generations of a cached image",
+	Long: `List the current images of a cache entry and the earlier generations kept
+when it was regenerated, e.g. with --no-cache, newest first.
+
+Earlier generations are saved next to the current images as
+<hash>@r<revision>.webp. Use 'restore' to make one current again.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runHistory,
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <hash|name> <revision>",
+	Short: "Make an earlier generation of a cached image current again",
+	Long: `Move the images of a revision listed by 'history' back to the entry's output
+files. The current images are kept as a new revision first, so restoring is
+never lossy.`,
+	Args: cobra.ExactArgs(2),
+	RunE: runRestore,
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	rootCmd.AddCommand(restoreCmd)
+}
+
+func runHistory(_ *cobra.Command, args []string) error {
+	c, err := loadCache()
+	if err != nil {
+		return err
+	}
+	e, err := findEntry(c, args[0])
+	if err != nil {
+		return err
+	}
+
+	results := []HistoryResult{{
+		Hash:        e.Hash,
+		Current:     true,
+		OutputFile:  outputPaths(e.Files())[0],
+		OutputFiles: outputPaths(e.OutputFiles),
+		CreatedAt:   e.CreatedAt,
+	}}
+	for i := len(e.Revisions) - 1; i >= 0; i-- {
+		r := &e.Revisions[i]
+		results = append(results, HistoryResult{
+			Hash:        e.Hash,
+			Revision:    r.Number,
+			OutputFile:  outputPaths(r.Files())[0],
+			OutputFiles: outputPaths(r.OutputFiles),
+			CreatedAt:   r.CreatedAt,
+		})
+	}
+
+	for _, r := range results {
+		if flagJSON {
+			outputJSON(r)
+			continue
+		}
+		if !shouldOutput() {
+			continue
+		}
+		label := "current"
+		if !r.Current {
+			label = fmt.Sprintf("r%d", r.Revision)
+		}
+		files := r.OutputFiles
+		if len(files) == 0 {
+			files = []string{r.OutputFile}
+		}
+		for i, f := range files {
+			if i == 0 {
+				fmt.Printf("%-8s %s  %s\n", label, r.CreatedAt.Local().Format(time.DateTime), f)
+			} else {
+				fmt.Printf("%-8s %19s  %s\n", "", "", f)
+			}
+		}
+	}
+	if shouldOutput() && !flagJSON && len(e.Revisions) == 0 {
+		fmt.Println("\nNo earlier revisions.")
+	}
+	return nil
+}
+
+func runRestore(_ *cobra.Command, args []string) error {
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 {
+		return &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("invalid revision %q: want a number from 'history'", args[1])}
+	}
+	c, err := loadCache()
+	if err != nil {
+		return err
+	}
+	e, err := findEntry(c, args[0])
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(e.Revisions, func(r cache.Revision) bool { return r.Number == n }) {
+		return &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("%s has no revision %d", e.Hash, n)}
+	}
+	if flagDryRun {
+		if shouldOutput() {
+			fmt.Printf("Would restore revision %d of %s\n", n, e.Hash)
+		}
+		return nil
+	}
+
+	e, err = c.Restore(e.Hash, n)
+	if err != nil {
+		return fmt.Errorf("failed to restore revision %d: %w", n, err)
+	}
+	relinkAliases(c, e.Hash)
+	if err := c.Save(); err != nil {
+		return fmt.Errorf("failed to save cache: %w", err)
+	}
+
+	if flagJSON {
+		outputJSON(CacheEntryResult{Entry: *e, Status: "restored"})
+	} else if shouldOutput() {
+		fmt.Printf("Restored revision %d of %s\n", n, e.Hash)
+		for _, p := range outputPaths(e.Files()) {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+	return nil
+}
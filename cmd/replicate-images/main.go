@@ -3,16 +3,26 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/kevinmichaelchen/replicate-images/internal/cache"
+	"github.com/kevinmichaelchen/replicate-images/internal/cassette"
 	"github.com/kevinmichaelchen/replicate-images/internal/client"
 	"github.com/kevinmichaelchen/replicate-images/internal/convert"
 	"github.com/kevinmichaelchen/replicate-images/internal/models"
+	"github.com/kevinmichaelchen/replicate-images/internal/pending"
+	"github.com/kevinmichaelchen/replicate-images/internal/retry"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
 )
@@ -26,24 +36,56 @@ const (
 )
 
 var (
-	flagModel       string
-	flagOutput      string
-	flagNoCache     bool
-	flagConcurrency int
-	flagJSON        bool
-	flagDryRun      bool
-	flagQuiet       bool
+	flagModel        string
+	flagOutput       string
+	flagNoCache      bool
+	flagRefresh      bool
+	flagConcurrency  int
+	flagJSON         bool
+	flagDryRun       bool
+	flagQuiet        bool
+	flagParams       []string
+	flagCount        int
+	flagAsync        bool
+	flagRetries      int
+	flagRetryDelay   time.Duration
+	flagProvider     string
+	flagProviderURL  string
+	flagRecord       string
+	flagReplay       string
+	flagImage        string
+	flagImageParam   string
+	flagMask         string
+	flagCacheBackend string
+	flagRemoteCache  string
+	flagStore        bool
+	flagMaxCacheSize string
+	flagCacheTTL     time.Duration
+	flagFormat       string
+	flagQuality      int
+	flagSizes        []int
 )
 
 // GenerateResult represents the JSON output for a single generation.
 type GenerateResult struct {
-	Status     string `json:"status"`
-	Prompt     string `json:"prompt"`
-	Model      string `json:"model"`
-	Hash       string `json:"hash"`
-	OutputFile string `json:"output_file,omitempty"`
-	Cached     bool   `json:"cached"`
-	Error      string `json:"error,omitempty"`
+	Status       string          `json:"status"`
+	Prompt       string          `json:"prompt"`
+	Model        string          `json:"model"`
+	Params       map[string]any  `json:"params,omitempty"`
+	Image        string          `json:"image,omitempty"`
+	Mask         string          `json:"mask,omitempty"`
+	Hash         string          `json:"hash"`
+	OutputFile   string          `json:"output_file,omitempty"`
+	OutputFiles  []string        `json:"output_files,omitempty"`
+	Variants     []cache.Variant `json:"variants,omitempty"` // Downscaled copies, from --sizes or sizes
+	Cached       bool            `json:"cached"`
+	Attempts     int             `json:"attempts,omitempty"`
+	PredictionID string          `json:"prediction_id,omitempty"`
+	Error        string          `json:"error,omitempty"`
+
+	// CacheMismatches lists cached files that no longer matched their
+	// checksums, so the image was generated again.
+	CacheMismatches []cache.Mismatch `json:"cache_mismatches,omitempty"`
 }
 
 // DryRunResult represents the JSON output for a dry-run.
@@ -55,12 +97,19 @@ type DryRunResult struct {
 
 // DryRunPrompt represents a single prompt in dry-run output.
 type DryRunPrompt struct {
-	Prompt     string `json:"prompt"`
-	Model      string `json:"model"`
-	Hash       string `json:"hash"`
-	Name       string `json:"name,omitempty"`
-	Status     string `json:"status"`
-	OutputFile string `json:"output_file,omitempty"`
+	Prompt      string         `json:"prompt"`
+	Model       string         `json:"model"`
+	Params      map[string]any `json:"params,omitempty"`
+	Image       string         `json:"image,omitempty"`
+	ImageFrom   string         `json:"image_from,omitempty"`
+	Mask        string         `json:"mask,omitempty"`
+	Hash        string         `json:"hash,omitempty"` // Unknown until an image_from source is generated
+	Name        string         `json:"name,omitempty"`
+	Status      string         `json:"status"`
+	OutputFile  string         `json:"output_file,omitempty"`
+	OutputFiles []string       `json:"output_files,omitempty"`
+
+	CacheMismatches []cache.Mismatch `json:"cache_mismatches,omitempty"` // Why a cached image is pending again
 }
 
 // ExitError represents an error with a specific exit code.
@@ -74,7 +123,7 @@ func (e *ExitError) Error() string {
 }
 
 func main() {
-	if err := rootCmd.Execute(); err != nil {
+	if err := rootCmd.ExecuteContext(signalContext()); err != nil {
 		if exitErr, ok := err.(*ExitError); ok {
 			if exitErr.Message != "" && !flagJSON {
 				fmt.Fprintln(os.Stderr, exitErr.Message)
@@ -88,6 +137,21 @@ func main() {
 	}
 }
 
+// signalContext returns a context canceled by SIGINT or SIGTERM, so commands
+// can cancel remote predictions and save finished work before exiting.
+// A second signal terminates the process immediately.
+func signalContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		if !flagQuiet {
+			fmt.Fprintln(os.Stderr, "\nInterrupted: canceling running predictions and saving finished images. Press Ctrl-C again to quit now.")
+		}
+	}()
+	return ctx
+}
+
 var rootCmd = &cobra.Command{
 	Use:           "replicate-images [prompt]",
 	Short:         "Generate images from text prompts using Replicate",
@@ -95,10 +159,13 @@ var rootCmd = &cobra.Command{
 	SilenceUsage:  true,
 	Long: `A CLI tool that generates images from text prompts using Replicate's API.
 
-Images are cached based on prompt+model hash to avoid regenerating duplicates.
-Output files are saved as WEBP in the output directory.`,
-	Args: cobra.ExactArgs(1),
-	RunE: runGenerate,
+Images are cached based on a hash of the prompt, model and model inputs to
+avoid regenerating duplicates.
+Output files are saved as WEBP in the output directory, or as PNG or JPEG
+with --format.`,
+	Args:              cobra.ExactArgs(1),
+	PersistentPreRunE: resolveProvider,
+	RunE:              runGenerate,
 }
 
 var modelsCmd = &cobra.Command{
@@ -127,9 +194,25 @@ Example prompts.yaml:
     - prompt: "a dog on the moon"
     - prompt: "a bird underwater"
       model: stability-ai/sdxl
+      params:
+        aspect_ratio: "16:9"
+      count: 4
+    - prompt: "the same bird as a watercolor"
+      model: black-forest-labs/flux-1.1-pro
+      image: refs/bird.png
+    - prompt: "a red sky"
+      model: black-forest-labs/flux-fill-pro
+      name: cat-space-red-sky
+      image_from: cat-space
+      mask: masks/sky.png
 
 Prompts without a model use the default or --model flag value.
-Existing cached images are skipped unless --no-cache is set.`,
+Entry params override --param values, which override model defaults.
+Reference image and mask paths are relative to the prompts file.
+image_from uses the output of an earlier named prompt as the reference image;
+such prompts run once their source has been generated.
+Existing cached images are skipped unless --no-cache is set, or --refresh
+for prompts whose model isn't pinned to a version.`,
 	Args: cobra.ExactArgs(1),
 	RunE: runBatch,
 }
@@ -143,6 +226,9 @@ Validates:
   - YAML syntax
   - Required fields (prompt)
   - Empty prompts
+  - Invalid counts
+  - Unreadable reference images and masks
+  - image_from names that don't match an earlier prompt
   - Duplicate prompt/model combinations
   - Duplicate names`,
 	Args: cobra.ExactArgs(1),
@@ -152,15 +238,43 @@ Validates:
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&flagOutput, "output", "o", "./generated-images", "Output directory")
 	rootCmd.PersistentFlags().BoolVar(&flagNoCache, "no-cache", false, "Force regeneration, ignore cache")
+	rootCmd.PersistentFlags().BoolVar(&flagRefresh, "refresh", false, "Regenerate images from models not pinned to a :version")
 	rootCmd.PersistentFlags().BoolVar(&flagJSON, "json", false, "Output results as JSON (JSONL for batch)")
 	rootCmd.PersistentFlags().BoolVar(&flagDryRun, "dry-run", false, "Show what would be generated without executing")
 	rootCmd.PersistentFlags().BoolVarP(&flagQuiet, "quiet", "q", false, "Suppress all output except errors")
+	rootCmd.PersistentFlags().StringVar(&flagProvider, "provider", client.ProviderReplicate, fmt.Sprintf("Image generation backend %v", client.Providers))
+	rootCmd.PersistentFlags().StringVar(&flagProviderURL, "provider-url", "", "API base URL for the provider (replicate also reads REPLICATE_BASE_URL)")
+	rootCmd.PersistentFlags().StringVar(&flagRecord, "record", "", "Record API and download HTTP exchanges into this directory")
+	rootCmd.PersistentFlags().StringVar(&flagReplay, "replay", "", "Serve API and download HTTP exchanges from this recorded directory")
+	rootCmd.PersistentFlags().StringVar(&flagCacheBackend, "cache-backend", "", fmt.Sprintf("Cache storage %v (default: bolt if the output directory has a cache.db, else json)", cache.Backends))
+	rootCmd.PersistentFlags().BoolVar(&flagStore, "store", false, "Share images with other projects through the user-level store")
+	rootCmd.PersistentFlags().StringVar(&flagRemoteCache, "remote-cache", "", "Shared cache in an S3-compatible bucket, as s3://bucket/prefix")
+	rootCmd.PersistentFlags().StringVar(&flagMaxCacheSize, "max-cache-size", "", "Evict least recently used images beyond this size, e.g. 500MB or 2GiB")
+	rootCmd.PersistentFlags().DurationVar(&flagCacheTTL, "cache-ttl", 0, "Evict images unused for longer than this, e.g. 720h")
+	rootCmd.PersistentFlags().IntVar(&flagRetries, "retries", retry.DefaultPolicy.MaxRetries, "Retries for rate limits and transient failures")
+	rootCmd.PersistentFlags().DurationVar(&flagRetryDelay, "retry-delay", retry.DefaultPolicy.BaseDelay, "Initial retry backoff, doubled on each retry")
+	rootCmd.Flags().BoolVar(&flagAsync, "async", false, "Submit the prediction and return; download later with 'fetch'")
 	rootCmd.Flags().StringVarP(&flagModel, "model", "m", models.Default, "Replicate model to use")
+	rootCmd.Flags().StringArrayVar(&flagParams, "param", nil, "Model input parameter as key=value (repeatable)")
+	rootCmd.Flags().IntVarP(&flagCount, "count", "n", 1, "Number of images to generate (sets num_outputs)")
+	rootCmd.Flags().StringVar(&flagImage, "image", "", "Reference image for image-to-image models (path or URL)")
+	rootCmd.Flags().StringVar(&flagMask, "mask", "", "Inpainting mask for --image (path or URL)")
+	rootCmd.Flags().StringVar(&flagImageParam, "image-param", "", "Model input that takes --image (default from the model registry, else \"image\")")
+	rootCmd.Flags().StringVar(&flagFormat, "format", convert.FormatWebP, fmt.Sprintf("Output image format %v", convert.Formats))
+	rootCmd.Flags().IntVar(&flagQuality, "quality", 0, "JPEG or WEBP quality 1-100 (JPEG default 90); WEBP without one is lossless")
+	rootCmd.Flags().IntSliceVar(&flagSizes, "sizes", nil, "Also save copies scaled down to these widths, e.g. 320,640,1280")
 
 	batchCmd.Flags().StringVarP(&flagModel, "model", "m", models.Default, "Default model for prompts without one")
+	batchCmd.Flags().StringArrayVar(&flagParams, "param", nil, "Model input parameter as key=value for every prompt (repeatable)")
+	batchCmd.Flags().IntVarP(&flagCount, "count", "n", 1, "Number of images per prompt without a count (sets num_outputs)")
 	batchCmd.Flags().IntVarP(&flagConcurrency, "concurrency", "c", 3, "Number of concurrent generations")
+	batchCmd.Flags().BoolVar(&flagAsync, "async", false, "Submit predictions and return; download later with 'fetch'")
+	batchCmd.Flags().StringVar(&flagFormat, "format", convert.FormatWebP, fmt.Sprintf("Output image format for prompts without one %v", convert.Formats))
+	batchCmd.Flags().IntVar(&flagQuality, "quality", 0, "JPEG or WEBP quality 1-100 for JPEG and WEBP prompts without one")
+	batchCmd.Flags().IntSliceVar(&flagSizes, "sizes", nil, "Widths to also save scaled-down copies at, for prompts without sizes")
 
 	validateCmd.Flags().StringVarP(&flagModel, "model", "m", models.Default, "Default model for prompts without one")
+	validateCmd.Flags().StringVar(&flagFormat, "format", convert.FormatWebP, "Output image format for prompts without one")
 
 	rootCmd.AddCommand(modelsCmd)
 	rootCmd.AddCommand(supportedModelsCmd)
@@ -173,8 +287,548 @@ func shouldOutput() bool {
 	return !flagJSON && !flagQuiet
 }
 
+// parseParams parses repeated key=value flags into model input parameters.
+// Values are decoded as YAML scalars, so numbers and booleans keep their type.
+func parseParams(pairs []string) (map[string]any, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	params := make(map[string]any, len(pairs))
+	for _, pair := range pairs {
+		key, raw, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("invalid --param %q: expected key=value", pair)}
+		}
+		var value any
+		if err := yaml.Unmarshal([]byte(raw), &value); err != nil || value == nil {
+			value = raw
+		}
+		params[key] = value
+	}
+	return params, nil
+}
+
+// mergeParams overlays override on top of base. Returns nil if both are empty.
+func mergeParams(base, override map[string]any) map[string]any {
+	if len(base) == 0 && len(override) == 0 {
+		return nil
+	}
+	merged := make(map[string]any, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	return merged
+}
+
+// useCache reports whether cached images from model can be used. Keys hold
+// the model as given, so an unpinned model's cached images may come from an
+// older version than the latest; --refresh regenerates them.
+func useCache(model string) bool {
+	return !flagNoCache && !(flagRefresh && !models.IsPinned(model))
+}
+
+// withCount sets the num_outputs input from an image count.
+// A count of 1 or less, or an explicit num_outputs param, leaves params unchanged.
+func withCount(params map[string]any, count int) map[string]any {
+	if count <= 1 {
+		return params
+	}
+	if _, ok := params["num_outputs"]; ok {
+		return params
+	}
+	return mergeParams(params, map[string]any{"num_outputs": count})
+}
+
+// checkCount validates --count or a prompt's count.
+func checkCount(count int) error {
+	if count < 1 {
+		return &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("invalid count %d: want 1 or more", count)}
+	}
+	return nil
+}
+
+// checkCounts validates --count and the count of every prompt in pf that sets
+// one.
+func checkCounts(pf *PromptFile) error {
+	if err := checkCount(flagCount); err != nil {
+		return err
+	}
+	for i, p := range pf.Prompts {
+		if p.Count == 0 {
+			continue // Unset; --count applies
+		}
+		if err := checkCount(p.Count); err != nil {
+			return &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("prompt %d: %v", i+1, err)}
+		}
+	}
+	return nil
+}
+
+// outputFilenames returns the filenames for n images saved under base.
+// A single image is saved as "{base}{ext}"; several as "{base}-0{ext}", "{base}-1{ext}", ...
+func outputFilenames(base string, n int, ext string) []string {
+	if n == 1 {
+		return []string{base + ext}
+	}
+	filenames := make([]string, n)
+	for i := range filenames {
+		filenames[i] = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	return filenames
+}
+
+// outputPaths joins filenames onto the output directory.
+func outputPaths(filenames []string) []string {
+	paths := make([]string, len(filenames))
+	for i, f := range filenames {
+		paths[i] = filepath.Join(flagOutput, f)
+	}
+	return paths
+}
+
+// saveImages converts images to the output format recorded in key and writes
+// them to the output directory under its hash, returning their filenames.
+func saveImages(images []client.Image, key cache.Key) ([]string, error) {
+	out := savedOptions(key.Format, key.Quality)
+	filenames := outputFilenames(key.Hash(), len(images), out.Ext())
+	for i, img := range images {
+		if err := convert.Save(img.Data, filepath.Join(flagOutput, filenames[i]), out); err != nil {
+			return nil, err
+		}
+	}
+	return filenames, nil
+}
+
+// cachedOutputs returns the output paths of a cache hit, or nil if there is
+// no entry for hash or any of its files no longer exist. Files whose size or
+// checksum changed since they were cached are returned as mismatches, and
+// are a miss too.
+func cachedOutputs(c *cache.Cache, hash string) ([]string, []cache.Mismatch) {
+	if c == nil {
+		return nil, nil
+	}
+	entry := c.Lookup(hash)
+	if entry == nil {
+		return nil, nil
+	}
+	missing, mismatches := c.Check(entry)
+	if len(mismatches) > 0 && !flagJSON {
+		for _, m := range mismatches {
+			fmt.Fprintf(os.Stderr, "Warning: %s changed since it was cached (%s mismatch); not using it\n", m.File, m.Reason)
+		}
+	}
+	if len(missing) > 0 || len(mismatches) > 0 {
+		return nil, mismatches
+	}
+	return outputPaths(entry.Files()), nil
+}
+
+// resolveProvider validates --provider and, unless --model was given,
+// switches the model to the provider's default.
+func resolveProvider(cmd *cobra.Command, _ []string) error {
+	if !slices.Contains(client.Providers, flagProvider) {
+		return &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("unknown provider %q (supported: %v)", flagProvider, client.Providers)}
+	}
+	if f := cmd.Flags().Lookup("model"); f != nil && !f.Changed {
+		flagModel = client.DefaultModel(flagProvider)
+	}
+	return nil
+}
+
+// loadCache loads the output directory's cache with the --cache-backend
+// storage, or the one it already uses.
+func loadCache() (*cache.Cache, error) {
+	backend, err := cacheBackend()
+	if err != nil {
+		return nil, err
+	}
+	c, err := cache.LoadBackend(flagOutput, backend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cache: %w", err)
+	}
+	if flagStore {
+		s, err := openStore()
+		if err != nil {
+			return nil, err
+		}
+		if !flagDryRun {
+			if err := s.Register(flagOutput); err != nil {
+				return nil, fmt.Errorf("failed to register with the store: %w", err)
+			}
+		}
+		c.SetStore(s)
+	}
+	if flagRemoteCache != "" {
+		r, err := cache.NewRemote(flagRemoteCache)
+		if err != nil {
+			return nil, &ExitError{Code: ExitInvalidInput, Message: err.Error()}
+		}
+		c.SetRemote(r)
+	}
+
+	limits := cache.Limits{TTL: flagCacheTTL}
+	if flagMaxCacheSize != "" {
+		if limits.MaxSize, err = cache.ParseSize(flagMaxCacheSize); err != nil {
+			return nil, &ExitError{Code: ExitInvalidInput, Message: err.Error()}
+		}
+	}
+	if flagCacheTTL < 0 {
+		return nil, &ExitError{Code: ExitInvalidInput, Message: "--cache-ttl must not be negative"}
+	}
+	c.SetLimits(limits)
+	return c, nil
+}
+
+// cacheBackend returns the --cache-backend storage, or, if unset, the one
+// the output directory's cache uses. Asking for json where there's a cache.db
+// is refused, since its cache.json would be out of date.
+func cacheBackend() (string, error) {
+	if flagCacheBackend != "" && !slices.Contains(cache.Backends, flagCacheBackend) {
+		return "", &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("unknown cache backend %q (supported: %v)", flagCacheBackend, cache.Backends)}
+	}
+	detected, err := cache.DetectBackend(flagOutput)
+	if err != nil {
+		return "", fmt.Errorf("failed to load cache: %w", err)
+	}
+	if flagCacheBackend == cache.BackendJSON && detected == cache.BackendBolt {
+		return "", &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("%s has a %s cache in %s; use --cache-backend %s", flagOutput, cache.BackendBolt, cache.BoltFileName, cache.BackendBolt)}
+	}
+	if flagCacheBackend != "" {
+		return flagCacheBackend, nil
+	}
+	return detected, nil
+}
+
+// lookupOutputs returns the output paths of a cache hit for hash, like
+// cachedOutputs. On a local miss it pulls the entry from the store or the
+// remote cache, if enabled. Dry runs only check locally.
+func lookupOutputs(ctx context.Context, c *cache.Cache, hash string) ([]string, []cache.Mismatch) {
+	paths, mismatches := cachedOutputs(c, hash)
+	if flagDryRun {
+		return paths, mismatches
+	}
+	if paths != nil {
+		c.Touch(hash)
+		return paths, nil
+	}
+	e, err := c.Pull(ctx, hash, flagOutput)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: shared cache lookup for %s failed: %v\n", hash, err)
+		return nil, mismatches
+	}
+	if e == nil {
+		return nil, mismatches
+	}
+	if err := c.Append(e); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to journal cache entry for %q: %v\n", e.Prompt, err)
+	}
+	return outputPaths(e.Files()), nil
+}
+
+// canonicalizeCache moves images cached under a prompt's name, by versions
+// that didn't keep aliases, to their hash. Dry runs change nothing.
+func canonicalizeCache(c *cache.Cache) {
+	if flagDryRun {
+		return
+	}
+	if _, err := c.Canonicalize(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to move named images to their hash: %v\n", err)
+	}
+}
+
+// aliasFor returns the alias of a prompt name for n images.
+func aliasFor(name string, files []string) cache.Alias {
+	return cache.Alias{Name: name, Files: outputFilenames(name, len(files), filepath.Ext(files[0]))}
+}
+
+// linkAlias links the files of a prompt's name to the images of the entry
+// for hash, at paths. It returns the paths to report for the prompt: the
+// alias's, or paths if it has no name.
+func linkAlias(c *cache.Cache, hash, name string, paths []string) []string {
+	if name == "" {
+		return paths
+	}
+	a := aliasFor(name, paths)
+	if !flagDryRun {
+		if err := c.AddAlias(hash, a); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to name %s %q: %v\n", hash, name, err)
+			return paths
+		}
+	}
+	return outputPaths(a.Files)
+}
+
+// relinkAliases links the aliases of the entry for hash to its images again,
+// after they were regenerated or restored.
+func relinkAliases(c *cache.Cache, hash string) {
+	e := c.Lookup(hash)
+	if e == nil || len(e.Aliases) == 0 {
+		return
+	}
+	aliases := make([]cache.Alias, len(e.Aliases))
+	for i, a := range e.Aliases {
+		aliases[i] = aliasFor(a.Name, e.Files())
+	}
+	if err := c.SetAliases(hash, aliases); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to update the names of %s: %v\n", hash, err)
+	}
+}
+
+// saveVariants writes copies of the images saved as filenames, scaled down to
+// each of widths, in the format out. Widths the images are no wider than are
+// left out.
+func saveVariants(filenames []string, widths []int, out convert.Options) ([]cache.Variant, error) {
+	var variants []cache.Variant
+	for _, w := range widths {
+		v := cache.Variant{Width: w, Files: make([]string, len(filenames))}
+		saved := true
+		for i, f := range filenames {
+			v.Files[i] = cache.VariantFile(f, w)
+			ok, err := convert.SaveResized(filepath.Join(flagOutput, f), filepath.Join(flagOutput, v.Files[i]), w, out)
+			if err != nil {
+				return variants, err
+			}
+			saved = saved && ok
+		}
+		if saved {
+			variants = append(variants, v)
+		}
+	}
+	return variants, nil
+}
+
+// addVariants records variants for the entry for hash, and returns its
+// variants at widths as the paths to report for a prompt: the alias's, if it
+// has a name.
+func addVariants(c *cache.Cache, hash, name string, widths []int, variants []cache.Variant) []cache.Variant {
+	for _, v := range variants {
+		if err := c.AddVariant(hash, v); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to record the %dw copy of %s: %v\n", v.Width, hash, err)
+		}
+	}
+	e := c.Lookup(hash)
+	if e == nil {
+		return nil
+	}
+	var result []cache.Variant
+	for _, w := range widths {
+		v := e.Variant(w)
+		if v == nil {
+			continue
+		}
+		r := *v
+		if name != "" {
+			r = cache.AliasVariant(aliasFor(name, e.Files()), w)
+		}
+		r.Files = outputPaths(r.Files)
+		result = append(result, r)
+	}
+	return result
+}
+
+// ensureVariants writes the variants at widths that the entry for hash is
+// missing, e.g. after a cache hit, and returns them like addVariants. A
+// failure only warns: the images themselves are cached either way.
+func ensureVariants(c *cache.Cache, hash, name string, widths []int) []cache.Variant {
+	e := c.Lookup(hash)
+	if e == nil || len(widths) == 0 {
+		return nil
+	}
+	var missing []int
+	for _, w := range widths {
+		if v := e.Variant(w); v == nil || !outputsExist(v.Files) {
+			missing = append(missing, w)
+		}
+	}
+	variants, err := saveVariants(e.Files(), missing, savedOptions(e.Format, e.Quality))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to scale down %s: %v\n", hash, err)
+	}
+	return addVariants(c, hash, name, widths, variants)
+}
+
+// outputsExist reports whether every file in filenames is in the output
+// directory.
+func outputsExist(filenames []string) bool {
+	for _, p := range outputPaths(filenames) {
+		if _, err := os.Stat(p); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// archiveEntry keeps the current images of the entry for hash as a revision
+// before they're regenerated. A failure only warns: the images are then
+// overwritten, as before revisions were kept.
+func archiveEntry(c *cache.Cache, hash string) {
+	if _, err := c.Archive(hash); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to keep the previous images of %s: %v\n", hash, err)
+	}
+}
+
+// pushEntry adds a newly generated entry to the store and the remote cache,
+// if enabled. A failure only warns: the images are saved locally either way.
+func pushEntry(ctx context.Context, c *cache.Cache, e cache.Entry) {
+	if err := c.Push(ctx, e, flagOutput); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to share %s: %v\n", e.Hash, err)
+	}
+}
+
+// evictCache removes the entries beyond --max-cache-size and --cache-ttl,
+// and their images, before the cache is saved. Dry runs evict nothing.
+func evictCache(c *cache.Cache) error {
+	if flagDryRun {
+		return nil
+	}
+	evicted, err := c.Evict(false)
+	if shouldOutput() && !flagJSON {
+		var freed int64
+		for _, ev := range evicted {
+			fmt.Printf("Evicted (%s): %s\n", ev.Reason, ev.Prompt)
+			freed += ev.Size
+		}
+		if len(evicted) > 0 {
+			fmt.Printf("Evicted %d cache entries, freeing %s.\n", len(evicted), formatSize(freed))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to evict cache entries: %w", err)
+	}
+	return nil
+}
+
+// clientConfig builds the generator configuration from flags.
+func clientConfig() (client.Config, error) {
+	cfg := client.Config{
+		Provider: flagProvider,
+		BaseURL:  flagProviderURL,
+		Retry: retry.Policy{
+			MaxRetries: flagRetries,
+			BaseDelay:  flagRetryDelay,
+			MaxDelay:   retry.DefaultPolicy.MaxDelay,
+		},
+	}
+
+	switch {
+	case flagRecord != "" && flagReplay != "":
+		return cfg, &ExitError{Code: ExitInvalidInput, Message: "--record and --replay are mutually exclusive"}
+	case flagRecord != "":
+		rec, err := cassette.NewRecorder(flagRecord, http.DefaultTransport)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Transport = rec
+	case flagReplay != "":
+		rep, err := cassette.NewReplayer(flagReplay)
+		if err != nil {
+			return cfg, &ExitError{Code: ExitInvalidInput, Message: err.Error()}
+		}
+		cfg.Transport = rep
+		// Recorded requests carry no token, so none is needed to replay them.
+		if os.Getenv("REPLICATE_API_TOKEN") == "" {
+			cfg.Token = "replay"
+		}
+	}
+	return cfg, nil
+}
+
+// newGenerator creates the generator selected by --provider. Tests replace it
+// to control how generation behaves.
+var newGenerator = func() (client.Generator, error) {
+	cfg, err := clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return client.NewGenerator(cfg)
+}
+
+// newKey builds the cache key for a generation request with the selected
+// provider. Replicate, the default, is left out so its keys don't change.
+// Reference images and masks are keyed by content, so they must be readable.
+func newKey(req client.Request, out convert.Options) (cache.Key, error) {
+	key := cache.NewKey(req.Prompt, req.Model, req.Params)
+	if flagProvider != client.ProviderReplicate {
+		key.Provider = flagProvider
+	}
+	if out.Format != convert.FormatWebP {
+		key.Format = out.Format
+	}
+	key.Quality = out.Quality
+	if req.Image != "" {
+		digest, err := cache.ImageDigest(req.Image)
+		if err != nil {
+			return key, &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("invalid reference image: %v", err)}
+		}
+		key.Image = digest
+		key.ImageParam = req.ImageParam
+	}
+	if req.Mask != "" {
+		digest, err := cache.ImageDigest(req.Mask)
+		if err != nil {
+			return key, &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("invalid mask: %v", err)}
+		}
+		key.Mask = digest
+	}
+	return key, nil
+}
+
+// outputOptions returns the save options for a format and quality. The format
+// defaults to --format, and a JPEG or WEBP quality to --quality, which doesn't
+// apply to PNG prompts.
+func outputOptions(format string, quality int) (convert.Options, error) {
+	if format == "" {
+		format = flagFormat
+	}
+	out, err := convert.NewOptions(format, quality)
+	if err == nil && quality == 0 && flagQuality != 0 && out.Format != convert.FormatPNG {
+		out, err = convert.NewOptions(format, flagQuality)
+	}
+	if err != nil {
+		return out, &ExitError{Code: ExitInvalidInput, Message: err.Error()}
+	}
+	return out, nil
+}
+
+// savedOptions returns the save options recorded as format and quality in a
+// cache key or entry.
+func savedOptions(format string, quality int) convert.Options {
+	if format == "" {
+		format = convert.FormatWebP
+	}
+	return convert.Options{Format: format, Quality: quality}
+}
+
+// checkSizes validates the widths of --sizes or a prompt's sizes, and returns
+// them sorted without duplicates.
+func checkSizes(sizes []int) ([]int, error) {
+	for _, w := range sizes {
+		if w <= 0 {
+			return nil, &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("invalid size %d: want a width in pixels", w)}
+		}
+	}
+	sizes = slices.Clone(sizes)
+	slices.Sort(sizes)
+	return slices.Compact(sizes), nil
+}
+
+// resolveImagePath resolves a reference image path relative to dir.
+// URLs and absolute paths are returned unchanged.
+func resolveImagePath(ref, dir string) string {
+	if ref == "" || client.IsURL(ref) || filepath.IsAbs(ref) {
+		return ref
+	}
+	return filepath.Join(dir, ref)
+}
+
 // warnUnsupportedModel prints a warning if the model isn't in the supported list.
 func warnUnsupportedModel(modelID string) {
+	if flagProvider != client.ProviderReplicate {
+		return
+	}
 	if !models.IsSupported(modelID) && shouldOutput() {
 		fmt.Fprintf(os.Stderr, "Warning: %s is not a supported model. It may work but is untested.\n", modelID)
 		fmt.Fprintf(os.Stderr, "Run 'replicate-images supported-models' to see supported models.\n\n")
@@ -214,30 +868,51 @@ func runSupportedModels(_ *cobra.Command, _ []string) error {
 	return nil
 }
 
-func runGenerate(_ *cobra.Command, args []string) error {
-	ctx := context.Background()
+func runGenerate(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
 	prompt := args[0]
 
+	params, err := parseParams(flagParams)
+	if err != nil {
+		return err
+	}
+	if err := checkCount(flagCount); err != nil {
+		return err
+	}
+	params = withCount(params, flagCount)
+
 	warnUnsupportedModel(flagModel)
 
-	hash := cache.Hash(prompt, flagModel)
+	req := client.Request{Model: flagModel, Prompt: prompt, Params: params, Image: flagImage, ImageParam: flagImageParam, Mask: flagMask}
+	out, err := outputOptions(flagFormat, flagQuality)
+	if err != nil {
+		return err
+	}
+	sizes, err := checkSizes(flagSizes)
+	if err != nil {
+		return err
+	}
+	key, err := newKey(req, out)
+	if err != nil {
+		return err
+	}
+	hash := key.Hash()
 
 	// For dry-run, we only need to check the cache
 	if flagDryRun {
-		c, err := cache.Load(flagOutput)
-		if err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("failed to load cache: %w", err)
+		c, err := loadCache()
+		if err != nil {
+			return err
 		}
 
 		status := "pending"
-		var outputFile string
-		if !flagNoCache && c != nil {
-			if entry := c.Lookup(hash); entry != nil {
-				outputPath := filepath.Join(flagOutput, entry.OutputFile)
-				if _, err := os.Stat(outputPath); err == nil {
-					status = "cached"
-					outputFile = outputPath
-				}
+		var outputFiles []string
+		var mismatches []cache.Mismatch
+		if useCache(flagModel) {
+			var paths []string
+			if paths, mismatches = cachedOutputs(c, hash); paths != nil {
+				status = "cached"
+				outputFiles = paths
 			}
 		}
 
@@ -245,11 +920,17 @@ func runGenerate(_ *cobra.Command, args []string) error {
 			ToGenerate: 0,
 			Cached:     0,
 			Prompts: []DryRunPrompt{{
-				Prompt:     prompt,
-				Model:      flagModel,
-				Hash:       hash,
-				Status:     status,
-				OutputFile: outputFile,
+				Prompt:      prompt,
+				Model:       flagModel,
+				Params:      params,
+				Image:       flagImage,
+				Mask:        flagMask,
+				Hash:        hash,
+				Status:      status,
+				OutputFile:  firstOrEmpty(outputFiles),
+				OutputFiles: outputFiles,
+
+				CacheMismatches: mismatches,
 			}},
 		}
 		if status == "cached" {
@@ -263,10 +944,19 @@ func runGenerate(_ *cobra.Command, args []string) error {
 		} else if shouldOutput() {
 			fmt.Printf("Dry run: %s\n", prompt)
 			fmt.Printf("  Model:  %s\n", flagModel)
+			if len(params) > 0 {
+				fmt.Printf("  Params: %v\n", params)
+			}
+			if flagImage != "" {
+				fmt.Printf("  Image:  %s\n", flagImage)
+			}
+			if flagMask != "" {
+				fmt.Printf("  Mask:   %s\n", flagMask)
+			}
 			fmt.Printf("  Hash:   %s\n", hash)
 			fmt.Printf("  Status: %s\n", status)
-			if outputFile != "" {
-				fmt.Printf("  File:   %s\n", outputFile)
+			for _, f := range outputFiles {
+				fmt.Printf("  File:   %s\n", f)
 			}
 		}
 		return nil
@@ -278,53 +968,97 @@ func runGenerate(_ *cobra.Command, args []string) error {
 	}
 
 	// Load cache
-	c, err := cache.Load(flagOutput)
+	c, err := loadCache()
 	if err != nil {
-		return fmt.Errorf("failed to load cache: %w", err)
+		return err
 	}
+	canonicalizeCache(c)
 
 	// Check cache
-	if !flagNoCache {
-		if entry := c.Lookup(hash); entry != nil {
-			outputPath := filepath.Join(flagOutput, entry.OutputFile)
-			if _, err := os.Stat(outputPath); err == nil {
-				if flagJSON {
-					outputJSON(GenerateResult{
-						Status:     "cached",
-						Prompt:     prompt,
-						Model:      flagModel,
-						Hash:       hash,
-						OutputFile: outputPath,
-						Cached:     true,
-					})
-				} else if shouldOutput() {
-					fmt.Printf("Using cached image: %s\n", outputPath)
+	var mismatches []cache.Mismatch
+	if useCache(flagModel) {
+		var paths []string
+		if paths, mismatches = lookupOutputs(ctx, c, hash); paths != nil {
+			variants := ensureVariants(c, hash, "", sizes)
+			if err := evictCache(c); err != nil {
+				return err
+			}
+			if c.Changed() { // Touched, evicted or pulled from a shared cache
+				if err := c.Save(); err != nil {
+					return fmt.Errorf("failed to save cache: %w", err)
 				}
-				return nil
 			}
+			if flagJSON {
+				outputJSON(GenerateResult{
+					Status:      "cached",
+					Prompt:      prompt,
+					Model:       flagModel,
+					Params:      params,
+					Image:       flagImage,
+					Mask:        flagMask,
+					Hash:        hash,
+					OutputFile:  paths[0],
+					OutputFiles: paths,
+					Variants:    variants,
+					Cached:      true,
+				})
+			} else if shouldOutput() {
+				for _, p := range paths {
+					fmt.Printf("Using cached image: %s\n", p)
+				}
+				for _, v := range variants {
+					for _, p := range v.Files {
+						fmt.Printf("Using cached image: %s\n", p)
+					}
+				}
+			}
+			return nil
 		}
 	}
 
-	// Create client
-	rc, err := client.New()
+	// Create generator
+	gen, err := newGenerator()
 	if err != nil {
 		return err
 	}
 
+	if flagAsync {
+		ag, err := asyncGenerator(gen, flagProvider)
+		if err != nil {
+			return err
+		}
+		store, err := pending.Load(flagOutput)
+		if err != nil {
+			return fmt.Errorf("failed to load pending predictions: %w", err)
+		}
+		result := submitAsync(ctx, ag, store, &sync.Mutex{}, key, req, nil, sizes)
+		if result.Status == "error" && !flagJSON {
+			return errors.New(result.Error)
+		}
+		printSubmitResult(result)
+		return nil
+	}
+
 	if shouldOutput() {
 		fmt.Printf("Generating image with %s...\n", flagModel)
 	}
 
 	// Generate image
-	data, url, err := rc.GenerateImage(ctx, flagModel, prompt)
+	res, err := gen.GenerateImages(ctx, req)
 	if err != nil {
 		if flagJSON {
 			outputJSON(GenerateResult{
-				Status: "error",
-				Prompt: prompt,
-				Model:  flagModel,
-				Hash:   hash,
-				Error:  err.Error(),
+				Status:   "error",
+				Prompt:   prompt,
+				Model:    flagModel,
+				Params:   params,
+				Image:    flagImage,
+				Mask:     flagMask,
+				Hash:     hash,
+				Attempts: res.Attempts,
+				Error:    err.Error(),
+
+				CacheMismatches: mismatches,
 			})
 			return nil
 		}
@@ -332,52 +1066,89 @@ func runGenerate(_ *cobra.Command, args []string) error {
 	}
 
 	if shouldOutput() {
-		fmt.Printf("Downloaded from: %s\n", url)
+		for _, img := range res.Images {
+			if img.URL != "" {
+				fmt.Printf("Downloaded from: %s\n", img.URL)
+			}
+		}
 	}
 
-	// Convert to WEBP and save
-	filename := hash + ".webp"
-	outputPath := filepath.Join(flagOutput, filename)
-
-	if err := convert.SaveWebP(data, outputPath); err != nil {
+	// Convert and save, keeping any previous images as a revision
+	archiveEntry(c, hash)
+	filenames, err := saveImages(res.Images, key)
+	if err != nil {
 		return fmt.Errorf("failed to save image: %w", err)
 	}
+	paths := outputPaths(filenames)
 
-	// Update cache
-	c.Upsert(prompt, flagModel, filename)
+	// Update cache, then save scaled-down copies
+	relinkAliases(c, c.Upsert(key, filenames).Hash)
+	variants := ensureVariants(c, hash, "", sizes)
+	entry := *c.Lookup(hash)
+	if err := evictCache(c); err != nil {
+		return err
+	}
 	if err := c.Save(); err != nil {
 		return fmt.Errorf("failed to save cache: %w", err)
 	}
+	pushEntry(ctx, c, entry)
 
 	if flagJSON {
 		outputJSON(GenerateResult{
-			Status:     "generated",
-			Prompt:     prompt,
-			Model:      flagModel,
-			Hash:       hash,
-			OutputFile: outputPath,
-			Cached:     false,
+			Status:      "generated",
+			Prompt:      prompt,
+			Model:       flagModel,
+			Params:      params,
+			Image:       flagImage,
+			Mask:        flagMask,
+			Hash:        hash,
+			OutputFile:  paths[0],
+			OutputFiles: paths,
+			Variants:    variants,
+			Cached:      false,
+			Attempts:    res.Attempts,
+
+			CacheMismatches: mismatches,
 		})
 	} else if shouldOutput() {
-		fmt.Printf("Saved: %s\n", outputPath)
+		for _, p := range paths {
+			fmt.Printf("Saved: %s\n", p)
+		}
+		for _, v := range variants {
+			for _, p := range v.Files {
+				fmt.Printf("Saved: %s\n", p)
+			}
+		}
 	}
 	return nil
 }
 
+// firstOrEmpty returns the first element of s, or "" if s is empty.
+func firstOrEmpty(s []string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	return s[0]
+}
+
 func outputJSON(v any) {
 	enc := json.NewEncoder(os.Stdout)
 	_ = enc.Encode(v)
 }
 
-func runModels(_ *cobra.Command, args []string) error {
-	ctx := context.Background()
+func runModels(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
 
 	query := "text to image"
 	if len(args) > 0 {
 		query = args[0]
 	}
 
-	rc, err := client.New()
+	cfg, err := clientConfig()
+	if err != nil {
+		return err
+	}
+	rc, err := client.New(cfg)
 	if err != nil {
 		return err
 	}
@@ -419,36 +1190,100 @@ type PromptFile struct {
 
 // PromptEntry represents a single prompt/model combination.
 type PromptEntry struct {
-	Prompt string `yaml:"prompt"`
-	Model  string `yaml:"model,omitempty"`
-	Name   string `yaml:"name,omitempty"`
+	Prompt string         `yaml:"prompt"`
+	Model  string         `yaml:"model,omitempty"`
+	Name   string         `yaml:"name,omitempty"`
+	Params map[string]any `yaml:"params,omitempty"`
+	Count  int            `yaml:"count,omitempty"`
+
+	Image      string `yaml:"image,omitempty"`       // Reference image path or URL
+	ImageFrom  string `yaml:"image_from,omitempty"`  // Name of an earlier entry whose output is the reference image
+	ImageParam string `yaml:"image_param,omitempty"` // Model input that takes Image
+	Mask       string `yaml:"mask,omitempty"`        // Inpainting mask path or URL
+
+	Format  string `yaml:"format,omitempty"`  // Output format: webp, png or jpeg
+	Quality int    `yaml:"quality,omitempty"` // JPEG quality, 1-100
+	Sizes   []int  `yaml:"sizes,omitempty"`   // Widths to also save scaled-down copies at
 }
 
-// filenameForEntry returns the output filename for a prompt entry.
-// If the entry has a custom name, it uses "{name}.webp"; otherwise "{hash}.webp".
-func filenameForEntry(p PromptEntry, hash string) string {
-	if p.Name != "" {
-		return p.Name + ".webp"
-	}
-	return hash + ".webp"
+// request returns the generation request for a resolved entry.
+func (p PromptEntry) request() client.Request {
+	return client.Request{Model: p.Model, Prompt: p.Prompt, Params: p.Params, Image: p.Image, ImageParam: p.ImageParam, Mask: p.Mask}
 }
 
-func runBatch(_ *cobra.Command, args []string) error {
-	ctx := context.Background()
+// key returns the cache key for a resolved entry, which includes its output
+// format.
+func (p PromptEntry) key() (cache.Key, error) {
+	out, err := outputOptions(p.Format, p.Quality)
+	if err != nil {
+		return cache.Key{}, err
+	}
+	return newKey(p.request(), out)
+}
 
-	// Read and parse YAML file
-	data, err := os.ReadFile(args[0])
+// readPromptFile reads and parses a prompts YAML file, which must contain at
+// least one prompt.
+func readPromptFile(path string) (*PromptFile, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("failed to read file: %v", err)}
+		return nil, &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("failed to read file: %v", err)}
 	}
 
 	var pf PromptFile
 	if err := yaml.Unmarshal(data, &pf); err != nil {
-		return &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("failed to parse YAML: %v", err)}
+		return nil, &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("failed to parse YAML: %v", err)}
 	}
 
 	if len(pf.Prompts) == 0 {
-		return &ExitError{Code: ExitInvalidInput, Message: "no prompts found in file"}
+		return nil, &ExitError{Code: ExitInvalidInput, Message: "no prompts found in file"}
+	}
+	return &pf, nil
+}
+
+// resolveEntry applies flag defaults to a prompt file entry: the model, the
+// count, sizes and --param values, and resolves its image paths against dir.
+func resolveEntry(p PromptEntry, cliParams map[string]any, dir string) PromptEntry {
+	model := p.Model
+	if model == "" {
+		model = flagModel
+	}
+	count := p.Count
+	if count == 0 {
+		count = flagCount
+	}
+	sizes := p.Sizes
+	if sizes == nil {
+		sizes = flagSizes
+	}
+	return PromptEntry{
+		Prompt:     p.Prompt,
+		Model:      model,
+		Name:       p.Name,
+		Params:     withCount(mergeParams(cliParams, p.Params), count),
+		Image:      resolveImagePath(p.Image, dir),
+		ImageFrom:  p.ImageFrom,
+		ImageParam: p.ImageParam,
+		Mask:       resolveImagePath(p.Mask, dir),
+		Format:     p.Format,
+		Quality:    p.Quality,
+		Sizes:      sizes,
+	}
+}
+
+func runBatch(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
+	pf, err := readPromptFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	cliParams, err := parseParams(flagParams)
+	if err != nil {
+		return err
+	}
+	if err := checkCounts(pf); err != nil {
+		return err
 	}
 
 	// Warn about unsupported models
@@ -460,92 +1295,154 @@ func runBatch(_ *cobra.Command, args []string) error {
 	}
 
 	// Load cache (don't create output dir for dry-run)
-	var c *cache.Cache
-	if flagDryRun {
-		c, err = cache.Load(flagOutput)
-		if err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("failed to load cache: %w", err)
-		}
-		if c == nil {
-			c = &cache.Cache{}
-		}
-	} else {
-		// Ensure output directory exists
+	if !flagDryRun {
 		if err := os.MkdirAll(flagOutput, 0755); err != nil {
 			return fmt.Errorf("failed to create output directory: %w", err)
 		}
-		c, err = cache.Load(flagOutput)
-		if err != nil {
-			return fmt.Errorf("failed to load cache: %w", err)
-		}
 	}
+	c, err := loadCache()
+	if err != nil {
+		return err
+	}
+	canonicalizeCache(c)
 
 	// Categorize prompts
 	var (
 		toGenerate  []PromptEntry
+		deferred    []PromptEntry // Waiting for an image_from source generated in this run
 		dryPrompts  []DryRunPrompt
 		cachedCount int
+		named       = make(map[string]bool)
+		mismatched  = make(map[string][]cache.Mismatch) // Hash -> cached files that changed
+		sources     = make(map[string]string)           // Entry name -> first output path
+		aliases     = make(map[string][]string)         // Hash -> names of its prompts
+		queued      = make(map[string]bool)             // Hashes in toGenerate
+		duplicates  []duplicatePrompt                   // Same hash as a prompt in toGenerate
+		dir         = filepath.Dir(args[0])
 	)
+	addName := func(hash, name string) {
+		names := aliases[hash]
+		if name != "" {
+			names = append(names, name)
+		}
+		aliases[hash] = names
+	}
 
 	for _, p := range pf.Prompts {
-		model := p.Model
-		if model == "" {
-			model = flagModel
+		if p.ImageFrom != "" {
+			if p.Image != "" {
+				return &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("prompt %q: image and image_from are mutually exclusive", p.Prompt)}
+			}
+			if !named[p.ImageFrom] {
+				return &ExitError{Code: ExitInvalidInput, Message: fmt.Sprintf("prompt %q: image_from %q is not the name of an earlier prompt", p.Prompt, p.ImageFrom)}
+			}
+		}
+		if p.Name != "" {
+			named[p.Name] = true
 		}
 
-		hash := cache.Hash(p.Prompt, model)
-		isCached := false
-
-		if !flagNoCache {
-			if entry := c.Lookup(hash); entry != nil {
-				outputPath := filepath.Join(flagOutput, entry.OutputFile)
-				if _, err := os.Stat(outputPath); err == nil {
-					isCached = true
-					cachedCount++
-
-					if flagDryRun {
-						dryPrompts = append(dryPrompts, DryRunPrompt{
-							Prompt:     p.Prompt,
-							Model:      model,
-							Hash:       hash,
-							Name:       p.Name,
-							Status:     "cached",
-							OutputFile: outputPath,
-						})
-					} else if flagJSON {
-						outputJSON(GenerateResult{
-							Status:     "cached",
-							Prompt:     p.Prompt,
-							Model:      model,
-							Hash:       hash,
-							OutputFile: outputPath,
-							Cached:     true,
-						})
-					} else if shouldOutput() {
-						fmt.Printf("Cached: %s\n", p.Prompt)
-					}
+		entry := resolveEntry(p, cliParams, dir)
+		model, params := entry.Model, entry.Params
+		if entry.Sizes, err = checkSizes(entry.Sizes); err != nil {
+			return err
+		}
+
+		if entry.ImageFrom != "" {
+			if path, ok := sources[entry.ImageFrom]; ok {
+				entry.Image = path
+			} else {
+				// The source is generated in this run, and the entry's hash
+				// depends on its content. Check everything else now.
+				if _, err := entry.key(); err != nil {
+					return err
+				}
+				deferred = append(deferred, entry)
+				if flagDryRun {
+					dryPrompts = append(dryPrompts, DryRunPrompt{
+						Prompt:    p.Prompt,
+						Model:     model,
+						Params:    params,
+						ImageFrom: entry.ImageFrom,
+						Mask:      entry.Mask,
+						Name:      p.Name,
+						Status:    "pending",
+					})
 				}
+				continue
 			}
 		}
 
-		if !isCached {
-			toGenerate = append(toGenerate, PromptEntry{Prompt: p.Prompt, Model: model, Name: p.Name})
-			if flagDryRun {
-				dryPrompts = append(dryPrompts, DryRunPrompt{
-					Prompt: p.Prompt,
-					Model:  model,
-					Hash:   hash,
-					Name:   p.Name,
-					Status: "pending",
-				})
+		key, err := entry.key()
+		if err != nil {
+			return err
+		}
+		hash := key.Hash()
+
+		addName(hash, entry.Name)
+
+		if useCache(model) {
+			paths, mismatches := lookupOutputs(ctx, c, hash)
+			if mismatches != nil {
+				mismatched[hash] = mismatches
 			}
+			if paths != nil {
+				cachedCount++
+				if entry.Name != "" {
+					sources[entry.Name] = paths[0]
+				}
+				paths = linkAlias(c, hash, entry.Name, paths)
+
+				if flagDryRun {
+					dryPrompts = append(dryPrompts, DryRunPrompt{
+						Prompt:      p.Prompt,
+						Model:       model,
+						Params:      params,
+						Image:       entry.Image,
+						ImageFrom:   entry.ImageFrom,
+						Mask:        entry.Mask,
+						Hash:        hash,
+						Name:        p.Name,
+						Status:      "cached",
+						OutputFile:  paths[0],
+						OutputFiles: paths,
+					})
+				} else {
+					printCached(entry, hash, paths, ensureVariants(c, hash, entry.Name, entry.Sizes))
+				}
+				continue
+			}
+		}
+
+		if queued[hash] {
+			// Generated once, for the first prompt; this one only gets its name.
+			duplicates = append(duplicates, duplicatePrompt{entry: entry, hash: hash})
+		} else {
+			queued[hash] = true
+			toGenerate = append(toGenerate, entry)
+		}
+		if flagDryRun {
+			dryPrompts = append(dryPrompts, DryRunPrompt{
+				Prompt:    p.Prompt,
+				Model:     model,
+				Params:    params,
+				Image:     entry.Image,
+				ImageFrom: entry.ImageFrom,
+				Mask:      entry.Mask,
+				Hash:      hash,
+				Name:      p.Name,
+				Status:    "pending",
+
+				CacheMismatches: mismatched[hash],
+			})
 		}
 	}
 
+	total := len(toGenerate) + len(deferred)
+
 	// Handle dry-run output
 	if flagDryRun {
 		result := DryRunResult{
-			ToGenerate: len(toGenerate),
+			ToGenerate: total,
 			Cached:     cachedCount,
 			Prompts:    dryPrompts,
 		}
@@ -561,31 +1458,72 @@ func runBatch(_ *cobra.Command, args []string) error {
 			for _, p := range dryPrompts {
 				fmt.Printf("  [%s] %s\n", p.Status, p.Prompt)
 				fmt.Printf("         Model: %s\n", p.Model)
-				fmt.Printf("         Hash:  %s\n", p.Hash)
+				if len(p.Params) > 0 {
+					fmt.Printf("         Params: %v\n", p.Params)
+				}
+				if p.Image != "" {
+					fmt.Printf("         Image: %s\n", p.Image)
+				} else if p.ImageFrom != "" {
+					fmt.Printf("         Image: output of %s\n", p.ImageFrom)
+				}
+				if p.Mask != "" {
+					fmt.Printf("         Mask:  %s\n", p.Mask)
+				}
+				if p.Hash != "" {
+					fmt.Printf("         Hash:  %s\n", p.Hash)
+				} else {
+					fmt.Printf("         Hash:  (after %s)\n", p.ImageFrom)
+				}
 				fmt.Printf("         Name:  %s\n", p.Name)
-				if p.OutputFile != "" {
-					fmt.Printf("         File:  %s\n", p.OutputFile)
+				for _, f := range p.OutputFiles {
+					fmt.Printf("         File:  %s\n", f)
 				}
 			}
 		}
 		return nil
 	}
 
-	if len(toGenerate) == 0 {
+	if total == 0 {
+		pruneAliases(c, aliases)
+		if err := evictCache(c); err != nil {
+			return err
+		}
+		if c.Changed() { // Touched, evicted or pulled from a shared cache
+			if err := c.Save(); err != nil {
+				return fmt.Errorf("failed to save cache: %w", err)
+			}
+		}
 		if shouldOutput() {
 			fmt.Println("All images already cached.")
 		}
 		return nil
 	}
 
-	// Create client (only needed if actually generating)
-	rc, err := client.New()
+	// Create generator (only needed if actually generating)
+	gen, err := newGenerator()
 	if err != nil {
 		return err
 	}
 
+	var (
+		ag    client.AsyncGenerator
+		store *pending.Store
+	)
+	if flagAsync {
+		if ag, err = asyncGenerator(gen, flagProvider); err != nil {
+			return err
+		}
+		if store, err = pending.Load(flagOutput); err != nil {
+			return fmt.Errorf("failed to load pending predictions: %w", err)
+		}
+	}
+
 	if shouldOutput() {
-		fmt.Printf("Generating %d images (concurrency: %d)...\n\n", len(toGenerate), flagConcurrency)
+		verb := "Generating"
+		if flagAsync {
+			verb = "Submitting"
+		}
+		fmt.Printf("%s %d images (concurrency: %d)...\n\n", verb, total, flagConcurrency)
 	}
 
 	// Process with concurrency limit
@@ -593,97 +1531,314 @@ func runBatch(_ *cobra.Command, args []string) error {
 		wg      sync.WaitGroup
 		sem     = make(chan struct{}, flagConcurrency)
 		mu      sync.Mutex
+		storeMu sync.Mutex
 		errored int
+		started int
 	)
 
-	for _, p := range toGenerate {
-		wg.Add(1)
-		sem <- struct{}{}
-
-		go func(entry PromptEntry) {
-			defer wg.Done()
-			defer func() { <-sem }()
-
-			hash := cache.Hash(entry.Prompt, entry.Model)
-			filename := filenameForEntry(entry, hash)
-			outputPath := filepath.Join(flagOutput, filename)
+	process := func(entry PromptEntry) {
+		req := entry.request()
+		key, err := entry.key()
+		if err != nil {
+			mu.Lock()
+			printBatchError(entry, "", 0, "Error", err)
+			errored++
+			mu.Unlock()
+			return
+		}
+		hash := key.Hash()
 
-			data, _, err := rc.GenerateImage(ctx, entry.Model, entry.Prompt)
-			if err != nil {
-				mu.Lock()
-				if flagJSON {
-					outputJSON(GenerateResult{
-						Status: "error",
-						Prompt: entry.Prompt,
-						Model:  entry.Model,
-						Hash:   hash,
-						Error:  err.Error(),
-					})
-				} else {
-					fmt.Printf("Error [%s]: %v\n", entry.Prompt, err)
+		// An image_from source may have come out the same as before.
+		if entry.ImageFrom != "" && useCache(entry.Model) {
+			mu.Lock()
+			addName(hash, entry.Name)
+			paths, mismatches := lookupOutputs(ctx, c, hash)
+			if mismatches != nil {
+				mismatched[hash] = mismatches
+			}
+			if paths != nil {
+				if entry.Name != "" {
+					sources[entry.Name] = paths[0]
 				}
-				errored++
-				mu.Unlock()
+				printCached(entry, hash, linkAlias(c, hash, entry.Name, paths), ensureVariants(c, hash, entry.Name, entry.Sizes))
+			}
+			mu.Unlock()
+			if paths != nil {
 				return
 			}
+		}
 
-			if err := convert.SaveWebP(data, outputPath); err != nil {
-				mu.Lock()
-				if flagJSON {
-					outputJSON(GenerateResult{
-						Status: "error",
-						Prompt: entry.Prompt,
-						Model:  entry.Model,
-						Hash:   hash,
-						Error:  err.Error(),
-					})
-				} else {
-					fmt.Printf("Error saving [%s]: %v\n", entry.Prompt, err)
-				}
+		if flagAsync {
+			// Saved under the names of every prompt with the same hash
+			mu.Lock()
+			names := slices.Clone(aliases[hash])
+			mu.Unlock()
+			if entry.Name != "" && !slices.Contains(names, entry.Name) {
+				names = append(names, entry.Name)
+			}
+			result := submitAsync(ctx, ag, store, &storeMu, key, req, names, entry.Sizes)
+			mu.Lock()
+			printSubmitResult(result)
+			if result.Status == "error" {
 				errored++
-				mu.Unlock()
-				return
 			}
+			mu.Unlock()
+			return
+		}
 
+		res, err := gen.GenerateImages(ctx, req)
+		if err != nil {
 			mu.Lock()
-			c.Upsert(entry.Prompt, entry.Model, filename)
-			if flagJSON {
-				outputJSON(GenerateResult{
-					Status:     "generated",
-					Prompt:     entry.Prompt,
-					Model:      entry.Model,
-					Hash:       hash,
-					OutputFile: outputPath,
-					Cached:     false,
-				})
-			} else if shouldOutput() {
-				fmt.Printf("Generated: %s -> %s\n", entry.Prompt, filename)
-			}
+			printBatchError(entry, hash, res.Attempts, "Error", err)
+			errored++
 			mu.Unlock()
-		}(p)
+			return
+		}
+
+		mu.Lock()
+		archiveEntry(c, hash)
+		mu.Unlock()
+		filenames, err := saveImages(res.Images, key)
+		if err != nil {
+			mu.Lock()
+			printBatchError(entry, hash, res.Attempts, "Error saving", err)
+			errored++
+			mu.Unlock()
+			return
+		}
+		variants, err := saveVariants(filenames, entry.Sizes, savedOptions(key.Format, key.Quality))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to scale down %s: %v\n", hash, err)
+		}
+
+		mu.Lock()
+		// Journal the entry right away, so a crash later in the batch
+		// doesn't lose it.
+		relinkAliases(c, c.Upsert(key, filenames).Hash)
+		if entry.ImageFrom != "" {
+			addName(hash, entry.Name)
+		}
+		paths := outputPaths(filenames)
+		if entry.Name != "" {
+			sources[entry.Name] = paths[0]
+			paths = linkAlias(c, hash, entry.Name, paths)
+			filenames = aliasFor(entry.Name, filenames).Files
+		}
+		variants = addVariants(c, hash, entry.Name, entry.Sizes, variants)
+		cached := *c.Lookup(hash)
+		if err := c.Append(&cached); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to journal cache entry for %q: %v\n", entry.Prompt, err)
+		}
+		if flagJSON {
+			outputJSON(GenerateResult{
+				Status:      "generated",
+				Prompt:      entry.Prompt,
+				Model:       entry.Model,
+				Params:      entry.Params,
+				Image:       entry.Image,
+				Mask:        entry.Mask,
+				Hash:        hash,
+				OutputFile:  paths[0],
+				OutputFiles: paths,
+				Variants:    variants,
+				Cached:      false,
+				Attempts:    res.Attempts,
+
+				CacheMismatches: mismatched[hash],
+			})
+		} else if shouldOutput() {
+			fmt.Printf("Generated: %s -> %s\n", entry.Prompt, strings.Join(filenames, ", "))
+		}
+		mu.Unlock()
+
+		pushEntry(ctx, c, cached)
+	}
+
+	// Entries run in waves: each wave includes the image_from entries whose
+	// source was generated by an earlier one. Once interrupted, no more are
+	// started; running ones are canceled and finished images are kept.
+	for wave := toGenerate; len(wave) > 0 && ctx.Err() == nil; {
+		for _, p := range wave {
+			sem <- struct{}{}
+			if ctx.Err() != nil {
+				<-sem
+				break
+			}
+			wg.Add(1)
+			started++
+
+			go func(entry PromptEntry) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				process(entry)
+			}(p)
+		}
+
+		wg.Wait()
+		wave, deferred = resolveSources(deferred, sources)
+	}
+
+	// Unless interrupted, whatever is left depends on an entry that failed
+	// or, in async mode, hasn't been fetched yet.
+	interrupted := ctx.Err() != nil
+	if interrupted {
+		errored += total - started
+		deferred = nil
+	}
+	for _, entry := range deferred {
+		err := fmt.Errorf("image_from %q was not generated", entry.ImageFrom)
+		if flagAsync {
+			err = fmt.Errorf("image_from %q is not generated yet; run 'replicate-images fetch', then batch again", entry.ImageFrom)
+		}
+		printBatchError(entry, "", 0, "Error", err)
+		errored++
 	}
 
-	wg.Wait()
+	for _, d := range duplicates {
+		if flagAsync {
+			printDuplicateSubmit(d, store)
+			continue
+		}
+		paths, _ := cachedOutputs(c, d.hash)
+		if paths == nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipped %q: the same prompt failed above\n", d.entry.Prompt)
+			continue
+		}
+		printCached(d.entry, d.hash, linkAlias(c, d.hash, d.entry.Name, paths), ensureVariants(c, d.hash, d.entry.Name, d.entry.Sizes))
+	}
+	pruneAliases(c, aliases)
 
 	// Save cache
+	if err := evictCache(c); err != nil {
+		return err
+	}
 	if err := c.Save(); err != nil {
 		return fmt.Errorf("failed to save cache: %w", err)
 	}
 
 	if errored > 0 {
 		msg := fmt.Sprintf("%d generation(s) failed", errored)
-		if errored == len(toGenerate) {
+		if interrupted {
+			msg = fmt.Sprintf("interrupted: %d of %d generation(s) failed or not started", errored, total)
+		}
+		if errored == total {
 			return &ExitError{Code: ExitTotalFail, Message: msg}
 		}
 		return &ExitError{Code: ExitPartialFail, Message: msg}
 	}
 
 	if shouldOutput() {
-		fmt.Printf("\nDone. Generated %d images.\n", len(toGenerate))
+		if flagAsync {
+			fmt.Printf("\nDone. Submitted %d predictions. Run 'replicate-images fetch' to download them.\n", total)
+		} else {
+			fmt.Printf("\nDone. Generated %d images.\n", total)
+		}
 	}
 	return nil
 }
 
+// duplicatePrompt is a batch prompt with the same hash as an earlier one.
+type duplicatePrompt struct {
+	entry PromptEntry
+	hash  string
+}
+
+// printDuplicateSubmit reports a batch prompt in async mode whose hash was
+// submitted for an earlier prompt, under both their names.
+func printDuplicateSubmit(d duplicatePrompt, store *pending.Store) {
+	p := store.LookupHash(d.hash)
+	if p == nil {
+		fmt.Fprintf(os.Stderr, "Warning: skipped %q: the same prompt failed above\n", d.entry.Prompt)
+		return
+	}
+	printSubmitResult(GenerateResult{
+		Status:       "pending",
+		Prompt:       d.entry.Prompt,
+		Model:        d.entry.Model,
+		Params:       d.entry.Params,
+		Image:        d.entry.Image,
+		Mask:         d.entry.Mask,
+		Hash:         d.hash,
+		PredictionID: p.ID,
+	})
+}
+
+// pruneAliases removes the aliases of the entries a batch used that none of
+// their prompts named, e.g. because a prompt was renamed.
+func pruneAliases(c *cache.Cache, names map[string][]string) {
+	for hash, keep := range names {
+		e := c.Lookup(hash)
+		if e == nil || !slices.ContainsFunc(e.Aliases, func(a cache.Alias) bool { return !slices.Contains(keep, a.Name) }) {
+			continue
+		}
+		aliases := make([]cache.Alias, 0, len(keep))
+		for _, name := range keep {
+			if !slices.ContainsFunc(aliases, func(a cache.Alias) bool { return a.Name == name }) {
+				aliases = append(aliases, aliasFor(name, e.Files()))
+			}
+		}
+		if err := c.SetAliases(hash, aliases); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to update the names of %s: %v\n", hash, err)
+		}
+	}
+}
+
+// resolveSources sets the reference image of deferred entries whose
+// image_from source now has an output. It returns those entries and the ones
+// still waiting.
+func resolveSources(deferred []PromptEntry, sources map[string]string) (ready, waiting []PromptEntry) {
+	for _, entry := range deferred {
+		if path, ok := sources[entry.ImageFrom]; ok {
+			entry.Image = path
+			ready = append(ready, entry)
+		} else {
+			waiting = append(waiting, entry)
+		}
+	}
+	return ready, waiting
+}
+
+// printCached reports a batch entry found in the cache.
+func printCached(entry PromptEntry, hash string, paths []string, variants []cache.Variant) {
+	if flagJSON {
+		outputJSON(GenerateResult{
+			Status:      "cached",
+			Prompt:      entry.Prompt,
+			Model:       entry.Model,
+			Params:      entry.Params,
+			Image:       entry.Image,
+			Mask:        entry.Mask,
+			Hash:        hash,
+			OutputFile:  paths[0],
+			OutputFiles: paths,
+			Variants:    variants,
+			Cached:      true,
+		})
+	} else if shouldOutput() {
+		fmt.Printf("Cached: %s\n", entry.Prompt)
+	}
+}
+
+// printBatchError reports a batch entry that failed. what prefixes the
+// human-readable message.
+func printBatchError(entry PromptEntry, hash string, attempts int, what string, err error) {
+	if flagJSON {
+		outputJSON(GenerateResult{
+			Status:   "error",
+			Prompt:   entry.Prompt,
+			Model:    entry.Model,
+			Params:   entry.Params,
+			Image:    entry.Image,
+			Mask:     entry.Mask,
+			Hash:     hash,
+			Attempts: attempts,
+			Error:    err.Error(),
+		})
+	} else {
+		fmt.Printf("%s [%s]: %v\n", what, entry.Prompt, err)
+	}
+}
+
 // ValidationResult represents the JSON output for validation.
 type ValidationResult struct {
 	Valid    bool              `json:"valid"`
@@ -754,10 +1909,42 @@ func runValidate(cmd *cobra.Command, args []string) error {
 			continue
 		}
 
+		// Check for invalid counts
+		if p.Count < 0 {
+			errors = append(errors, fmt.Sprintf("prompt %d: count must be positive, got %d", i+1, p.Count))
+		}
+
+		// Check image_from references
+		if p.ImageFrom != "" {
+			if p.Image != "" {
+				errors = append(errors, fmt.Sprintf("prompt %d: image and image_from are mutually exclusive", i+1))
+			}
+			if _, exists := names[p.ImageFrom]; !exists {
+				errors = append(errors, fmt.Sprintf("prompt %d: image_from %q is not the name of an earlier prompt", i+1, p.ImageFrom))
+			}
+		}
+
+		// Check for unreadable reference images and masks
+		p.Model = model
+		p.Params = withCount(p.Params, p.Count)
+		p.Image = resolveImagePath(p.Image, filepath.Dir(args[0]))
+		p.Mask = resolveImagePath(p.Mask, filepath.Dir(args[0]))
+		k, err := p.key()
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("prompt %d: %v", i+1, err))
+		}
+		if _, err := checkSizes(p.Sizes); err != nil {
+			errors = append(errors, fmt.Sprintf("prompt %d: %v", i+1, err))
+		}
+		if p.ImageFrom != "" {
+			// The source isn't generated yet; identify it by name.
+			k.Image = "from:" + p.ImageFrom
+		}
+
 		// Check for duplicates
-		key := p.Prompt + "|" + model
+		key := k.Hash()
 		if prev, exists := seen[key]; exists {
-			warnings = append(warnings, fmt.Sprintf("prompt %d: duplicate of prompt %d (same prompt+model)", i+1, prev))
+			warnings = append(warnings, fmt.Sprintf("prompt %d: duplicate of prompt %d (same prompt+model+params)", i+1, prev))
 		} else {
 			seen[key] = i + 1
 		}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/cache"
+	"github.com/kevinmichaelchen/replicate-images/internal/client"
+	"github.com/kevinmichaelchen/replicate-images/internal/convert"
+)
+
+// setFlag sets a flag's variable for the duration of a test.
+func setFlag[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+func TestParseParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		pairs []string
+		want  map[string]any
+	}{
+		{"none", nil, nil},
+		{"int", []string{"seed=42"}, map[string]any{"seed": 42}},
+		{"float", []string{"guidance=3.5"}, map[string]any{"guidance": 3.5}},
+		{"bool", []string{"go_fast=false"}, map[string]any{"go_fast": false}},
+		{"string", []string{"aspect_ratio=16:9"}, map[string]any{"aspect_ratio": "16:9"}},
+		{"empty value", []string{"negative_prompt="}, map[string]any{"negative_prompt": ""}},
+		{"value with equals", []string{"style=a=b"}, map[string]any{"style": "a=b"}},
+		{"last wins", []string{"seed=1", "seed=2"}, map[string]any{"seed": 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseParams(tt.pairs)
+			if err != nil {
+				t.Fatalf("parseParams(%q): %v", tt.pairs, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseParams(%q) = %#v, want %#v", tt.pairs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseParamsInvalid(t *testing.T) {
+	for _, pair := range []string{"seed", "=42"} {
+		_, err := parseParams([]string{pair})
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) || exitErr.Code != ExitInvalidInput {
+			t.Errorf("parseParams(%q) = %v, want an invalid input error", pair, err)
+		}
+	}
+}
+
+func TestMergeParams(t *testing.T) {
+	tests := []struct {
+		name           string
+		base, override map[string]any
+		want           map[string]any
+	}{
+		{"both empty", nil, map[string]any{}, nil},
+		{"base only", map[string]any{"seed": 1}, nil, map[string]any{"seed": 1}},
+		{"override only", nil, map[string]any{"seed": 2}, map[string]any{"seed": 2}},
+		{"override wins", map[string]any{"seed": 1, "steps": 4}, map[string]any{"seed": 2}, map[string]any{"seed": 2, "steps": 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeParams(tt.base, tt.override); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeParams = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeParamsCopies(t *testing.T) {
+	base := map[string]any{"seed": 1}
+	merged := mergeParams(base, map[string]any{"seed": 2})
+	merged["steps"] = 4
+	if !reflect.DeepEqual(base, map[string]any{"seed": 1}) {
+		t.Errorf("mergeParams modified its base: %#v", base)
+	}
+}
+
+func TestWithCount(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]any
+		count  int
+		want   map[string]any
+	}{
+		{"one", nil, 1, nil},
+		{"several", nil, 3, map[string]any{"num_outputs": 3}},
+		{"merged", map[string]any{"seed": 1}, 2, map[string]any{"seed": 1, "num_outputs": 2}},
+		{"explicit num_outputs", map[string]any{"num_outputs": 4}, 2, map[string]any{"num_outputs": 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withCount(tt.params, tt.count); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withCount(%v, %d) = %#v, want %#v", tt.params, tt.count, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckCounts(t *testing.T) {
+	defer func(count int) { flagCount = count }(flagCount)
+
+	tests := []struct {
+		name   string
+		flag   int
+		counts []int // Per prompt; 0 is unset
+		valid  bool
+	}{
+		{"defaults", 1, []int{0, 0}, true},
+		{"set", 2, []int{1, 4}, true},
+		{"zero flag", 0, []int{1}, false},
+		{"negative flag", -1, []int{0}, false},
+		{"negative prompt", 1, []int{2, -2}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flagCount = tt.flag
+			pf := &PromptFile{}
+			for _, n := range tt.counts {
+				pf.Prompts = append(pf.Prompts, PromptEntry{Prompt: "a cat", Count: n})
+			}
+			err := checkCounts(pf)
+			if tt.valid {
+				if err != nil {
+					t.Errorf("checkCounts: %v", err)
+				}
+				return
+			}
+			var exitErr *ExitError
+			if !errors.As(err, &exitErr) || exitErr.Code != ExitInvalidInput {
+				t.Errorf("checkCounts = %v, want an invalid input error", err)
+			}
+		})
+	}
+}
+
+func TestCacheBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    string
+		bolt    bool // Whether the output directory has a cache.db
+		want    string
+		wantErr bool
+	}{
+		{"new", "", false, cache.BackendJSON, false},
+		{"detected", "", true, cache.BackendBolt, false},
+		{"json", cache.BackendJSON, false, cache.BackendJSON, false},
+		{"bolt", cache.BackendBolt, false, cache.BackendBolt, false},
+		{"json over bolt", cache.BackendJSON, true, "", true},
+		{"unknown", "sqlite", false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			setFlag(t, &flagOutput, dir)
+			setFlag(t, &flagCacheBackend, tt.flag)
+			if tt.bolt {
+				if err := os.WriteFile(filepath.Join(dir, cache.BoltFileName), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := cacheBackend()
+			if tt.wantErr {
+				var exitErr *ExitError
+				if !errors.As(err, &exitErr) || exitErr.Code != ExitInvalidInput {
+					t.Errorf("cacheBackend = %q, %v; want an invalid input error", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("cacheBackend = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUseCache(t *testing.T) {
+	const pinned = "black-forest-labs/flux-schnell:c846a69991daf4c0e5d016514849d14ee5b2e6846ce6b9d6f21369e564cfe51e"
+	tests := []struct {
+		name             string
+		noCache, refresh bool
+		model            string
+		want             bool
+	}{
+		{"default", false, false, "black-forest-labs/flux-schnell", true},
+		{"no-cache", true, false, pinned, false},
+		{"refresh unpinned", false, true, "black-forest-labs/flux-schnell", false},
+		{"refresh pinned", false, true, pinned, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &flagNoCache, tt.noCache)
+			setFlag(t, &flagRefresh, tt.refresh)
+			if got := useCache(tt.model); got != tt.want {
+				t.Errorf("useCache(%q) = %v, want %v", tt.model, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewKeyImages(t *testing.T) {
+	setFlag(t, &flagProvider, client.ProviderReplicate)
+	dir := t.TempDir()
+	cat, dog := filepath.Join(dir, "cat.png"), filepath.Join(dir, "dog.png")
+	for path, content := range map[string]string{cat: "cat", dog: "dog"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := convert.Options{Format: convert.FormatWebP}
+	hash := func(req client.Request) string {
+		t.Helper()
+		key, err := newKey(req, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key.Hash()
+	}
+
+	base := client.Request{Model: "black-forest-labs/flux-schnell", Prompt: "a pet"}
+	withCat := base
+	withCat.Image = cat
+	withDog := base
+	withDog.Image = dog
+	masked := withCat
+	masked.Mask = dog
+	withURL := base
+	withURL.Image = "https://example.com/cat.png"
+
+	hashes := map[string]string{}
+	for name, req := range map[string]client.Request{"none": base, "cat": withCat, "dog": withDog, "masked": masked, "url": withURL} {
+		h := hash(req)
+		if other, ok := hashes[h]; ok {
+			t.Errorf("%s and %s have the same key", name, other)
+		}
+		hashes[h] = name
+	}
+
+	missing := base
+	missing.Image = filepath.Join(dir, "missing.png")
+	_, err := newKey(missing, out)
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != ExitInvalidInput {
+		t.Errorf("newKey with a missing image = %v, want invalid input", err)
+	}
+}
+
+func TestResolveSources(t *testing.T) {
+	deferred := []PromptEntry{
+		{Prompt: "in space", ImageFrom: "cat"},
+		{Prompt: "at night", ImageFrom: "cat-space"},
+	}
+	ready, waiting := resolveSources(deferred, map[string]string{"cat": "out/cat.webp"})
+	if len(ready) != 1 || ready[0].Prompt != "in space" || ready[0].Image != "out/cat.webp" {
+		t.Errorf("ready = %+v, want the entry from cat with its image", ready)
+	}
+	if len(waiting) != 1 || waiting[0].Prompt != "at night" || waiting[0].Image != "" {
+		t.Errorf("waiting = %+v, want the entry from cat-space", waiting)
+	}
+}
+
+// batchDir sets up a fake-provider batch writing to a temporary directory,
+// with a prompts file holding prompts, and returns the directory and the
+// prompts file.
+func batchDir(t *testing.T, prompts string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	setFlag(t, &flagOutput, filepath.Join(dir, "out"))
+	setFlag(t, &flagProvider, client.ProviderFake)
+	setFlag(t, &flagQuiet, true)
+	path := filepath.Join(dir, "prompts.yaml")
+	if err := os.WriteFile(path, []byte(prompts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, path
+}
+
+func TestBatchImageFrom(t *testing.T) {
+	dir, prompts := batchDir(t, `prompts:
+  - prompt: a cat
+    name: cat
+  - prompt: the cat in space
+    name: cat-space
+    image_from: cat
+  - prompt: the cat in space, at night
+    image_from: cat-space
+    mask: mask.png
+`)
+	mask := filepath.Join(dir, "mask.png")
+	if err := os.WriteFile(mask, []byte("sky"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runBatch(command(context.Background()), []string{prompts}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := cache.Load(flagOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := func(prompt string) *cache.Entry {
+		t.Helper()
+		for i := range c.Entries {
+			if c.Entries[i].Prompt == prompt {
+				return &c.Entries[i]
+			}
+		}
+		t.Fatalf("no entry for %q", prompt)
+		return nil
+	}
+	digest := func(path string) string {
+		t.Helper()
+		d, err := cache.ImageDigest(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// Each wave's reference image is the previous wave's output.
+	if e := entry("the cat in space"); e.Image != digest(filepath.Join(flagOutput, "cat.webp")) {
+		t.Errorf("cat-space was made from %s, want cat's output", e.Image)
+	}
+	night := entry("the cat in space, at night")
+	if night.Image != digest(filepath.Join(flagOutput, "cat-space.webp")) || night.Mask != digest(mask) {
+		t.Errorf("the night entry was made from %s masked by %s, want cat-space's output and mask.png", night.Image, night.Mask)
+	}
+
+	// A new mask is a new image.
+	if err := os.WriteFile(mask, []byte("stars"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runBatch(command(context.Background()), []string{prompts}); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = cache.Load(flagOutput); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Entries) != 4 {
+		t.Errorf("%d entries after changing the mask, want 4", len(c.Entries))
+	}
+}
+
+func TestBatchImageFromInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		prompts string
+	}{
+		{"missing source", `prompts:
+  - prompt: a cat
+    image_from: dog
+`},
+		{"self", `prompts:
+  - prompt: a cat
+    name: cat
+    image_from: cat
+`},
+		{"cycle", `prompts:
+  - prompt: a cat
+    name: cat
+    image_from: dog
+  - prompt: a dog
+    name: dog
+    image_from: cat
+`},
+		{"image and image_from", `prompts:
+  - prompt: a cat
+    name: cat
+  - prompt: a dog
+    image: dog.png
+    image_from: cat
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, prompts := batchDir(t, tt.prompts)
+			err := runBatch(command(context.Background()), []string{prompts})
+			var exitErr *ExitError
+			if !errors.As(err, &exitErr) || exitErr.Code != ExitInvalidInput {
+				t.Errorf("runBatch = %v, want invalid input", err)
+			}
+			if _, err := os.Stat(filepath.Join(flagOutput, cache.CacheFileName)); err == nil {
+				t.Error("an invalid batch generated images")
+			}
+		})
+	}
+}
+
+func TestBatchInterrupt(t *testing.T) {
+	_, prompts := batchDir(t, `prompts:
+  - prompt: a cat
+  - prompt: a dog
+  - prompt: a fox
+  - prompt: an owl
+  - prompt: a bat
+  - prompt: an eel
+`)
+	setFlag(t, &flagConcurrency, 2)
+	gen := &slowGenerator{started: make(chan struct{}, 6)}
+	setFlag(t, &newGenerator, func() (client.Generator, error) { return gen, nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- runBatch(command(ctx), []string{prompts}) }()
+	for range flagConcurrency {
+		<-gen.started
+	}
+	cancel() // As on Ctrl-C, while both are running
+	err := <-done
+
+	// No more are started, and the running ones finish and are cached.
+	if n := gen.created.Load(); n != 2 {
+		t.Errorf("started %d generations, want 2", n)
+	}
+	c, loadErr := cache.Load(flagOutput)
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	if len(c.Entries) != 2 {
+		t.Errorf("cached %d entries, want the 2 that were running", len(c.Entries))
+	}
+	for _, e := range c.Entries {
+		if missing, _ := c.Check(&e); len(missing) > 0 {
+			t.Errorf("%q is cached without its files %v", e.Prompt, missing)
+		}
+	}
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != ExitPartialFail || !strings.Contains(exitErr.Message, "4 of 6") {
+		t.Errorf("runBatch = %v, want a partial failure counting the 4 not started", err)
+	}
+}
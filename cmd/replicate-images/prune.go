@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/cache"
+	"github.com/kevinmichaelchen/replicate-images/internal/convert"
+	"github.com/kevinmichaelchen/replicate-images/internal/models"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagAgainst string
+	flagYes     bool
+)
+
+// PruneResult represents the JSON output for a cache entry that no longer
+// matches a prompt.
+type PruneResult struct {
+	cache.Entry
+	Status string   `json:"status"`          // would_prune, pruned or skipped
+	Files  []string `json:"files,omitempty"` // Output paths removed with the entry
+}
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune --against <prompts.yaml>",
+	Short: "Remove images for prompts that are no longer in a prompts file",
+	Long: `Compute the hash of every prompt in a prompts file, exactly as batch would,
+and list the cache entries and output files that match none of them, e.g.
+after prompts were deleted or reworded.
+
+Nothing is deleted unless --yes is given. Use the same --model, --param,
+--count and --provider values as the batch runs, or every entry will look
+stale. Files still used by a current entry, such as a named output that was
+regenerated under a new hash, are kept.
+
+An image_from prompt whose source isn't cached has no known hash, so entries
+with its prompt and model made from a reference image are skipped rather
+than pruned.`,
+	Args: cobra.NoArgs,
+	RunE: runPrune,
+}
+
+func init() {
+	pruneCmd.Flags().StringVar(&flagAgainst, "against", "", "Prompts file whose entries to keep (required)")
+	pruneCmd.Flags().BoolVarP(&flagYes, "yes", "y", false, "Delete the stale entries and files")
+	pruneCmd.Flags().StringVarP(&flagModel, "model", "m", models.Default, "Default model for prompts without one")
+	pruneCmd.Flags().StringArrayVar(&flagParams, "param", nil, "Model input parameter as key=value for every prompt (repeatable)")
+	pruneCmd.Flags().IntVarP(&flagCount, "count", "n", 1, "Number of images per prompt without a count (sets num_outputs)")
+	pruneCmd.Flags().StringVar(&flagFormat, "format", convert.FormatWebP, "Output image format for prompts without one")
+	pruneCmd.Flags().IntVar(&flagQuality, "quality", 0, "JPEG or WEBP quality 1-100 for JPEG and WEBP prompts without one")
+	_ = pruneCmd.MarkFlagRequired("against")
+
+	rootCmd.AddCommand(pruneCmd)
+}
+
+// currentHashes returns the cache hashes batch would produce for a prompts
+// file, given the cache's current contents, and the keys, without an image,
+// of the image_from prompts whose source isn't cached.
+func currentHashes(pf *PromptFile, dir string, c *cache.Cache) (map[string]bool, []cache.Key, error) {
+	cliParams, err := parseParams(flagParams)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hashes := make(map[string]bool)
+	var unresolved []cache.Key
+	sources := make(map[string]string) // Entry name -> first cached output path
+	for _, p := range pf.Prompts {
+		entry := resolveEntry(p, cliParams, dir)
+		if entry.ImageFrom != "" {
+			path, ok := sources[entry.ImageFrom]
+			if !ok {
+				key, err := entry.key()
+				if err != nil {
+					return nil, nil, err
+				}
+				unresolved = append(unresolved, key)
+				continue
+			}
+			entry.Image = path
+		}
+
+		key, err := entry.key()
+		if err != nil {
+			return nil, nil, err
+		}
+		hash := key.Hash()
+		hashes[hash] = true
+		if paths, _ := cachedOutputs(c, hash); paths != nil && entry.Name != "" {
+			sources[entry.Name] = paths[0]
+		}
+	}
+	return hashes, unresolved, nil
+}
+
+// fromUnresolved reports whether e may have been generated by one of the
+// unresolved image_from prompts: from a reference image, with its prompt,
+// model and provider.
+func fromUnresolved(e *cache.Entry, unresolved []cache.Key) bool {
+	if e.Image == "" {
+		return false
+	}
+	for _, k := range unresolved {
+		if e.Prompt == k.Prompt && e.Model == k.Model && e.Provider == k.Provider {
+			return true
+		}
+	}
+	return false
+}
+
+func runPrune(_ *cobra.Command, _ []string) error {
+	pf, err := readPromptFile(flagAgainst)
+	if err != nil {
+		return err
+	}
+	if err := checkCounts(pf); err != nil {
+		return err
+	}
+	c, err := loadCache()
+	if err != nil {
+		return err
+	}
+	keep, unresolved, err := currentHashes(pf, filepath.Dir(flagAgainst), c)
+	if err != nil {
+		return err
+	}
+
+	// Named outputs are overwritten when a prompt is regenerated, so a stale
+	// entry can share its file with a current one.
+	inUse := make(map[string]bool)
+	for i := range c.Entries {
+		if keep[c.Entries[i].Hash] {
+			for _, f := range c.Entries[i].AllFiles() {
+				inUse[f] = true
+			}
+		}
+	}
+
+	remove := flagYes && !flagDryRun
+	status := "would_prune"
+	if remove {
+		status = "pruned"
+	}
+
+	var stale []string
+	var files, skipped int
+	for i := range c.Entries {
+		e := &c.Entries[i]
+		if keep[e.Hash] {
+			continue
+		}
+		if fromUnresolved(e, unresolved) {
+			// Its prompt may still be current; there is no hash to tell.
+			skipped++
+			if flagJSON {
+				outputJSON(PruneResult{Entry: *e, Status: "skipped"})
+			} else if shouldOutput() {
+				fmt.Printf("[skipped] %s\n", e.Prompt)
+				fmt.Printf("         Hash:  %s\n", e.Hash)
+			}
+			continue
+		}
+		stale = append(stale, e.Hash)
+
+		var paths []string
+		for _, f := range e.AllFiles() {
+			if inUse[f] {
+				continue
+			}
+			path := filepath.Join(flagOutput, f)
+			if remove {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("failed to delete %s: %w", path, err)
+				}
+			}
+			paths = append(paths, path)
+		}
+		files += len(paths)
+
+		if flagJSON {
+			outputJSON(PruneResult{Entry: *e, Status: status, Files: paths})
+		} else if shouldOutput() {
+			fmt.Printf("[%s] %s\n", status, e.Prompt)
+			fmt.Printf("         Hash:  %s\n", e.Hash)
+			for _, p := range paths {
+				fmt.Printf("         File:  %s\n", p)
+			}
+		}
+	}
+
+	if remove && len(stale) > 0 {
+		c.Remove(stale...)
+		if err := c.Save(); err != nil {
+			return fmt.Errorf("failed to save cache: %w", err)
+		}
+	}
+
+	if shouldOutput() {
+		switch {
+		case remove:
+			fmt.Printf("\nRemoved %d entries and %d files.\n", len(stale), files)
+		case len(stale) == 0:
+			fmt.Println("\nNothing to prune.")
+		default:
+			fmt.Printf("\n%d entries and %d files no longer match a prompt.", len(stale), files)
+			if !flagDryRun {
+				fmt.Print(" Run again with --yes to delete them.")
+			}
+			fmt.Println()
+		}
+		if skipped > 0 {
+			fmt.Printf("Skipped %d entries made from an image_from source that isn't cached.\n", skipped)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/cache"
+)
+
+func TestFromUnresolved(t *testing.T) {
+	unresolved := []cache.Key{{Prompt: "a cat in a hat", Model: "black-forest-labs/flux-schnell"}}
+	tests := []struct {
+		name  string
+		entry cache.Entry
+		want  bool
+	}{
+		{"match", cache.Entry{Prompt: "a cat in a hat", Model: "black-forest-labs/flux-schnell", Image: "sha256:00"}, true},
+		{"no image", cache.Entry{Prompt: "a cat in a hat", Model: "black-forest-labs/flux-schnell"}, false},
+		{"other prompt", cache.Entry{Prompt: "a dog", Model: "black-forest-labs/flux-schnell", Image: "sha256:00"}, false},
+		{"other model", cache.Entry{Prompt: "a cat in a hat", Model: "stability-ai/sdxl", Image: "sha256:00"}, false},
+		{"other provider", cache.Entry{Prompt: "a cat in a hat", Model: "black-forest-labs/flux-schnell", Provider: "fake", Image: "sha256:00"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fromUnresolved(&tt.entry, unresolved); got != tt.want {
+				t.Errorf("fromUnresolved = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/cache"
+	"github.com/spf13/cobra"
+)
+
+// StoreGCResult represents the JSON output for an entry removed by
+// `store gc`.
+type StoreGCResult struct {
+	cache.StoredObject
+	Status string `json:"status"`
+}
+
+var storeCmd = &cobra.Command{
+	Use:   "store",
+	Short: "Maintain the user-level store shared by projects",
+	Long: `With --store, generated images are also kept in a store in the user's cache
+directory ($XDG_CACHE_HOME/replicate-images/store on Linux), keyed by cache
+hash. Other projects using --store get hardlinks (or copies) of stored images
+instead of generating them again.
+
+Output directories that use the store are registered with it, so 'store gc'
+knows which entries are still referenced.`,
+}
+
+var storeGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Delete stored images that no registered project references",
+	Long: `Delete entries from the store that no registered project's cache references.
+Projects whose output directory no longer exists are unregistered. Entries
+stored in the last hour are kept, in case a run is still recording them.`,
+	Args: cobra.NoArgs,
+	RunE: runStoreGC,
+}
+
+func init() {
+	storeCmd.AddCommand(storeGCCmd)
+	rootCmd.AddCommand(storeCmd)
+}
+
+// openStore opens the user-level store.
+func openStore() (*cache.Store, error) {
+	dir, err := cache.DefaultStoreDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the store: %w", err)
+	}
+	return cache.OpenStore(dir)
+}
+
+func runStoreGC(_ *cobra.Command, _ []string) error {
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	removed, err := s.GC(flagDryRun)
+	if err != nil {
+		return fmt.Errorf("store gc failed: %w", err)
+	}
+
+	status := "deleted"
+	if flagDryRun {
+		status = "would_delete"
+	}
+	var freed int64
+	for _, obj := range removed {
+		freed += obj.Size
+		if flagJSON {
+			outputJSON(StoreGCResult{StoredObject: obj, Status: status})
+		} else if shouldOutput() {
+			fmt.Printf("[%s] %s (%s)\n", status, obj.Hash, formatSize(obj.Size))
+		}
+	}
+
+	if shouldOutput() {
+		verb := "Deleted"
+		if flagDryRun {
+			verb = "Would delete"
+		}
+		fmt.Printf("\n%s %d entries from %s (%s).\n", verb, len(removed), s.Dir(), formatSize(freed))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Package atomicfile replaces files through a temporary file next to them, so
+// readers never see a partial file, and other hardlinks to the old file keep
+// their content.
+package atomicfile
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile writes data to path atomically, with permissions perm.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return WriteFrom(path, bytes.NewReader(data), perm, nil)
+}
+
+// WriteFrom writes r to path atomically, with permissions perm. If verify is
+// set, it's called once r is exhausted, and path is left untouched if it
+// fails.
+func WriteFrom(path string, r io.Reader, perm os.FileMode, verify func() error) error {
+	f, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() { _ = os.Remove(tmp) }() // No-op once renamed
+
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if verify != nil {
+		if err := verify(); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Link replaces path with a hardlink to src atomically. It fails, leaving
+// path untouched, if they're on different filesystems.
+func Link(src, path string) error {
+	f, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_ = f.Close()
+	_ = os.Remove(tmp)
+
+	if err := os.Link(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// createTemp creates a hidden temporary file in path's directory.
+func createTemp(path string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+}
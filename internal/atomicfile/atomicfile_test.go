@@ -0,0 +1,101 @@
+package atomicfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// noTemp fails t if a temporary file was left behind in dir.
+func noTemp(t *testing.T, dir string) {
+	t.Helper()
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".*.tmp")); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cat.webp")
+	other := filepath.Join(dir, "other.webp")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(path, other); err != nil {
+		t.Skipf("hardlinks not supported: %v", err)
+	}
+
+	if err := WriteFile(path, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "new" {
+		t.Errorf("%s holds %q, want new", path, got)
+	}
+	if got, _ := os.ReadFile(other); string(got) != "old" {
+		t.Errorf("WriteFile wrote through a hardlink: the other name holds %q", got)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("mode = %v, want 0644", info.Mode().Perm())
+	}
+	noTemp(t, dir)
+}
+
+func TestWriteFromVerify(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cat.webp")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	errMismatch := errors.New("checksum mismatch")
+	err := WriteFrom(path, strings.NewReader("corrupt"), 0644, func() error { return errMismatch })
+	if !errors.Is(err, errMismatch) {
+		t.Fatalf("WriteFrom = %v, want the verify error", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "old" {
+		t.Errorf("%s holds %q after a failed verify, want it untouched", path, got)
+	}
+	noTemp(t, dir)
+
+	if err := WriteFrom(path, strings.NewReader("new"), 0644, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "new" {
+		t.Errorf("%s holds %q, want new", path, got)
+	}
+}
+
+func TestLink(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.webp")
+	path := filepath.Join(dir, "cat.webp")
+	for name, content := range map[string]string{src: "stored", path: "old"} {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Link(src, path); err != nil {
+		t.Skipf("hardlinks not supported: %v", err)
+	}
+	si, _ := os.Stat(src)
+	pi, _ := os.Stat(path)
+	if si == nil || pi == nil || !os.SameFile(si, pi) {
+		t.Error("Link didn't replace the file with a link")
+	}
+	noTemp(t, dir)
+
+	if err := Link(filepath.Join(dir, "missing.webp"), path); err == nil {
+		t.Error("Link of a missing file succeeded")
+	}
+	if got, _ := os.ReadFile(path); string(got) != "stored" {
+		t.Errorf("%s holds %q after a failed link, want it untouched", path, got)
+	}
+	noTemp(t, dir)
+}
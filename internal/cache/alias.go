@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Alias is a named copy of an entry's images, e.g. for a prompt's name in a
+// batch file: a hardlink to each image, or a copy where links aren't
+// supported. The images themselves are kept once, named after the hash.
+type Alias struct {
+	Name  string   `json:"name"`
+	Files []string `json:"files"` // In the order of Entry.Files
+}
+
+// indexSuffix matches the -<i> that numbers the files of multi-image outputs.
+var indexSuffix = regexp.MustCompile(`-\d+$`)
+
+// staleHash matches names after a hash, such as a version 1 cache's, whose
+// entries were rehashed when migrated.
+var staleHash = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// canonicalFiles returns the names e's files are kept under.
+func canonicalFiles(e *Entry) []string {
+	files := e.Files()
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = hashName(e.Hash, i, len(files), filepath.Ext(f))
+	}
+	return names
+}
+
+// Canonicalize moves the images of entries recorded under a name, as before
+// aliases were kept, to names after their hash, keeping the old names as
+// aliases. Files named after an older hash are renamed instead. It returns
+// how many entries were changed.
+func (c *Cache) Canonicalize() (int, error) {
+	var n int
+	for i := range c.Entries {
+		e := &c.Entries[i]
+		files := e.Files()
+		canonical := canonicalFiles(e)
+		if slices.Equal(files, canonical) {
+			continue
+		}
+
+		alias := Alias{Name: strings.TrimSuffix(files[0], filepath.Ext(files[0])), Files: files}
+		if len(files) > 1 {
+			alias.Name = indexSuffix.ReplaceAllString(alias.Name, "")
+		}
+		exists := true
+		for j, f := range files {
+			err := linkOrCopy(filepath.Join(c.dir, f), filepath.Join(c.dir, canonical[j]))
+			if errors.Is(err, os.ErrNotExist) {
+				exists = false // A cache miss either way
+				continue
+			}
+			if err != nil {
+				return n, err
+			}
+		}
+
+		e.OutputFile = canonical[0]
+		if len(e.OutputFiles) > 0 {
+			e.OutputFiles = canonical
+		}
+		switch {
+		case !exists:
+		case staleHash.MatchString(alias.Name):
+			if c.Lookup(alias.Name) == nil { // Unless it's another entry's
+				for _, f := range files {
+					if err := os.Remove(filepath.Join(c.dir, f)); err != nil && !errors.Is(err, os.ErrNotExist) {
+						return n, err
+					}
+				}
+			}
+		case !slices.ContainsFunc(e.Aliases, func(a Alias) bool { return a.Name == alias.Name }):
+			e.Aliases = append(e.Aliases, alias)
+		}
+		c.markDirty(e.Hash)
+		c.aliases = nil
+		n++
+	}
+	return n, nil
+}
+
+// AddAlias links a to the images of the entry for hash, replacing any alias
+// of the same name, as SetAliases does.
+func (c *Cache) AddAlias(hash string, a Alias) error {
+	e := c.Lookup(hash)
+	if e == nil {
+		return fmt.Errorf("no cache entry for %s", hash)
+	}
+	aliases := slices.DeleteFunc(slices.Clone(e.Aliases), func(old Alias) bool { return old.Name == a.Name })
+	return c.SetAliases(hash, append(aliases, a))
+}
+
+// SetAliases makes aliases the only aliases of the entry for hash, linking
+// their files to its images. A name that is an alias of another entry is
+// moved, and the files of aliases no longer listed are deleted.
+func (c *Cache) SetAliases(hash string, aliases []Alias) error {
+	e := c.Lookup(hash)
+	if e == nil {
+		return fmt.Errorf("no cache entry for %s", hash)
+	}
+	if c.aliases == nil {
+		c.aliases = make(map[string]string)
+		for _, other := range c.Entries {
+			for _, a := range other.Aliases {
+				c.aliases[a.Name] = other.Hash
+			}
+		}
+	}
+
+	files := e.Files()
+	var stale []string
+	for _, a := range e.Aliases {
+		stale = append(stale, a.Files...)
+		stale = append(stale, aliasVariantFiles(a, e.Variants)...)
+	}
+	keep := make(map[string]bool)
+	for _, a := range aliases {
+		if len(a.Files) != len(files) {
+			return fmt.Errorf("alias %q has %d files for %d images", a.Name, len(a.Files), len(files))
+		}
+		if owner := c.Lookup(c.aliases[a.Name]); owner != nil && owner.Hash != hash {
+			owner.Aliases = slices.DeleteFunc(owner.Aliases, func(old Alias) bool {
+				if old.Name == a.Name {
+					stale = append(stale, old.Files...)
+					stale = append(stale, aliasVariantFiles(old, owner.Variants)...)
+					return true
+				}
+				return false
+			})
+			c.markDirty(owner.Hash)
+		}
+		for i, f := range a.Files {
+			keep[f] = true
+			if err := linkOrCopy(filepath.Join(c.dir, files[i]), filepath.Join(c.dir, f)); err != nil {
+				return fmt.Errorf("failed to link %s: %w", f, err)
+			}
+		}
+		for _, v := range e.Variants {
+			for i, f := range AliasVariant(a, v.Width).Files {
+				keep[f] = true
+				if err := linkOrCopy(filepath.Join(c.dir, v.Files[i]), filepath.Join(c.dir, f)); err != nil {
+					return fmt.Errorf("failed to link %s: %w", f, err)
+				}
+			}
+		}
+		c.aliases[a.Name] = hash
+	}
+
+	for _, a := range e.Aliases {
+		if !slices.ContainsFunc(aliases, func(n Alias) bool { return n.Name == a.Name }) {
+			delete(c.aliases, a.Name)
+		}
+	}
+	for _, f := range stale {
+		if keep[f] || slices.Contains(files, f) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, f)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if !slices.EqualFunc(e.Aliases, aliases, func(a, b Alias) bool { return a.Name == b.Name && slices.Equal(a.Files, b.Files) }) {
+		e.Aliases = slices.Clone(aliases)
+		c.markDirty(hash)
+	}
+	return nil
+}
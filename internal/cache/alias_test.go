@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// exists reports whether name exists in c's directory.
+func exists(c *Cache, name string) bool {
+	_, err := os.Stat(filepath.Join(c.dir, name))
+	return err == nil
+}
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     []string // Recorded and written before canonicalizing
+		missing   bool     // Whether the files are deleted first
+		changed   int
+		wantAlias *Alias
+	}{
+		{"named", []string{"cat.webp"}, false, 1, &Alias{Name: "cat", Files: []string{"cat.webp"}}},
+		{"several", []string{"cat-0.webp", "cat-1.webp"}, false, 1, &Alias{Name: "cat", Files: []string{"cat-0.webp", "cat-1.webp"}}},
+		{"missing", []string{"cat.webp"}, true, 1, nil},
+		{"stale hash", []string{"0123456789abcdef.webp"}, false, 1, nil},
+		{"canonical", nil, false, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := load(t, t.TempDir(), BackendJSON)
+			hash := testKey("a").Hash()
+			files := tt.files
+			if files == nil {
+				files = []string{hash + ".webp"}
+			}
+			for _, f := range files {
+				if err := os.WriteFile(filepath.Join(c.dir, f), []byte(f), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if tt.missing {
+					_ = os.Remove(filepath.Join(c.dir, f))
+				}
+			}
+			c.Upsert(testKey("a"), files)
+
+			n, err := c.Canonicalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.changed {
+				t.Errorf("Canonicalize = %d, want %d", n, tt.changed)
+			}
+			e := c.Lookup(hash)
+			if want := canonicalFiles(e); !slices.Equal(e.Files(), want) {
+				t.Errorf("files = %v, want %v", e.Files(), want)
+			}
+			switch {
+			case tt.wantAlias == nil && len(e.Aliases) > 0:
+				t.Errorf("Aliases = %+v, want none", e.Aliases)
+			case tt.wantAlias != nil && (len(e.Aliases) != 1 || e.Aliases[0].Name != tt.wantAlias.Name || !slices.Equal(e.Aliases[0].Files, tt.wantAlias.Files)):
+				t.Errorf("Aliases = %+v, want %+v", e.Aliases, *tt.wantAlias)
+			}
+			if !tt.missing {
+				for i, f := range e.Files() {
+					if got := read(c, f); got != files[i] {
+						t.Errorf("%s holds %q, want %q", f, got, files[i])
+					}
+				}
+			}
+			if tt.wantAlias == nil && tt.changed > 0 {
+				for _, f := range files {
+					if exists(c, f) {
+						t.Errorf("%s was kept without an alias", f)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSetAliases(t *testing.T) {
+	c := load(t, t.TempDir(), BackendJSON)
+	a := withFile(t, c, "a", testKey("a").Hash()+".webp", "image a").Hash
+	b := withFile(t, c, "b", testKey("b").Hash()+".webp", "image b").Hash
+	cat := Alias{Name: "cat", Files: []string{"cat.webp"}}
+	dog := Alias{Name: "dog", Files: []string{"dog.webp"}}
+
+	steps := []struct {
+		name  string
+		hash  string
+		set   []Alias
+		wantA []string // Alias names of a and b afterwards
+		wantB []string
+		files map[string]string // Content of alias files; "" is deleted
+	}{
+		{"add", a, []Alias{cat}, []string{"cat"}, nil, map[string]string{"cat.webp": "image a"}},
+		{"add another", a, []Alias{cat, dog}, []string{"cat", "dog"}, nil, map[string]string{"dog.webp": "image a"}},
+		{"drop one", a, []Alias{dog}, []string{"dog"}, nil, map[string]string{"cat.webp": "", "dog.webp": "image a"}},
+		{"move", b, []Alias{dog}, nil, []string{"dog"}, map[string]string{"dog.webp": "image b"}},
+		{"clear", b, nil, nil, nil, map[string]string{"dog.webp": ""}},
+	}
+	for _, step := range steps {
+		if err := c.SetAliases(step.hash, step.set); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		for hash, want := range map[string][]string{a: step.wantA, b: step.wantB} {
+			var got []string
+			for _, al := range c.Lookup(hash).Aliases {
+				got = append(got, al.Name)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("%s: aliases of %s = %v, want %v", step.name, hash, got, want)
+			}
+		}
+		for f, want := range step.files {
+			if got := read(c, f); got != want {
+				t.Errorf("%s: %s holds %q, want %q", step.name, f, got, want)
+			}
+		}
+	}
+
+	if !exists(c, testKey("a").Hash()+".webp") || !exists(c, testKey("b").Hash()+".webp") {
+		t.Error("an entry's own image was deleted")
+	}
+	if err := c.SetAliases(a, []Alias{{Name: "pair", Files: []string{"p-0.webp", "p-1.webp"}}}); err == nil {
+		t.Error("SetAliases with the wrong number of files succeeded")
+	}
+	if err := c.SetAliases("0000000000000000", []Alias{cat}); err == nil {
+		t.Error("SetAliases of a missing entry succeeded")
+	}
+}
+
+func TestAddAlias(t *testing.T) {
+	c := load(t, t.TempDir(), BackendJSON)
+	hash := withFile(t, c, "a", testKey("a").Hash()+".webp", "image a").Hash
+	if err := c.AddAlias(hash, Alias{Name: "cat", Files: []string{"cat.webp"}}); err != nil {
+		t.Fatal(err)
+	}
+	// A new output format: the same name with a new file
+	if err := c.AddAlias(hash, Alias{Name: "cat", Files: []string{"cat.png"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	e := c.Lookup(hash)
+	if len(e.Aliases) != 1 || e.Aliases[0].Files[0] != "cat.png" {
+		t.Errorf("Aliases = %+v, want only cat.png", e.Aliases)
+	}
+	if exists(c, "cat.webp") || !exists(c, "cat.png") {
+		t.Error("AddAlias didn't replace the old alias's file")
+	}
+}
@@ -0,0 +1,269 @@
+package cache
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/atomicfile"
+)
+
+// Archives are gzipped tarballs holding a cache.json manifest, written first,
+// followed by the images it references under images/.
+const archiveImageDir = "images/"
+
+// ExportStats summarizes an Export.
+type ExportStats struct {
+	Entries int `json:"entries"`
+	Files   int `json:"files"`
+	Skipped int `json:"skipped"` // Entries left out because a file is missing
+}
+
+// ImportStats summarizes an Import.
+type ImportStats struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"` // Existing entries replaced by newer ones
+	Skipped int `json:"skipped"` // Entries already present and at least as new
+}
+
+// Export writes every entry whose files exist in outputDir, along with those
+// files, to w as a gzipped tarball.
+func (c *Cache) Export(w io.Writer, outputDir string) (ExportStats, error) {
+	var stats ExportStats
+	manifest := Cache{Version: Version, Entries: []Entry{}}
+	for _, e := range c.Entries {
+		if filesExist(outputDir, &e) {
+			e.Revisions, e.Aliases, e.Variants = nil, nil, nil // Only current images are exported
+			manifest.Entries = append(manifest.Entries, e)
+		} else {
+			stats.Skipped++
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return stats, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: CacheFileName, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return stats, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return stats, err
+	}
+
+	added := make(map[string]bool) // Named outputs can be shared by entries
+	for _, e := range manifest.Entries {
+		for _, f := range e.Files() {
+			if added[f] {
+				continue
+			}
+			added[f] = true
+			if err := addFile(tw, filepath.Join(outputDir, f), archiveImageDir+f, e); err != nil {
+				return stats, err
+			}
+			stats.Files++
+		}
+		stats.Entries++
+	}
+
+	if err := tw.Close(); err != nil {
+		return stats, err
+	}
+	return stats, gz.Close()
+}
+
+// addFile copies the file at src into the archive as name.
+func addFile(tw *tar.Writer, src, name string, e Entry) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: e.CreatedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Import merges an archive written by Export into the cache, copying images
+// into outputDir. When both have an entry for a hash, the newer CreatedAt
+// wins; a local entry whose files are missing always loses. An imported file
+// whose name is taken by a different local entry is renamed after its hash.
+// A replaced entry's files are kept as a revision, as when regenerating it,
+// and its aliases are relinked to the imported files.
+// The caller saves the cache.
+func (c *Cache) Import(r io.Reader, outputDir string) (ImportStats, error) {
+	var stats ImportStats
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return stats, fmt.Errorf("not a cache archive: %w", err)
+	}
+	defer func() { _ = gz.Close() }()
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != CacheFileName {
+		return stats, fmt.Errorf("not a cache archive: missing %s", CacheFileName)
+	}
+	var manifest Cache
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return stats, fmt.Errorf("invalid %s in archive: %w", CacheFileName, err)
+	}
+	manifest.migrate()
+
+	// Decide which entries win, and where their files go.
+	taken := make(map[string]string) // Local filename -> hash of its entry
+	for _, e := range c.Entries {
+		for _, f := range e.AllFiles() {
+			taken[f] = e.Hash
+		}
+	}
+	var winners []Entry
+	dest := make(map[string][]string) // Archive filename -> local filenames
+	for _, e := range manifest.Entries {
+		if e.Hash == "" || !validFiles(&e) {
+			return stats, fmt.Errorf("invalid entry %q in archive", e.Hash)
+		}
+		if local := c.Lookup(e.Hash); local != nil {
+			if !e.CreatedAt.After(local.CreatedAt) && filesExist(outputDir, local) {
+				stats.Skipped++
+				continue
+			}
+			stats.Updated++
+		} else {
+			stats.Added++
+		}
+
+		files := e.Files()
+		renamed := make([]string, len(files))
+		for i, f := range files {
+			renamed[i] = f
+			if h, ok := taken[f]; ok && h != e.Hash {
+				renamed[i] = hashName(e.Hash, i, len(files), path.Ext(f))
+			}
+			dest[f] = append(dest[f], renamed[i])
+		}
+		e.OutputFile = renamed[0]
+		if len(e.OutputFiles) > 0 {
+			e.OutputFiles = renamed
+		}
+		winners = append(winners, e)
+	}
+
+	// Keep the files of replaced entries as revisions, rather than
+	// overwriting them.
+	for _, e := range winners {
+		if _, err := c.Archive(e.Hash); err != nil {
+			return stats, fmt.Errorf("failed to archive %s: %w", e.Hash, err)
+		}
+	}
+
+	written := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to read archive: %w", err)
+		}
+		name, ok := strings.CutPrefix(hdr.Name, archiveImageDir)
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		var first string
+		for _, to := range dest[name] {
+			if written[to] {
+				continue
+			}
+			var err error
+			if first == "" {
+				err = atomicfile.WriteFrom(filepath.Join(outputDir, to), tr, 0644, nil)
+				first = to
+			} else {
+				// Also imported under a hash-based name.
+				err = copyFile(filepath.Join(outputDir, first), filepath.Join(outputDir, to))
+			}
+			if err != nil {
+				return stats, fmt.Errorf("failed to import %s: %w", name, err)
+			}
+			written[to] = true
+		}
+	}
+
+	for _, e := range winners {
+		for _, f := range e.Files() {
+			if !written[f] {
+				return stats, fmt.Errorf("archive is missing %s", f)
+			}
+		}
+		e.Revisions, e.Aliases, e.Variants = nil, nil, nil
+		if local := c.Lookup(e.Hash); local != nil {
+			e.Revisions, e.Aliases = local.Revisions, local.Aliases
+		}
+		c.put(e)
+		c.markDirty(e.Hash)
+		delete(c.removed, e.Hash)
+		// Aliases still link to the replaced files.
+		if err := c.SetAliases(e.Hash, e.Aliases); err != nil {
+			return stats, fmt.Errorf("failed to relink aliases of %s: %w", e.Hash, err)
+		}
+	}
+	return stats, nil
+}
+
+// hashName names the i-th of n output files after hash, as the CLI does for
+// unnamed entries.
+func hashName(hash string, i, n int, ext string) string {
+	if n == 1 {
+		return hash + ext
+	}
+	return fmt.Sprintf("%s-%d%s", hash, i, ext)
+}
+
+// validFiles reports whether every file of an archived entry is a plain
+// filename, so importing it can't write outside the output directory.
+func validFiles(e *Entry) bool {
+	for _, f := range e.Files() {
+		if f == "" || f == "." || f == ".." || f != filepath.Base(f) || strings.ContainsAny(f, `/\`) {
+			return false
+		}
+	}
+	return true
+}
+
+// filesExist reports whether every file of e exists in outputDir.
+func filesExist(outputDir string, e *Entry) bool {
+	for _, f := range e.Files() {
+		if _, err := os.Stat(filepath.Join(outputDir, f)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// copyFile copies src to dst atomically.
+func copyFile(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return atomicfile.WriteFrom(dst, f, 0644, nil)
+}
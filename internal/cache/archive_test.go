@@ -0,0 +1,233 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  bool
+	}{
+		{"plain", []string{"cat.webp"}, true},
+		{"several", []string{"cat-0.webp", "cat-1.webp"}, true},
+		{"dotfile", []string{".cat.webp"}, true},
+		{"empty", []string{""}, false},
+		{"dot", []string{"."}, false},
+		{"dotdot", []string{".."}, false},
+		{"parent", []string{"../cat.webp"}, false},
+		{"subdir", []string{"images/cat.webp"}, false},
+		{"absolute", []string{"/etc/passwd"}, false},
+		{"backslash", []string{`..\cat.webp`}, false},
+		{"second file", []string{"cat-0.webp", "../cat-1.webp"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Entry{OutputFile: tt.files[0]}
+			if len(tt.files) > 1 {
+				e.OutputFiles = tt.files
+			}
+			if got := validFiles(&e); got != tt.want {
+				t.Errorf("validFiles(%q) = %v, want %v", tt.files, got, tt.want)
+			}
+		})
+	}
+}
+
+// archive builds a cache archive holding entries and files, by archive name.
+func archive(t *testing.T, entries []Entry, files map[string]string) *bytes.Buffer {
+	t.Helper()
+	data, err := json.Marshal(Cache{Version: Version, Entries: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	write := func(name, content string) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(CacheFileName, string(data))
+	for name, content := range files {
+		write(archiveImageDir+name, content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// withFile upserts an entry for prompt with a single file of content.
+func withFile(t *testing.T, c *Cache, prompt, name, content string) *Entry {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(c.dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return c.Upsert(testKey(prompt), []string{name})
+}
+
+func TestExportImport(t *testing.T) {
+	src := load(t, t.TempDir(), BackendJSON)
+	withFile(t, src, "a", "a.webp", "image a")
+	withFile(t, src, "b", "b.webp", "image b")
+	src.Upsert(testKey("gone"), []string{"gone.webp"}) // Its file is missing
+
+	var buf bytes.Buffer
+	stats, err := src.Export(&buf, src.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (ExportStats{Entries: 2, Files: 2, Skipped: 1}) {
+		t.Errorf("Export = %+v", stats)
+	}
+
+	dst := load(t, t.TempDir(), BackendJSON)
+	imported, err := dst.Import(&buf, dst.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != (ImportStats{Added: 2}) {
+		t.Errorf("Import = %+v", imported)
+	}
+	for _, name := range []string{"a", "b"} {
+		e := dst.Lookup(testKey(name).Hash())
+		if e == nil {
+			t.Fatalf("entry %s not imported", name)
+		}
+		if missing, mismatches := dst.Check(e); len(missing) > 0 || len(mismatches) > 0 {
+			t.Errorf("Check(%s) = %v, %v", name, missing, mismatches)
+		}
+	}
+}
+
+func TestImportMerge(t *testing.T) {
+	now := time.Now()
+	hash := testKey("a").Hash()
+	tests := []struct {
+		name      string
+		localAge  time.Duration // How long before the archived entry the local one was made
+		localFile bool          // Whether the local entry's file exists
+		want      ImportStats
+		wantData  string
+		wantRevs  int // Revisions kept of the local entry
+	}{
+		{"archive newer", time.Hour, true, ImportStats{Updated: 1}, "archived", 1},
+		{"local newer", -time.Hour, true, ImportStats{Skipped: 1}, "local", 0},
+		{"same age", 0, true, ImportStats{Skipped: 1}, "local", 0},
+		{"local missing", -time.Hour, false, ImportStats{Updated: 1}, "archived", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := load(t, t.TempDir(), BackendJSON)
+			local := withFile(t, c, "a", "a.webp", "local")
+			local.CreatedAt = now.Add(-tt.localAge)
+			if err := c.AddAlias(hash, Alias{Name: "cat", Files: []string{"cat.webp"}}); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.localFile {
+				_ = os.Remove(filepath.Join(c.dir, "a.webp"))
+			}
+
+			archived := Entry{Hash: hash, Prompt: "a", Model: testModel, OutputFile: "a.webp", CreatedAt: now}
+			stats, err := c.Import(archive(t, []Entry{archived}, map[string]string{"a.webp": "archived"}), c.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats != tt.want {
+				t.Errorf("Import = %+v, want %+v", stats, tt.want)
+			}
+			e := c.Lookup(hash)
+			for _, f := range []string{e.OutputFile, "cat.webp"} {
+				if got := read(c, f); got != tt.wantData {
+					t.Errorf("%s holds %q, want %q", f, got, tt.wantData)
+				}
+			}
+			if len(e.Revisions) != tt.wantRevs {
+				t.Fatalf("Revisions = %+v, want %d", e.Revisions, tt.wantRevs)
+			}
+			for _, r := range e.Revisions {
+				if got := read(c, r.OutputFile); got != "local" {
+					t.Errorf("revision %s holds %q, want local", r.OutputFile, got)
+				}
+			}
+		})
+	}
+}
+
+func TestImportRenamesTakenFiles(t *testing.T) {
+	c := load(t, t.TempDir(), BackendJSON)
+	withFile(t, c, "local", "cat.webp", "local")
+
+	hash := testKey("archived").Hash()
+	archived := Entry{Hash: hash, Prompt: "archived", Model: testModel, OutputFile: "cat.webp", CreatedAt: time.Now()}
+	if _, err := c.Import(archive(t, []Entry{archived}, map[string]string{"cat.webp": "archived"}), c.dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := c.Lookup(hash); e == nil || e.OutputFile != hash+".webp" {
+		t.Fatalf("imported %+v, want it renamed after its hash", e)
+	}
+	for name, want := range map[string]string{"cat.webp": "local", hash + ".webp": "archived"} {
+		if data, _ := os.ReadFile(filepath.Join(c.dir, name)); string(data) != want {
+			t.Errorf("%s holds %q, want %q", name, data, want)
+		}
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	entry := func(file string) Entry {
+		return Entry{Hash: testKey("a").Hash(), Prompt: "a", Model: testModel, OutputFile: file, CreatedAt: time.Now()}
+	}
+	tests := []struct {
+		name    string
+		archive func(t *testing.T) *bytes.Buffer
+	}{
+		{"not gzip", func(*testing.T) *bytes.Buffer { return bytes.NewBufferString("cache.json") }},
+		{"path traversal", func(t *testing.T) *bytes.Buffer {
+			return archive(t, []Entry{entry("../escaped.webp")}, map[string]string{"../escaped.webp": "evil"})
+		}},
+		{"missing file", func(t *testing.T) *bytes.Buffer {
+			return archive(t, []Entry{entry("a.webp")}, nil)
+		}},
+		{"no hash", func(t *testing.T) *bytes.Buffer {
+			e := entry("a.webp")
+			e.Hash = ""
+			return archive(t, []Entry{e}, map[string]string{"a.webp": "image"})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "out")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			c := load(t, dir, BackendJSON)
+			if _, err := c.Import(tt.archive(t), dir); err == nil {
+				t.Error("Import succeeded")
+			}
+			if _, err := os.Stat(filepath.Join(parent, "escaped.webp")); !os.IsNotExist(err) {
+				t.Error("Import wrote outside the output directory")
+			}
+			if len(c.Entries) != 0 {
+				t.Errorf("Import added %+v", c.Entries)
+			}
+		})
+	}
+}
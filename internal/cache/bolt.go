@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltFileName is the database used by the bolt backend.
+const BoltFileName = "cache.db"
+
+// boltOpenTimeout bounds how long to wait for another process to release the
+// database.
+const boltOpenTimeout = time.Minute
+
+var (
+	entriesBucket = []byte("entries") // Hash -> JSON-encoded Entry
+	metaBucket    = []byte("meta")
+	versionKey    = []byte("version")
+)
+
+// boltBackend stores entries in an embedded bbolt database, keyed by hash.
+// Saves write only the entries that changed, and other processes' entries are
+// never overwritten, so large caches stay fast to update.
+type boltBackend struct {
+	dir string
+}
+
+func (b boltBackend) path() string { return filepath.Join(b.dir, BoltFileName) }
+
+// load reads every entry, migrating older schemas like cache.json; migrated
+// entries are rewritten by the next Save. A new database is seeded from
+// cache.json, if there is one; its entries are written by the next Save.
+func (b boltBackend) load(c *Cache) error {
+	if _, err := os.Stat(b.path()); os.IsNotExist(err) {
+		if err := (jsonBackend{dir: b.dir}).load(c); err != nil {
+			return err
+		}
+		for _, e := range c.Entries {
+			c.markDirty(e.Hash)
+		}
+		return nil
+	}
+
+	db, err := bolt.Open(b.path(), 0644, &bolt.Options{ReadOnly: true, Timeout: boltOpenTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", BoltFileName, err)
+	}
+	defer func() { _ = db.Close() }()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+		if bucket == nil {
+			return nil
+		}
+		c.Version = 0 // Unset before the meta bucket was
+		if meta := tx.Bucket(metaBucket); meta != nil && meta.Get(versionKey) != nil {
+			v, err := strconv.Atoi(string(meta.Get(versionKey)))
+			if err != nil {
+				return fmt.Errorf("invalid version %q in %s", meta.Get(versionKey), BoltFileName)
+			}
+			if v > Version {
+				return fmt.Errorf("%s has schema version %d, newer than the supported %d", BoltFileName, v, Version)
+			}
+			c.Version = v
+		}
+		c.Entries = make([]Entry, 0, bucket.Stats().KeyN)
+		return bucket.ForEach(func(k, v []byte) error {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("invalid entry %s: %w", k, err)
+			}
+			c.Entries = append(c.Entries, e)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.Version < Version {
+		// Migration rehashes entries, so the old keys are deleted and every
+		// entry is written again under its new one.
+		old := make([]string, len(c.Entries))
+		for i, e := range c.Entries {
+			old[i] = e.Hash
+		}
+		c.migrate()
+		c.removed = make(map[string]bool)
+		for i, e := range c.Entries {
+			if old[i] != e.Hash {
+				c.removed[old[i]] = true
+			}
+			c.markDirty(e.Hash)
+		}
+		for _, e := range c.Entries {
+			delete(c.removed, e.Hash) // Another entry's old hash may be this one's new one
+		}
+	}
+	c.reindex()
+	return nil
+}
+
+// append writes e to the database.
+func (b boltBackend) append(_ *Cache, e *Entry) error {
+	return b.put([]Entry{*e})
+}
+
+// save writes the entries upserted since load and deletes the removed ones.
+func (b boltBackend) save(c *Cache) error {
+	entries := c.dirtyEntries()
+	if len(entries) == 0 && len(c.removed) == 0 {
+		return nil
+	}
+	return b.update(entries, c.removed)
+}
+
+// put writes entries in a single transaction, replacing any with the same
+// hash.
+func (b boltBackend) put(entries []Entry) error {
+	return b.update(entries, nil)
+}
+
+// update writes entries and deletes the removed hashes in a single
+// transaction.
+func (b boltBackend) update(entries []Entry, removed map[string]bool) error {
+	db, err := bolt.Open(b.path(), 0644, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", BoltFileName, err)
+	}
+	defer func() { _ = db.Close() }()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(entriesBucket)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(versionKey, []byte(strconv.Itoa(Version))); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			v, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(e.Hash), v); err != nil {
+				return err
+			}
+		}
+		for h := range removed {
+			if err := bucket.Delete([]byte(h)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// setBoltVersion overwrites the schema version stored in dir's database.
+func setBoltVersion(t *testing.T, dir string, version []byte) {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(dir, BoltFileName), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if version == nil {
+			return meta.Delete(versionKey)
+		}
+		return meta.Put(versionKey, version)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	for _, backend := range Backends {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			c := load(t, dir, backend)
+			c.Upsert(testKey("a"), []string{"a.webp"})
+			c.Upsert(testKey("b"), []string{"b-0.webp", "b-1.webp"})
+			if err := c.Save(); err != nil {
+				t.Fatal(err)
+			}
+
+			c = load(t, dir, backend)
+			if len(c.Entries) != 2 {
+				t.Fatalf("got %d entries, want 2", len(c.Entries))
+			}
+			if e := c.Lookup(testKey("b").Hash()); e == nil || len(e.Files()) != 2 {
+				t.Errorf("Lookup(b) = %+v, want 2 files", e)
+			}
+
+			c.Remove(testKey("a").Hash())
+			if err := c.Save(); err != nil {
+				t.Fatal(err)
+			}
+			c = load(t, dir, backend)
+			if len(c.Entries) != 1 || c.Lookup(testKey("a").Hash()) != nil {
+				t.Errorf("entries after Remove = %+v, want only b", c.Entries)
+			}
+		})
+	}
+
+	if _, err := LoadBackend(t.TempDir(), "sqlite"); err == nil {
+		t.Error("LoadBackend of an unknown backend succeeded")
+	}
+}
+
+func TestDetectBackend(t *testing.T) {
+	dir := t.TempDir()
+	for _, step := range []struct {
+		backend string // Saved with before detecting
+		want    string
+	}{
+		{"", BackendJSON},
+		{BackendJSON, BackendJSON},
+		{BackendBolt, BackendBolt}, // Seeded from the cache.json still next to it
+	} {
+		if step.backend != "" {
+			c := load(t, dir, step.backend)
+			c.Upsert(testKey("a"), []string{"a.webp"})
+			if err := c.Save(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, err := DetectBackend(dir); err != nil || got != step.want {
+			t.Errorf("DetectBackend after saving with %q = %q, %v; want %q", step.backend, got, err, step.want)
+		}
+	}
+}
+
+func TestBoltVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version []byte // nil deletes it
+		migrate bool
+		wantErr bool
+	}{
+		{"current", []byte(strconv.Itoa(Version)), false, false},
+		{"v1", []byte("1"), true, false},
+		{"missing", nil, true, false},
+		{"newer", []byte(strconv.Itoa(Version + 1)), false, true},
+		{"invalid", []byte("two"), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			key := testKey("a")
+			hash := key.Hash()
+			if tt.migrate {
+				hash = "5d41402abc4b2a76" // A v1 hash
+			}
+			err := boltBackend{dir: dir}.put([]Entry{{Hash: hash, Prompt: key.Prompt, Model: key.Model, OutputFile: "a.webp"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			setBoltVersion(t, dir, tt.version)
+
+			c, err := LoadBackend(dir, BackendBolt)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("LoadBackend succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Lookup(key.Hash()) == nil {
+				t.Fatalf("entries = %+v, want %s", c.Entries, key.Hash())
+			}
+			if c.Changed() != tt.migrate {
+				t.Errorf("Changed = %v, want %v", c.Changed(), tt.migrate)
+			}
+
+			// Migrated entries are rewritten under their new hash.
+			if err := c.Save(); err != nil {
+				t.Fatal(err)
+			}
+			c = load(t, dir, BackendBolt)
+			if len(c.Entries) != 1 || c.Lookup(key.Hash()) == nil || c.Changed() {
+				t.Errorf("entries after Save = %+v, want only %s", c.Entries, key.Hash())
+			}
+		})
+	}
+}
+
+func TestBoltSeed(t *testing.T) {
+	dir := t.TempDir()
+	c := load(t, dir, BackendJSON)
+	c.Upsert(testKey("a"), []string{"a.webp"})
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = load(t, dir, BackendBolt)
+	if c.Lookup(testKey("a").Hash()) == nil || !c.Changed() {
+		t.Fatalf("seeded %+v, want a to be written by Save", c.Entries)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, CacheFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if c := load(t, dir, BackendBolt); c.Lookup(testKey("a").Hash()) == nil {
+		t.Error("seeded entry not saved to the database")
+	}
+}
+
+// TestBoltConcurrentSaves checks that writers only write their own entries,
+// so none are lost.
+func TestBoltConcurrentSaves(t *testing.T) {
+	dir := t.TempDir()
+	a, b := load(t, dir, BackendBolt), load(t, dir, BackendBolt)
+	a.Upsert(testKey("a"), []string{"a.webp"})
+	b.Upsert(testKey("b"), []string{"b.webp"})
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if c := load(t, dir, BackendBolt); len(c.Entries) != 2 {
+		t.Errorf("got %d entries, want 2", len(c.Entries))
+	}
+}
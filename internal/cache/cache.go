@@ -4,97 +4,415 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/client"
+	"github.com/kevinmichaelchen/replicate-images/internal/models"
+)
+
+// Storage backends accepted by LoadBackend.
+const (
+	BackendJSON = "json" // cache.json plus an append-only journal
+	BackendBolt = "bolt" // cache.db, an embedded bbolt database
 )
 
-const CacheFileName = "cache.json"
+// Backends lists every supported backend; the first is used for new caches.
+var Backends = []string{BackendJSON, BackendBolt}
+
+// Version is the current cache.json schema version.
+// Version 1 files (no version field) hashed prompt+model only and are
+// migrated on Load.
+const Version = 2
 
 type Entry struct {
-	Hash       string    `json:"hash"`
-	Prompt     string    `json:"prompt"`
-	Model      string    `json:"model"`
-	OutputFile string    `json:"output_file"`
-	CreatedAt  time.Time `json:"created_at"`
+	Hash         string         `json:"hash"`
+	Prompt       string         `json:"prompt"`
+	Model        string         `json:"model"`
+	Provider     string         `json:"provider,omitempty"`
+	Params       map[string]any `json:"params,omitempty"`
+	Image        string         `json:"image,omitempty"`
+	ImageParam   string         `json:"image_param,omitempty"`
+	Mask         string         `json:"mask,omitempty"`
+	Format       string         `json:"format,omitempty"`
+	Quality      int            `json:"quality,omitempty"`
+	OutputFile   string         `json:"output_file"`            // First (or only) output
+	OutputFiles  []string       `json:"output_files,omitempty"` // Every output, when the model returned several
+	Checksums    []Checksum     `json:"checksums,omitempty"`    // Per output file, in the order of Files
+	CreatedAt    time.Time      `json:"created_at"`
+	LastAccessed time.Time      `json:"last_accessed,omitzero"` // Last generated or served from the cache
+	Revisions    []Revision     `json:"revisions,omitempty"`    // Earlier generations, oldest first
+	Aliases      []Alias        `json:"aliases,omitempty"`      // Named copies of the output files
+	Variants     []Variant      `json:"variants,omitempty"`     // Downscaled copies, narrowest first
+}
+
+// Checksum identifies the content of an output file.
+type Checksum struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Mismatch describes an output file whose content no longer matches its
+// entry, e.g. because it was truncated or overwritten.
+type Mismatch struct {
+	File     string `json:"file"`
+	Reason   string `json:"reason"` // size or checksum
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// Files returns every output file recorded for the entry.
+func (e *Entry) Files() []string {
+	if len(e.OutputFiles) > 0 {
+		return e.OutputFiles
+	}
+	return []string{e.OutputFile}
+}
+
+// AllFiles returns the entry's output files followed by those of its
+// revisions, aliases and variants.
+func (e *Entry) AllFiles() []string {
+	files := slices.Clone(e.Files())
+	for i := range e.Revisions {
+		files = append(files, e.Revisions[i].Files()...)
+	}
+	for _, a := range e.Aliases {
+		files = append(files, a.Files...)
+	}
+	return append(files, e.variantFiles()...)
 }
 
 type Cache struct {
-	Entries []Entry `json:"entries"`
-	path    string
+	Version int             `json:"version"`
+	Entries []Entry         `json:"entries"`
+	dir     string          // Output directory the entries' files are in
+	index   map[string]int  // Hash -> position in Entries
+	dirty   map[string]bool // Hashes upserted by this process since the last Save
+	removed map[string]bool // Hashes removed by this process since the last Save
+	backend backend
+	store   *Store            // User-level store to read through and write through, if any
+	remote  *Remote           // Shared cache to read through and write through, if any
+	limits  Limits            // Bounds enforced by Evict
+	loaded  time.Time         // When the cache was loaded; entries used since aren't evicted
+	aliases map[string]string // Alias name -> hash, built on first use
 }
 
-// Load reads the cache from the output directory, creating it if it doesn't exist.
-func Load(outputDir string) (*Cache, error) {
-	path := filepath.Join(outputDir, CacheFileName)
-	c := &Cache{
-		Entries: []Entry{},
-		path:    path,
+// backend persists a cache's entries.
+type backend interface {
+	// load reads every entry into c.
+	load(c *Cache) error
+	// append durably records a single entry.
+	append(c *Cache, e *Entry) error
+	// save persists every change since load.
+	save(c *Cache) error
+}
+
+// Key holds every input that affects a generated image.
+type Key struct {
+	Prompt   string         `json:"prompt"`
+	Model    string         `json:"model"`              // Includes the ":version" suffix when pinned
+	Provider string         `json:"provider,omitempty"` // Empty for Replicate
+	Params   map[string]any `json:"params,omitempty"`
+
+	// Image identifies a reference image by content ("sha256:<hex>") or URL.
+	Image      string `json:"image,omitempty"`
+	ImageParam string `json:"image_param,omitempty"` // Set only when overriding the registry
+	Mask       string `json:"mask,omitempty"`        // Inpainting mask, identified like Image
+
+	// Format and Quality select how images are saved; both are empty for
+	// lossless WEBP, so earlier hashes are unchanged.
+	Format  string `json:"format,omitempty"`
+	Quality int    `json:"quality,omitempty"`
+}
+
+// NewKey builds a key from a prompt, model and user-supplied params.
+// Params are resolved against the model's registry defaults so that a change
+// to either produces a different hash.
+func NewKey(prompt, model string, params map[string]any) Key {
+	inputs := models.Inputs(model, params)
+	if len(inputs) == 0 {
+		inputs = nil
 	}
+	return Key{Prompt: prompt, Model: model, Params: inputs}
+}
+
+// Load reads the cache from the output directory using the default JSON
+// backend. A missing cache is empty.
+func Load(outputDir string) (*Cache, error) {
+	return LoadBackend(outputDir, BackendJSON)
+}
 
-	data, err := os.ReadFile(path)
-	if os.IsNotExist(err) {
-		return c, nil
+// DetectBackend returns the backend of the cache in the output directory:
+// bolt if it has a cache.db, otherwise json. A cache.json next to a cache.db
+// is the one the database was seeded from.
+func DetectBackend(outputDir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(outputDir, BoltFileName)); err == nil {
+		return BackendBolt, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
 	}
-	if err != nil {
-		return nil, err
+	return BackendJSON, nil
+}
+
+// LoadBackend reads the cache from the output directory using the named
+// backend. A missing cache is empty.
+func LoadBackend(outputDir, name string) (*Cache, error) {
+	var b backend
+	switch name {
+	case "", BackendJSON:
+		b = jsonBackend{dir: outputDir}
+	case BackendBolt:
+		b = boltBackend{dir: outputDir}
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q (supported: %v)", name, Backends)
 	}
 
-	if err := json.Unmarshal(data, c); err != nil {
+	c := &Cache{Version: Version, Entries: []Entry{}, dir: outputDir, backend: b, loaded: time.Now()}
+	if err := b.load(c); err != nil {
 		return nil, err
 	}
-	c.path = path
 	return c, nil
 }
 
-// Save writes the cache to disk.
+// Save persists every entry upserted since Load.
 func (c *Cache) Save() error {
-	data, err := json.MarshalIndent(c, "", "  ")
-	if err != nil {
+	if err := c.backend.save(c); err != nil {
 		return err
 	}
-	return os.WriteFile(c.path, data, 0644)
+	c.dirty = nil
+	c.removed = nil
+	return nil
 }
 
-// Hash generates a unique hash for a prompt+model combination.
-func Hash(prompt, model string) string {
-	h := sha256.New()
-	h.Write([]byte(prompt))
-	h.Write([]byte(model))
-	return hex.EncodeToString(h.Sum(nil))[:16]
+// Changed reports whether there is anything for Save to persist.
+func (c *Cache) Changed() bool {
+	return len(c.dirty) > 0 || len(c.removed) > 0
+}
+
+// Append durably records e, so it survives a crash before the next Save.
+// It's much cheaper than Save for large caches.
+func (c *Cache) Append(e *Entry) error {
+	return c.backend.append(c, e)
+}
+
+// Hash generates a unique hash for the key.
+// The key is encoded as JSON (with sorted map keys), so fields are
+// unambiguously delimited and param order doesn't matter.
+func (k Key) Hash() string {
+	data, err := json.Marshal(k)
+	if err != nil {
+		// Non-string map keys from YAML can't be JSON-encoded; fmt also
+		// prints maps in sorted key order, so this stays deterministic.
+		data = []byte(fmt.Sprintf("%#v", k))
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16]
 }
 
 // Lookup finds an existing cache entry by hash.
 func (c *Cache) Lookup(hash string) *Entry {
-	for i := range c.Entries {
-		if c.Entries[i].Hash == hash {
-			return &c.Entries[i]
-		}
+	if i, ok := c.index[hash]; ok {
+		return &c.Entries[i]
 	}
 	return nil
 }
 
-// Upsert creates or updates a cache entry.
-func (c *Cache) Upsert(prompt, model, outputFile string) *Entry {
-	hash := Hash(prompt, model)
+// reindex rebuilds the hash index after Entries is replaced.
+func (c *Cache) reindex() {
+	c.index = make(map[string]int, len(c.Entries))
+	for i, e := range c.Entries {
+		c.index[e.Hash] = i
+	}
+}
 
-	// Update existing entry if found
-	for i := range c.Entries {
-		if c.Entries[i].Hash == hash {
-			c.Entries[i].OutputFile = outputFile
-			c.Entries[i].CreatedAt = time.Now()
-			return &c.Entries[i]
+// put adds e, replacing any entry with the same hash.
+func (c *Cache) put(e Entry) {
+	c.aliases = nil
+	if existing := c.Lookup(e.Hash); existing != nil {
+		*existing = e
+		return
+	}
+	if c.index == nil {
+		c.reindex()
+	}
+	c.index[e.Hash] = len(c.Entries)
+	c.Entries = append(c.Entries, e)
+}
+
+// Remove deletes the entries with the given hashes, returning how many were
+// found. The next Save removes them from disk too, even if another process
+// saved them in the meantime.
+func (c *Cache) Remove(hashes ...string) int {
+	if c.removed == nil {
+		c.removed = make(map[string]bool)
+	}
+	drop := make(map[string]bool, len(hashes))
+	for _, h := range hashes {
+		drop[h] = true
+		c.removed[h] = true
+		delete(c.dirty, h)
+	}
+
+	kept := c.Entries[:0]
+	for _, e := range c.Entries {
+		if !drop[e.Hash] {
+			kept = append(kept, e)
+		}
+	}
+	n := len(c.Entries) - len(kept)
+	c.Entries = kept
+	c.reindex()
+	c.aliases = nil
+	return n
+}
+
+// markDirty records that hash must be written by the next Save.
+func (c *Cache) markDirty(hash string) {
+	if c.dirty == nil {
+		c.dirty = make(map[string]bool)
+	}
+	c.dirty[hash] = true
+}
+
+// dirtyEntries returns the entries upserted since the last Save.
+func (c *Cache) dirtyEntries() []Entry {
+	var entries []Entry
+	for _, e := range c.Entries {
+		if c.dirty[e.Hash] {
+			entries = append(entries, e)
 		}
 	}
+	return entries
+}
+
+// Upsert creates or updates a cache entry with the given output files.
+func (c *Cache) Upsert(key Key, outputFiles []string) *Entry {
+	hash := key.Hash()
+	c.markDirty(hash)
+	delete(c.removed, hash)
+
+	outputFile := outputFiles[0]
+	if len(outputFiles) == 1 {
+		outputFiles = nil
+	}
+
+	// Update existing entry if found
+	if e := c.Lookup(hash); e != nil {
+		e.OutputFile = outputFile
+		e.OutputFiles = outputFiles
+		e.Checksums = c.checksums(e.Files())
+		e.CreatedAt = time.Now()
+		e.LastAccessed = e.CreatedAt
+		return e
+	}
 
 	// Add new entry
-	entry := Entry{
-		Hash:       hash,
-		Prompt:     prompt,
-		Model:      model,
-		OutputFile: outputFile,
-		CreatedAt:  time.Now(),
-	}
-	c.Entries = append(c.Entries, entry)
-	return &c.Entries[len(c.Entries)-1]
+	now := time.Now()
+	c.put(Entry{
+		Hash:         hash,
+		Prompt:       key.Prompt,
+		Model:        key.Model,
+		Provider:     key.Provider,
+		Params:       key.Params,
+		Image:        key.Image,
+		ImageParam:   key.ImageParam,
+		Mask:         key.Mask,
+		Format:       key.Format,
+		Quality:      key.Quality,
+		OutputFile:   outputFile,
+		OutputFiles:  outputFiles,
+		CreatedAt:    now,
+		LastAccessed: now,
+	})
+	e := &c.Entries[len(c.Entries)-1]
+	e.Checksums = c.checksums(e.Files())
+	return e
+}
+
+// Touch records a cache hit on the entry for hash, so it's evicted last.
+func (c *Cache) Touch(hash string) {
+	if e := c.Lookup(hash); e != nil {
+		e.LastAccessed = time.Now()
+		c.markDirty(hash)
+	}
+}
+
+// checksums returns the checksums of output files, or nil if any can't be
+// read; such an entry is only checked for missing files.
+func (c *Cache) checksums(files []string) []Checksum {
+	sums := make([]Checksum, len(files))
+	for i, f := range files {
+		sum, size, err := fileSHA256(filepath.Join(c.dir, f))
+		if err != nil {
+			return nil
+		}
+		sums[i] = Checksum{SHA256: sum, Size: size}
+	}
+	return sums
+}
+
+// Check compares e's output files with the entry, returning the paths of
+// missing files and the files whose size or SHA-256 differ from those
+// recorded. Either means e is no longer a valid cache hit.
+func (c *Cache) Check(e *Entry) (missing []string, mismatches []Mismatch) {
+	files := e.Files()
+	for i, f := range files {
+		path := filepath.Join(c.dir, f)
+		info, err := os.Stat(path)
+		if err != nil {
+			missing = append(missing, path)
+			continue
+		}
+		if len(e.Checksums) != len(files) {
+			continue // Recorded before checksums were
+		}
+		want := e.Checksums[i]
+		if info.Size() != want.Size {
+			mismatches = append(mismatches, Mismatch{File: path, Reason: "size", Expected: strconv.FormatInt(want.Size, 10), Actual: strconv.FormatInt(info.Size(), 10)})
+			continue
+		}
+		sum, _, err := fileSHA256(path)
+		if err != nil {
+			missing = append(missing, path)
+			continue
+		}
+		if sum != want.SHA256 {
+			mismatches = append(mismatches, Mismatch{File: path, Reason: "checksum", Expected: want.SHA256, Actual: sum})
+		}
+	}
+	return missing, mismatches
+}
+
+// ImageDigest identifies a reference image or mask for a Key: the SHA-256 of
+// a local file's or data URL's content, so an edited file produces a different
+// hash, or an http(s) URL itself. Remote images aren't fetched, so one that
+// changes behind the same URL keeps its hash. References are told apart with
+// client.IsURL, as the generators do.
+func ImageDigest(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "data:"):
+		// The content is inline; hash it to keep the key short.
+		sum := sha256.Sum256([]byte(ref))
+		return "sha256:" + hex.EncodeToString(sum[:]), nil
+	case client.IsURL(ref):
+		return ref, nil
+	}
+	f, err := os.Open(ref)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
 }
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchEntries is the library size the benchmarks are sized for.
+const benchEntries = 100_000
+
+// benchCache returns a cache of n entries stored with backend in dir, saved
+// to disk.
+func benchCache(b *testing.B, dir, backend string, n int) *Cache {
+	b.Helper()
+	c, err := LoadBackend(dir, backend)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		c.Upsert(benchKey(i), []string{fmt.Sprintf("image-%d.webp", i)})
+	}
+	if err := c.Save(); err != nil {
+		b.Fatal(err)
+	}
+	return c
+}
+
+func benchKey(i int) Key {
+	return NewKey(fmt.Sprintf("prompt %d", i), "black-forest-labs/flux-schnell", map[string]any{"seed": i})
+}
+
+func BenchmarkLookup(b *testing.B) {
+	c := benchCache(b, b.TempDir(), BackendJSON, benchEntries)
+	hashes := make([]string, benchEntries)
+	for i := range hashes {
+		hashes[i] = benchKey(i).Hash()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if c.Lookup(hashes[i%benchEntries]) == nil {
+			b.Fatal("entry not found")
+		}
+	}
+}
+
+func BenchmarkUpsert(b *testing.B) {
+	c := benchCache(b, b.TempDir(), BackendJSON, benchEntries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Upsert(benchKey(benchEntries+i), []string{"image.webp"})
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	for _, backend := range Backends {
+		b.Run(backend, func(b *testing.B) {
+			dir := b.TempDir()
+			benchCache(b, dir, backend, benchEntries)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := LoadBackend(dir, backend); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSave measures saving one new entry into a large cache, as a batch
+// run does after generating a single image.
+func BenchmarkSave(b *testing.B) {
+	for _, backend := range Backends {
+		b.Run(backend, func(b *testing.B) {
+			c := benchCache(b, b.TempDir(), backend, benchEntries)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Upsert(benchKey(benchEntries+i), []string{"image.webp"})
+				if err := c.Save(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAppend(b *testing.B) {
+	for _, backend := range Backends {
+		b.Run(backend, func(b *testing.B) {
+			c := benchCache(b, b.TempDir(), backend, benchEntries)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				e := c.Upsert(benchKey(benchEntries+i), []string{"image.webp"})
+				if err := c.Append(e); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const testModel = "black-forest-labs/flux-schnell"
+
+func TestKeyHash(t *testing.T) {
+	base := NewKey("a cat", testModel, map[string]any{"seed": 1})
+	tests := []struct {
+		name string
+		key  Key
+		same bool
+	}{
+		{"identical", NewKey("a cat", testModel, map[string]any{"seed": 1}), true},
+		{"float param", NewKey("a cat", testModel, map[string]any{"seed": 1.0}), true},
+		{"prompt", NewKey("a dog", testModel, map[string]any{"seed": 1}), false},
+		{"model", NewKey("a cat", "stability-ai/sdxl", map[string]any{"seed": 1}), false},
+		{"param value", NewKey("a cat", testModel, map[string]any{"seed": 2}), false},
+		{"extra param", NewKey("a cat", testModel, map[string]any{"seed": 1, "steps": 4}), false},
+		{"no params", NewKey("a cat", testModel, nil), false},
+		{"provider", Key{Prompt: "a cat", Model: testModel, Provider: "fake", Params: base.Params}, false},
+		{"image", Key{Prompt: "a cat", Model: testModel, Params: base.Params, Image: "sha256:00"}, false},
+		{"image param", Key{Prompt: "a cat", Model: testModel, Params: base.Params, Image: "sha256:00", ImageParam: "init_image"}, false},
+		{"mask", Key{Prompt: "a cat", Model: testModel, Params: base.Params, Mask: "sha256:00"}, false},
+		{"format", Key{Prompt: "a cat", Model: testModel, Params: base.Params, Format: "png"}, false},
+		{"field boundary", NewKey("a ca", "t"+testModel, map[string]any{"seed": 1}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.key.Hash() == base.Hash(); got != tt.same {
+				t.Errorf("%+v hashes alike = %v, want %v", tt.key, got, tt.same)
+			}
+		})
+	}
+}
+
+func TestKeyHashFormat(t *testing.T) {
+	hash := NewKey("a cat", testModel, nil).Hash()
+	if !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(hash) {
+		t.Errorf("Hash = %q, want 16 hex digits", hash)
+	}
+
+	// YAML decodes nested maps with interface keys, which JSON can't encode.
+	key := NewKey("a cat", testModel, map[string]any{"lora": map[any]any{"scale": 1}})
+	if key.Hash() != key.Hash() {
+		t.Error("Hash of a key with non-string map keys isn't deterministic")
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		model  string
+		params map[string]any
+		want   map[string]any
+	}{
+		{"no defaults", testModel, nil, nil},
+		{"defaults", "google/nano-banana-pro", nil, map[string]any{"aspect_ratio": "1:1"}},
+		{"override", "google/nano-banana-pro", map[string]any{"aspect_ratio": "16:9"}, map[string]any{"aspect_ratio": "16:9"}},
+		{"unknown model", "acme/model", map[string]any{"seed": 1}, map[string]any{"seed": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewKey("a cat", tt.model, tt.params)
+			if len(got.Params) != len(tt.want) {
+				t.Fatalf("Params = %v, want %v", got.Params, tt.want)
+			}
+			for k, v := range tt.want {
+				if got.Params[k] != v {
+					t.Errorf("Params[%s] = %v, want %v", k, got.Params[k], v)
+				}
+			}
+		})
+	}
+
+	// A change to the registry defaults must change the hash, so explicit
+	// defaults hash like implicit ones.
+	implicit := NewKey("a cat", "google/nano-banana-pro", nil)
+	explicit := NewKey("a cat", "google/nano-banana-pro", map[string]any{"aspect_ratio": "1:1"})
+	if implicit.Hash() != explicit.Hash() {
+		t.Error("explicit registry defaults hash differently from implicit ones")
+	}
+}
+
+func TestImageDigest(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	digest := func(ref string) string {
+		t.Helper()
+		d, err := ImageDigest(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	cat := digest(write("cat.png", "cat"))
+	if !strings.HasPrefix(cat, "sha256:") {
+		t.Errorf("digest of a file = %q, want a sha256", cat)
+	}
+	if copied := digest(write("copy.png", "cat")); copied != cat {
+		t.Error("the same content at another path has a different digest")
+	}
+	if edited := digest(write("cat.png", "edited cat")); edited == cat {
+		t.Error("an edited file has the same digest")
+	}
+
+	// URLs aren't fetched, so they're keyed as given; data URLs by content.
+	const url = "https://example.com/cat.png"
+	if got := digest(url); got != url {
+		t.Errorf("digest of a URL = %q, want the URL", got)
+	}
+	if got := digest("data:image/png;base64,Y2F0"); !strings.HasPrefix(got, "sha256:") || got == digest("data:image/png;base64,ZG9n") {
+		t.Errorf("digest of a data URL = %q, want a sha256 of its content", got)
+	}
+	if _, err := ImageDigest(filepath.Join(dir, "missing.png")); err == nil {
+		t.Error("ImageDigest of a missing file succeeded")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	v1 := `{"entries": [{"hash": "5d41402abc4b2a76", "prompt": "a cat", "model": "` + testModel + `", "output_file": "cat.webp"}]}`
+	if err := os.WriteFile(filepath.Join(dir, CacheFileName), []byte(v1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version != Version {
+		t.Errorf("Version = %d, want %d", c.Version, Version)
+	}
+	want := NewKey("a cat", testModel, nil).Hash()
+	if e := c.Lookup(want); e == nil || e.OutputFile != "cat.webp" {
+		t.Errorf("Lookup(%s) = %+v, want the migrated entry", want, e)
+	}
+	if c.Lookup("5d41402abc4b2a76") != nil {
+		t.Error("the v1 hash is still indexed")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(path string) error // Applied to the output file after Upsert
+		legacy  bool                    // Recorded before checksums were
+		missing int
+		reason  string // Of the mismatch, if any
+	}{
+		{"intact", nil, false, 0, ""},
+		{"missing", os.Remove, false, 1, ""},
+		{"truncated", func(path string) error { return os.WriteFile(path, []byte("image"), 0644) }, false, 0, "size"},
+		{"overwritten", func(path string) error { return os.WriteFile(path, []byte("IMAGE DATA"), 0644) }, false, 0, "checksum"},
+		{"legacy overwritten", func(path string) error { return os.WriteFile(path, []byte("IMAGE DATA"), 0644) }, true, 0, ""},
+		{"legacy missing", os.Remove, true, 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := load(t, t.TempDir(), BackendJSON)
+			e := withFile(t, c, "a", "a.webp", "image data")
+			if len(e.Checksums) != 1 || e.Checksums[0].Size != int64(len("image data")) {
+				t.Fatalf("Checksums = %+v", e.Checksums)
+			}
+			if tt.legacy {
+				e.Checksums = nil
+			}
+			if tt.change != nil {
+				if err := tt.change(filepath.Join(c.dir, "a.webp")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			missing, mismatches := c.Check(e)
+			if len(missing) != tt.missing {
+				t.Errorf("missing = %v, want %d", missing, tt.missing)
+			}
+			switch {
+			case tt.reason == "" && len(mismatches) > 0:
+				t.Errorf("mismatches = %+v, want none", mismatches)
+			case tt.reason != "" && (len(mismatches) != 1 || mismatches[0].Reason != tt.reason):
+				t.Errorf("mismatches = %+v, want one by %s", mismatches, tt.reason)
+			}
+		})
+	}
+}
+
+func TestUpsertWithoutFiles(t *testing.T) {
+	c := load(t, t.TempDir(), BackendJSON)
+	e := c.Upsert(testKey("a"), []string{"a.webp"})
+	if e.Checksums != nil {
+		t.Errorf("Checksums = %+v, want none for a missing file", e.Checksums)
+	}
+}
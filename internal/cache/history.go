@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Revision is an earlier generation of an entry, kept when it was
+// regenerated. Its files are named <name>@r<number><ext> after the output
+// files they replaced.
+type Revision struct {
+	Number      int        `json:"number"`
+	OutputFile  string     `json:"output_file"`
+	OutputFiles []string   `json:"output_files,omitempty"`
+	Checksums   []Checksum `json:"checksums,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Files returns every output file of the revision.
+func (r *Revision) Files() []string {
+	if len(r.OutputFiles) > 0 {
+		return r.OutputFiles
+	}
+	return []string{r.OutputFile}
+}
+
+// revisionFile returns the name an output file is kept under as revision n.
+func revisionFile(name string, n int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s@r%d%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// currentFile returns the output file a file of revision n was kept for.
+func currentFile(name string, n int) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(strings.TrimSuffix(name, ext), fmt.Sprintf("@r%d", n)) + ext
+}
+
+// Archive keeps the output files of the entry for hash as a new revision, so
+// regenerating it doesn't overwrite them. Files that no longer exist are left
+// out; if none exist, or there is no entry, it returns nil. The entry's
+// variants are deleted rather than kept, since they can be made again.
+func (c *Cache) Archive(hash string) (*Revision, error) {
+	e := c.Lookup(hash)
+	if e == nil {
+		return nil, nil
+	}
+	if err := c.dropVariants(e); err != nil {
+		return nil, fmt.Errorf("failed to delete variants: %w", err)
+	}
+
+	n := 1
+	for _, r := range e.Revisions {
+		n = max(n, r.Number+1)
+	}
+	rev := Revision{Number: n, CreatedAt: e.CreatedAt}
+	files := e.Files()
+	for i, f := range files {
+		to := revisionFile(f, n)
+		if err := os.Rename(filepath.Join(c.dir, f), filepath.Join(c.dir, to)); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			c.unarchive(rev.OutputFiles, n)
+			return nil, err
+		}
+		rev.OutputFiles = append(rev.OutputFiles, to)
+		if len(e.Checksums) == len(files) {
+			rev.Checksums = append(rev.Checksums, e.Checksums[i])
+		}
+	}
+	switch len(rev.OutputFiles) {
+	case 0:
+		return nil, nil
+	case 1:
+		rev.OutputFile, rev.OutputFiles = rev.OutputFiles[0], nil
+	default:
+		rev.OutputFile = rev.OutputFiles[0]
+	}
+
+	e.Revisions = append(e.Revisions, rev)
+	c.markDirty(hash)
+	return &e.Revisions[len(e.Revisions)-1], nil
+}
+
+// unarchive moves files kept as revision n back to their output names.
+func (c *Cache) unarchive(files []string, n int) {
+	for _, f := range files {
+		_ = os.Rename(filepath.Join(c.dir, f), filepath.Join(c.dir, currentFile(f, n)))
+	}
+}
+
+// Restore makes revision n of the entry for hash current again. The current
+// files are archived as a new revision first, so nothing is lost.
+func (c *Cache) Restore(hash string, n int) (*Entry, error) {
+	e := c.Lookup(hash)
+	if e == nil {
+		return nil, fmt.Errorf("no cache entry for %s", hash)
+	}
+	i := -1
+	for j, r := range e.Revisions {
+		if r.Number == n {
+			i = j
+		}
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("%s has no revision %d", hash, n)
+	}
+	rev := e.Revisions[i]
+	for _, f := range rev.Files() {
+		if _, err := os.Stat(filepath.Join(c.dir, f)); err != nil {
+			return nil, fmt.Errorf("revision %d is missing %s", n, f)
+		}
+	}
+
+	if _, err := c.Archive(hash); err != nil {
+		return nil, fmt.Errorf("failed to archive current files: %w", err)
+	}
+	files := make([]string, len(rev.Files()))
+	for j, f := range rev.Files() {
+		files[j] = currentFile(f, n)
+		if err := os.Rename(filepath.Join(c.dir, f), filepath.Join(c.dir, files[j])); err != nil {
+			return nil, err
+		}
+	}
+
+	e.OutputFile = files[0]
+	e.OutputFiles = nil
+	if len(files) > 1 {
+		e.OutputFiles = files
+	}
+	e.Checksums = rev.Checksums
+	e.CreatedAt = rev.CreatedAt
+	e.LastAccessed = time.Now()
+	e.Revisions = append(e.Revisions[:i], e.Revisions[i+1:]...)
+	c.markDirty(hash)
+	return e, nil
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRevisionFile(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"cat.webp", 1, "cat@r1.webp"},
+		{"cat-0.png", 12, "cat-0@r12.png"},
+		{"a.b.jpg", 2, "a.b@r2.jpg"},
+		{"noext", 3, "noext@r3"},
+	}
+	for _, tt := range tests {
+		got := revisionFile(tt.name, tt.n)
+		if got != tt.want {
+			t.Errorf("revisionFile(%q, %d) = %q, want %q", tt.name, tt.n, got, tt.want)
+		}
+		if back := currentFile(got, tt.n); back != tt.name {
+			t.Errorf("currentFile(%q, %d) = %q, want %q", got, tt.n, back, tt.name)
+		}
+	}
+}
+
+// read returns the content of a file in c's directory, or "" if it's missing.
+func read(c *Cache, name string) string {
+	data, _ := os.ReadFile(filepath.Join(c.dir, name))
+	return string(data)
+}
+
+// regenerate archives the entry for prompt and saves content as its new
+// image, as the CLI does when regenerating.
+func regenerate(t *testing.T, c *Cache, prompt, content string) *Revision {
+	t.Helper()
+	rev, err := c.Archive(testKey(prompt).Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	withFile(t, c, prompt, prompt+".webp", content)
+	return rev
+}
+
+func TestArchive(t *testing.T) {
+	c := load(t, t.TempDir(), BackendJSON)
+	hash := testKey("a").Hash()
+	if rev, err := c.Archive(hash); rev != nil || err != nil {
+		t.Errorf("Archive of a missing entry = %+v, %v; want nil, nil", rev, err)
+	}
+
+	withFile(t, c, "a", "a.webp", "first")
+	for n, content := range []string{"second", "third"} {
+		rev := regenerate(t, c, "a", content)
+		if rev == nil || rev.Number != n+1 || rev.OutputFile != revisionFile("a.webp", n+1) || len(rev.Checksums) != 1 {
+			t.Fatalf("Archive = %+v, want revision %d with a checksum", rev, n+1)
+		}
+	}
+	for name, want := range map[string]string{"a.webp": "third", "a@r1.webp": "first", "a@r2.webp": "second"} {
+		if got := read(c, name); got != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+	}
+
+	// Nothing to keep once the files are gone.
+	if err := os.Remove(filepath.Join(c.dir, "a.webp")); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err := c.Archive(hash); rev != nil || err != nil {
+		t.Errorf("Archive without files = %+v, %v; want nil, nil", rev, err)
+	}
+	if n := len(c.Lookup(hash).Revisions); n != 2 {
+		t.Errorf("got %d revisions, want 2", n)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	c := load(t, t.TempDir(), BackendJSON)
+	hash := testKey("a").Hash()
+	withFile(t, c, "a", "a.webp", "first")
+	regenerate(t, c, "a", "second")
+
+	e, err := c.Restore(hash, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(c, e.OutputFile); got != "first" {
+		t.Errorf("restored %q, want first", got)
+	}
+	if missing, mismatches := c.Check(e); len(missing) > 0 || len(mismatches) > 0 {
+		t.Errorf("Check = %v, %v; want the restored checksums", missing, mismatches)
+	}
+	if len(e.Revisions) != 1 || e.Revisions[0].Number != 2 {
+		t.Fatalf("Revisions = %+v, want only the replaced generation as 2", e.Revisions)
+	}
+	if got := read(c, e.Revisions[0].OutputFile); got != "second" {
+		t.Errorf("revision 2 holds %q, want second", got)
+	}
+
+	// And back again
+	if _, err := c.Restore(hash, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(c, "a.webp"); got != "second" {
+		t.Errorf("restored %q, want second", got)
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+		n    int
+		prep func(c *Cache)
+	}{
+		{"no entry", "0000000000000000", 1, nil},
+		{"no revision", testKey("a").Hash(), 5, nil},
+		{"missing file", testKey("a").Hash(), 1, func(c *Cache) { _ = os.Remove(filepath.Join(c.dir, "a@r1.webp")) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := load(t, t.TempDir(), BackendJSON)
+			withFile(t, c, "a", "a.webp", "first")
+			regenerate(t, c, "a", "second")
+			if tt.prep != nil {
+				tt.prep(c)
+			}
+
+			if _, err := c.Restore(tt.hash, tt.n); err == nil {
+				t.Fatal("Restore succeeded")
+			}
+			if got := read(c, "a.webp"); got != "second" {
+				t.Errorf("current file holds %q, want it untouched", got)
+			}
+		})
+	}
+}
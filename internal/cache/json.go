@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gofrs/flock"
+	"github.com/kevinmichaelchen/replicate-images/internal/atomicfile"
+)
+
+const CacheFileName = "cache.json"
+
+// JournalFileName holds entries appended since cache.json was last saved, one
+// JSON object per line. Load replays it and Save compacts it into cache.json,
+// so entries recorded before a crash are not lost.
+const JournalFileName = "cache.journal"
+
+// LockFileName is the advisory lock held while cache.json or the journal is
+// written, so processes sharing an output directory don't lose each other's
+// entries.
+const LockFileName = "cache.lock"
+
+// jsonBackend stores entries in cache.json, with an append-only journal for
+// entries recorded between saves.
+type jsonBackend struct {
+	dir string
+}
+
+func (b jsonBackend) path() string    { return filepath.Join(b.dir, CacheFileName) }
+func (b jsonBackend) journal() string { return filepath.Join(b.dir, JournalFileName) }
+
+// load reads cache.json, migrating older schemas, and replays the journal.
+func (b jsonBackend) load(c *Cache) error {
+	data, err := os.ReadFile(b.path())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		c.Version = 0
+		if err := json.Unmarshal(data, c); err != nil {
+			return err
+		}
+		c.migrate()
+	}
+	c.reindex()
+	return b.replay(c)
+}
+
+// replay applies the journal's entries. A line that doesn't parse, such as
+// one cut short by a crash, is skipped.
+func (b jsonBackend) replay(c *Cache) error {
+	data, err := os.ReadFile(b.journal())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Hash == "" {
+			continue
+		}
+		c.put(e)
+	}
+	return scanner.Err()
+}
+
+// migrate upgrades entries loaded from an older schema to the current one.
+func (c *Cache) migrate() {
+	if c.Version >= Version {
+		return
+	}
+	// v1 hashed prompt+model; the client still applied registry defaults,
+	// so those are the effective inputs of every v1 entry.
+	for i := range c.Entries {
+		e := &c.Entries[i]
+		key := NewKey(e.Prompt, e.Model, nil)
+		e.Hash = key.Hash()
+		e.Params = key.Params
+	}
+	c.Version = Version
+}
+
+// save writes cache.json and clears the journal, whose entries it now
+// contains. Under the lock, it first merges in entries that other processes
+// saved or journaled since Load; entries upserted by this process win.
+// cache.json is replaced atomically, so readers never see a partial file.
+func (b jsonBackend) save(c *Cache) error {
+	unlock, err := b.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := b.merge(c); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(b.path(), data, 0644); err != nil {
+		return err
+	}
+	if err := os.Remove(b.journal()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// lock takes the cache's advisory lock, waiting for other processes to
+// release it, and returns a function that releases it.
+func (b jsonBackend) lock() (func(), error) {
+	l := flock.New(filepath.Join(b.dir, LockFileName))
+	if err := l.Lock(); err != nil {
+		return nil, fmt.Errorf("failed to lock cache: %w", err)
+	}
+	return func() { _ = l.Unlock() }, nil
+}
+
+// merge reloads the cache from disk and reapplies this process's upserts on
+// top of it, dropping the entries it removed.
+func (b jsonBackend) merge(c *Cache) error {
+	disk := &Cache{Version: Version, Entries: []Entry{}}
+	if err := b.load(disk); err != nil {
+		return err
+	}
+	ours := c.dirtyEntries()
+	c.Version = disk.Version
+	c.Entries = disk.Entries
+	c.reindex()
+	if len(c.removed) > 0 {
+		hashes := make([]string, 0, len(c.removed))
+		for h := range c.removed {
+			hashes = append(hashes, h)
+		}
+		c.Remove(hashes...)
+	}
+	for _, e := range ours {
+		c.put(e)
+	}
+	return nil
+}
+
+// append records e in the journal and syncs it to disk.
+func (b jsonBackend) append(_ *Cache, e *Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	unlock, err := b.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(b.journal(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// load loads the cache in dir with backend, failing the test on error.
+func load(t *testing.T, dir, backend string) *Cache {
+	t.Helper()
+	c, err := LoadBackend(dir, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// testKey returns a distinct key for each name.
+func testKey(name string) Key {
+	return NewKey(name, testModel, nil)
+}
+
+func TestJournal(t *testing.T) {
+	tests := []struct {
+		name    string
+		journal string // Appended after the journaled entries
+		want    int
+	}{
+		{"clean", "", 2},
+		{"torn line", `{"hash": "abc", "prompt": "cut sh`, 2},
+		{"no hash", `{"prompt": "no hash"}` + "\n", 2},
+		{"blank lines", "\n\n", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			c := load(t, dir, BackendJSON)
+			for _, name := range []string{"a", "b"} {
+				if err := c.Append(c.Upsert(testKey(name), []string{name + ".webp"})); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f, err := os.OpenFile(filepath.Join(dir, JournalFileName), os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = f.WriteString(tt.journal)
+			_ = f.Close()
+
+			// Not saved, as after a crash
+			got := load(t, dir, BackendJSON)
+			if len(got.Entries) != tt.want {
+				t.Errorf("replayed %d entries, want %d", len(got.Entries), tt.want)
+			}
+			for _, name := range []string{"a", "b"} {
+				if got.Lookup(testKey(name).Hash()) == nil {
+					t.Errorf("entry %s not replayed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestJournalSave(t *testing.T) {
+	dir := t.TempDir()
+	c := load(t, dir, BackendJSON)
+	if err := c.Append(c.Upsert(testKey("a"), []string{"a.webp"})); err != nil {
+		t.Fatal(err)
+	}
+	// A later journal line for the same hash wins over an earlier one.
+	if err := c.Append(c.Upsert(testKey("a"), []string{"a2.webp"})); err != nil {
+		t.Fatal(err)
+	}
+	if e := load(t, dir, BackendJSON).Lookup(testKey("a").Hash()); e == nil || e.OutputFile != "a2.webp" {
+		t.Errorf("replayed %+v, want the last journaled entry", e)
+	}
+
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, JournalFileName)); !os.IsNotExist(err) {
+		t.Errorf("journal still exists after Save: %v", err)
+	}
+	if got := load(t, dir, BackendJSON); len(got.Entries) != 1 {
+		t.Errorf("loaded %d entries after Save, want 1", len(got.Entries))
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		// a and b are loaded before either saves; both start with "old".
+		a, b  func(c *Cache)
+		want  []string // Prompts of the entries after both save
+		files map[string]string
+	}{
+		{
+			name: "disjoint upserts",
+			a:    func(c *Cache) { c.Upsert(testKey("a"), []string{"a.webp"}) },
+			b:    func(c *Cache) { c.Upsert(testKey("b"), []string{"b.webp"}) },
+			want: []string{"old", "a", "b"},
+		},
+		{
+			name: "remove survives a stale writer",
+			a:    func(c *Cache) { c.Remove(testKey("old").Hash()) },
+			b:    func(c *Cache) { c.Upsert(testKey("b"), []string{"b.webp"}) },
+			want: []string{"b"},
+		},
+		{
+			name:  "last upsert wins",
+			a:     func(c *Cache) { c.Upsert(testKey("old"), []string{"a.webp"}) },
+			b:     func(c *Cache) { c.Upsert(testKey("old"), []string{"b.webp"}) },
+			want:  []string{"old"},
+			files: map[string]string{"old": "b.webp"},
+		},
+		{
+			name: "upsert after remove",
+			a:    func(c *Cache) { c.Remove(testKey("old").Hash()) },
+			b:    func(c *Cache) { c.Upsert(testKey("old"), []string{"b.webp"}) },
+			want: []string{"old"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			c := load(t, dir, BackendJSON)
+			c.Upsert(testKey("old"), []string{"old.webp"})
+			if err := c.Save(); err != nil {
+				t.Fatal(err)
+			}
+
+			a, b := load(t, dir, BackendJSON), load(t, dir, BackendJSON)
+			tt.a(a)
+			tt.b(b)
+			if err := a.Save(); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Save(); err != nil {
+				t.Fatal(err)
+			}
+
+			got := load(t, dir, BackendJSON)
+			if len(got.Entries) != len(tt.want) {
+				t.Errorf("got %d entries, want %v", len(got.Entries), tt.want)
+			}
+			for _, prompt := range tt.want {
+				e := got.Lookup(testKey(prompt).Hash())
+				if e == nil {
+					t.Errorf("entry %q missing", prompt)
+					continue
+				}
+				if want, ok := tt.files[prompt]; ok && e.OutputFile != want {
+					t.Errorf("entry %q has %s, want %s", prompt, e.OutputFile, want)
+				}
+			}
+		})
+	}
+}
+
+// TestConcurrentSaves checks that the lock serializes writers, so none of
+// their entries are lost.
+func TestConcurrentSaves(t *testing.T) {
+	const writers = 8
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := Load(dir)
+			if err != nil {
+				errs <- err
+				return
+			}
+			c.Upsert(testKey(fmt.Sprint(i)), []string{fmt.Sprintf("%d.webp", i)})
+			errs <- c.Save()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := load(t, dir, BackendJSON); len(got.Entries) != writers {
+		t.Errorf("got %d entries, want %d", len(got.Entries), writers)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
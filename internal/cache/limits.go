@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits bounds the size and age of a cache. The zero value is unbounded.
+type Limits struct {
+	MaxSize int64         // Bytes of output files to keep, or 0 for no limit
+	TTL     time.Duration // How long an unused entry is kept, or 0 forever
+}
+
+// Evicted is an entry removed by Evict.
+type Evicted struct {
+	Entry
+	Reason string   `json:"reason"`          // ttl or size
+	Files  []string `json:"files,omitempty"` // Output paths deleted with the entry
+	Size   int64    `json:"size"`            // Bytes freed
+}
+
+// sizeUnits are the suffixes ParseSize accepts, by multiplier.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1000,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1000 * 1000,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1000 * 1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+	"t":   1000 * 1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"tib": 1 << 40,
+}
+
+// ParseSize parses a byte count such as 500MB, 2GiB or 1048576.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q: want e.g. 500MB or 2GiB", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// SetLimits sets the bounds Evict enforces.
+func (c *Cache) SetLimits(l Limits) {
+	c.limits = l
+}
+
+// lastUsed returns when e was last generated or served from the cache.
+func (e *Entry) lastUsed() time.Time {
+	if e.LastAccessed.IsZero() {
+		return e.CreatedAt
+	}
+	return e.LastAccessed
+}
+
+// Evict removes the entries unused for longer than the TTL, then the least
+// recently used ones until their output files fit in the maximum size,
+// deleting files no remaining entry shares. Entries used since the cache was
+// loaded are kept, even over the limit. With dryRun, nothing is changed.
+func (c *Cache) Evict(dryRun bool) ([]Evicted, error) {
+	if c.limits == (Limits{}) {
+		return nil, nil
+	}
+
+	// Named outputs can be shared by several entries, so sizes are counted
+	// per file. Aliases are hardlinks to their entry's images, so each
+	// image's size is counted once, for the first of its names.
+	refs := make(map[string]int)
+	sizes := make(map[string]int64)
+	counted := make(map[int64][]os.FileInfo) // By size, since links have the same one
+	var total int64
+	for _, e := range c.Entries {
+		for _, f := range e.AllFiles() {
+			refs[f]++
+			if _, ok := sizes[f]; ok {
+				continue
+			}
+			sizes[f] = 0
+			info, err := os.Stat(filepath.Join(c.dir, f))
+			if err != nil || slices.ContainsFunc(counted[info.Size()], func(fi os.FileInfo) bool { return os.SameFile(fi, info) }) {
+				continue
+			}
+			counted[info.Size()] = append(counted[info.Size()], info)
+			sizes[f] = info.Size()
+			total += info.Size()
+		}
+	}
+
+	order := make([]*Entry, len(c.Entries))
+	for i := range c.Entries {
+		order[i] = &c.Entries[i]
+	}
+	slices.SortStableFunc(order, func(a, b *Entry) int { return a.lastUsed().Compare(b.lastUsed()) })
+
+	now := time.Now()
+	var evicted []Evicted
+	var err error
+evict:
+	for _, e := range order {
+		used := e.lastUsed()
+		if !used.Before(c.loaded) {
+			break
+		}
+		var reason string
+		switch {
+		case c.limits.TTL > 0 && now.Sub(used) > c.limits.TTL:
+			reason = "ttl"
+		case c.limits.MaxSize > 0 && total > c.limits.MaxSize:
+			reason = "size"
+		default:
+			break evict // Every later entry is newer and fits
+		}
+
+		ev := Evicted{Entry: *e, Reason: reason}
+		for _, f := range e.AllFiles() {
+			if refs[f]--; refs[f] > 0 {
+				continue
+			}
+			path := filepath.Join(c.dir, f)
+			if !dryRun {
+				if rmErr := os.Remove(path); rmErr != nil && !os.IsNotExist(rmErr) {
+					err = fmt.Errorf("failed to delete %s: %w", path, rmErr)
+					if len(ev.Files) > 0 {
+						// Some of its files are gone, so it can't stay cached.
+						evicted = append(evicted, ev)
+					}
+					break evict
+				}
+			}
+			ev.Files = append(ev.Files, path)
+			ev.Size += sizes[f]
+			total -= sizes[f]
+		}
+		evicted = append(evicted, ev)
+	}
+
+	if !dryRun && len(evicted) > 0 {
+		hashes := make([]string, len(evicted))
+		for i, ev := range evicted {
+			hashes[i] = ev.Hash
+		}
+		c.Remove(hashes...)
+	}
+	return evicted, err
+}
@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"1048576", 1 << 20},
+		{"500MB", 500_000_000},
+		{"500mb", 500_000_000},
+		{"2GiB", 2 << 30},
+		{"1.5k", 1500},
+		{"10 KiB", 10 << 10},
+		{" 1t ", 1_000_000_000_000},
+		{"100b", 100},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "MB", "-1MB", "1.2.3", "5 parsecs", "1e6"} {
+		if got, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+// evictCache returns a cache with an entry per name, each with a file of
+// size bytes, last used an hour apart in order, oldest first. The cache is
+// reloaded so that none counts as used since.
+func evictCache(t *testing.T, size int, names ...string) *Cache {
+	t.Helper()
+	dir := t.TempDir()
+	c := load(t, dir, BackendJSON)
+	for _, name := range names {
+		withFile(t, c, name, name+".webp", strings.Repeat("x", size))
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c = load(t, dir, BackendJSON)
+	for i, name := range names {
+		c.Lookup(testKey(name).Hash()).LastAccessed = time.Now().Add(-time.Duration(len(names)-i) * time.Hour)
+	}
+	return c
+}
+
+// prompts returns the prompts of evicted entries, in eviction order.
+func prompts(evicted []Evicted) []string {
+	var names []string
+	for _, ev := range evicted {
+		names = append(names, ev.Prompt)
+	}
+	return names
+}
+
+func TestEvict(t *testing.T) {
+	// a is the least recently used, then b, then c, an hour apart.
+	tests := []struct {
+		name   string
+		limits Limits
+		touch  string // Used after loading
+		want   []string
+	}{
+		{"unbounded", Limits{}, "", nil},
+		{"fits", Limits{MaxSize: 300}, "", nil},
+		{"size", Limits{MaxSize: 200}, "", []string{"a"}},
+		{"size to one", Limits{MaxSize: 150}, "", []string{"a", "b"}},
+		{"ttl", Limits{TTL: 90 * time.Minute}, "", []string{"a", "b"}},
+		{"ttl and size", Limits{TTL: 150 * time.Minute, MaxSize: 150}, "", []string{"a", "b"}},
+		{"used since load", Limits{MaxSize: 50}, "a", []string{"b", "c"}}, // a is kept over the limit
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := evictCache(t, 100, "a", "b", "c")
+			if tt.touch != "" {
+				c.Touch(testKey(tt.touch).Hash())
+			}
+			c.SetLimits(tt.limits)
+
+			dry, err := c.Evict(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := prompts(dry); !slices.Equal(got, tt.want) {
+				t.Errorf("Evict(dry run) = %v, want %v", got, tt.want)
+			}
+			if len(c.Entries) != 3 {
+				t.Fatalf("dry run removed entries: %d left", len(c.Entries))
+			}
+
+			evicted, err := c.Evict(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := prompts(evicted); !slices.Equal(got, tt.want) {
+				t.Errorf("Evict = %v, want %v", got, tt.want)
+			}
+			for _, name := range []string{"a", "b", "c"} {
+				gone := slices.Contains(tt.want, name)
+				if (c.Lookup(testKey(name).Hash()) == nil) != gone {
+					t.Errorf("entry %s evicted = %v, want %v", name, !gone, gone)
+				}
+				if _, err := os.Stat(filepath.Join(c.dir, name+".webp")); os.IsNotExist(err) != gone {
+					t.Errorf("file of %s deleted = %v, want %v", name, !gone, gone)
+				}
+			}
+		})
+	}
+}
+
+func TestEvictSharedFile(t *testing.T) {
+	c := evictCache(t, 100, "a", "b")
+	// b is an older generation of the same named output as a.
+	c.Lookup(testKey("b").Hash()).OutputFile = "a.webp"
+	c.SetLimits(Limits{TTL: 90 * time.Minute})
+
+	evicted, err := c.Evict(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := prompts(evicted); !slices.Equal(got, []string{"a"}) {
+		t.Fatalf("Evict = %v, want [a]", got)
+	}
+	if len(evicted[0].Files) != 0 {
+		t.Errorf("deleted %v, still used by b", evicted[0].Files)
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, "a.webp")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEvictAliases(t *testing.T) {
+	c := evictCache(t, 100, "a", "b")
+	for _, name := range []string{"a", "b"} {
+		if err := c.AddAlias(testKey(name).Hash(), Alias{Name: name + "-hero", Files: []string{name + "-hero.webp"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The aliases are links to the images, so 200 bytes are used, not 400.
+	c.SetLimits(Limits{MaxSize: 200})
+	if evicted, err := c.Evict(true); err != nil || len(evicted) != 0 {
+		t.Fatalf("Evict = %v, %v; want nothing evicted", prompts(evicted), err)
+	}
+
+	c.SetLimits(Limits{MaxSize: 150})
+	evicted, err := c.Evict(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := prompts(evicted); !slices.Equal(got, []string{"a"}) {
+		t.Fatalf("Evict = %v, want [a]", got)
+	}
+	if len(evicted[0].Files) != 2 || evicted[0].Size != 100 {
+		t.Errorf("deleted %v freeing %d bytes, want the image and its alias freeing 100", evicted[0].Files, evicted[0].Size)
+	}
+}
+
+func TestEvictPartialDelete(t *testing.T) {
+	c := evictCache(t, 100, "a", "b")
+	// a's second file can't be deleted: it's a directory with a file in it.
+	a := c.Lookup(testKey("a").Hash())
+	a.OutputFiles = []string{"a.webp", "stuck"}
+	if err := os.MkdirAll(filepath.Join(c.dir, "stuck", "file"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c.SetLimits(Limits{MaxSize: 1})
+
+	evicted, err := c.Evict(false)
+	if err == nil {
+		t.Fatal("Evict succeeded")
+	}
+	// a lost a file, so it can't stay cached; b was never reached.
+	if got := prompts(evicted); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("Evict = %v, want [a]", got)
+	}
+	if c.Lookup(testKey("a").Hash()) != nil {
+		t.Error("entry a is still cached without its first file")
+	}
+	if c.Lookup(testKey("b").Hash()) == nil {
+		t.Error("entry b was evicted after the failure")
+	}
+}
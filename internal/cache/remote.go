@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/atomicfile"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// defaultS3Endpoint is used when AWS_ENDPOINT_URL isn't set.
+const defaultS3Endpoint = "https://s3.amazonaws.com"
+
+// Remote is a cache shared through an S3-compatible bucket. Each entry is
+// stored under <prefix>/<hash>/, as its files plus a record of the entry and
+// the files' SHA-256 checksums.
+//
+// The endpoint is AWS_ENDPOINT_URL (e.g. http://localhost:9000 for MinIO),
+// else AWS S3. Credentials come from AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY, MINIO_ROOT_USER and MINIO_ROOT_PASSWORD,
+// ~/.aws/credentials or an IAM role, in that order.
+type Remote struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewRemote connects to the bucket in an s3://bucket/prefix URL.
+func NewRemote(rawURL string) (*Remote, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid remote cache %q: want s3://bucket/prefix", rawURL)
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+	e, err := url.Parse(endpoint)
+	if err != nil || e.Host == "" {
+		return nil, fmt.Errorf("invalid AWS_ENDPOINT_URL %q", endpoint)
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+	})
+	client, err := minio.New(e.Host, &minio.Options{
+		Creds:  creds,
+		Secure: e.Scheme != "http",
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+	return &Remote{client: client, bucket: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+// String returns the remote's s3:// URL.
+func (r *Remote) String() string {
+	return "s3://" + path.Join(r.bucket, r.prefix)
+}
+
+// object returns the name of an entry's object.
+func (r *Remote) object(hash, name string) string {
+	return path.Join(r.prefix, hash, name)
+}
+
+// get fetches the record for hash, or nil if the remote has none.
+func (r *Remote) get(ctx context.Context, hash string) (*storedRecord, error) {
+	obj, err := r.client.GetObject(ctx, r.bucket, r.object(hash, recordName), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = obj.Close() }()
+
+	var rec storedRecord
+	if err := json.NewDecoder(obj).Decode(&rec); err != nil {
+		if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !rec.valid(hash) {
+		return nil, fmt.Errorf("invalid remote record for %s", hash)
+	}
+	return &rec, nil
+}
+
+// download fetches a file of the entry for hash into dst, verifying its
+// checksum before it replaces dst.
+func (r *Remote) download(ctx context.Context, hash string, f storedFile, dst string) error {
+	obj, err := r.client.GetObject(ctx, r.bucket, r.object(hash, f.Name), minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = obj.Close() }()
+
+	h := sha256.New()
+	return atomicfile.WriteFrom(dst, io.TeeReader(obj, h), 0644, func() error {
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != f.SHA256 {
+			return fmt.Errorf("checksum mismatch for %s: got %s, want %s", r.object(hash, f.Name), sum, f.SHA256)
+		}
+		return nil
+	})
+}
+
+// put uploads e's files from outputDir, then its record.
+func (r *Remote) put(ctx context.Context, e Entry, outputDir string) error {
+	rec, err := newRecord(e, outputDir)
+	if err != nil {
+		return err
+	}
+	for i, f := range rec.Files {
+		src := filepath.Join(outputDir, e.Files()[i])
+		_, err = r.client.FPutObject(ctx, r.bucket, r.object(e.Hash, f.Name), src, minio.PutObjectOptions{
+			ContentType: contentType(f.Name),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.PutObject(ctx, r.bucket, r.object(e.Hash, recordName), bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: "application/json",
+	})
+	return err
+}
+
+// contentType returns the MIME type of an image file by extension.
+func contentType(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".webp":
+		return "image/webp"
+	case ".png":
+		return "image/png"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	default:
+		return "application/octet-stream"
+	}
+}
@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// testRemote connects to the bucket in REPLICATE_IMAGES_TEST_REMOTE, under a
+// prefix of its own, creating the bucket if needed. The test is skipped
+// unless it's set; scripts/test-remote-cache.sh runs it against MinIO.
+func testRemote(t *testing.T) *Remote {
+	t.Helper()
+	url := os.Getenv("REPLICATE_IMAGES_TEST_REMOTE")
+	if url == "" {
+		t.Skip("REPLICATE_IMAGES_TEST_REMOTE not set; see scripts/test-remote-cache.sh")
+	}
+	r, err := NewRemote(fmt.Sprintf("%s/%s-%d", url, t.Name(), time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	exists, err := r.client.BucketExists(ctx, r.bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		if err := r.client.MakeBucket(ctx, r.bucket, minio.MakeBucketOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+// pushed saves data as the only image of a new entry in a fresh output
+// directory and pushes it to r.
+func pushed(t *testing.T, r *Remote, prompt string, data []byte) *Entry {
+	t.Helper()
+	dir := t.TempDir()
+	key := NewKey(prompt, "black-forest-labs/flux-schnell", nil)
+	name := key.Hash() + ".webp"
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetRemote(r)
+	e := c.Upsert(key, []string{name})
+	if err := c.Push(context.Background(), *e, dir); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	return e
+}
+
+// pull pulls hash from r into the cache of a fresh output directory.
+func pull(t *testing.T, r *Remote, hash string) (*Cache, *Entry, error) {
+	t.Helper()
+	dir := t.TempDir()
+	c, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetRemote(r)
+	e, err := c.Pull(context.Background(), hash, dir)
+	return c, e, err
+}
+
+func TestRemote(t *testing.T) {
+	r := testRemote(t)
+	ctx := context.Background()
+
+	t.Run("put and get", func(t *testing.T) {
+		data := []byte("image data")
+		want := pushed(t, r, "put and get", data)
+
+		c, e, err := pull(t, r, want.Hash)
+		if err != nil {
+			t.Fatalf("Pull: %v", err)
+		}
+		if e == nil {
+			t.Fatal("Pull: entry not found")
+		}
+		if e.Prompt != want.Prompt || e.OutputFile != want.OutputFile {
+			t.Errorf("Pull = %s %q, want %s %q", e.OutputFile, e.Prompt, want.OutputFile, want.Prompt)
+		}
+		got, err := os.ReadFile(filepath.Join(c.dir, e.OutputFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("pulled %q, want %q", got, data)
+		}
+		if missing, mismatches := c.Check(e); len(missing) > 0 || len(mismatches) > 0 {
+			t.Errorf("Check = %v, %v; want no problems", missing, mismatches)
+		}
+	})
+
+	t.Run("miss", func(t *testing.T) {
+		_, e, err := pull(t, r, "0000000000000000")
+		if err != nil || e != nil {
+			t.Errorf("Pull = %v, %v; want nil, nil", e, err)
+		}
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		e := pushed(t, r, "checksum mismatch", []byte("original"))
+		tampered := []byte("tampered")
+		_, err := r.client.PutObject(ctx, r.bucket, r.object(e.Hash, "0.webp"), bytes.NewReader(tampered), int64(len(tampered)), minio.PutObjectOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, got, err := pull(t, r, e.Hash)
+		if err == nil {
+			t.Fatalf("Pull = %v, want a checksum error", got)
+		}
+		files, _ := os.ReadDir(c.dir)
+		for _, f := range files {
+			if filepath.Ext(f.Name()) != ".json" && f.Name() != "cache.lock" {
+				t.Errorf("Pull left %s behind", f.Name())
+			}
+		}
+	})
+}
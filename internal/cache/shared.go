@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// recordName is the object, next to an entry's files, that describes the
+// entry in a Store or Remote. It's written last, so an entry is never visible
+// before its files are.
+const recordName = "entry.json"
+
+// storedRecord describes an entry kept in a Store or Remote.
+type storedRecord struct {
+	Entry Entry        `json:"entry"`
+	Files []storedFile `json:"files"` // In the order of Entry.Files()
+}
+
+// storedFile is a single stored output file.
+type storedFile struct {
+	Name   string `json:"name"` // Object name, relative to the entry
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// newRecord describes e, whose files are in outputDir. Stored files are named
+// by position, since output names differ between projects.
+func newRecord(e Entry, outputDir string) (*storedRecord, error) {
+	rec := &storedRecord{Entry: e}
+	rec.Entry.Revisions, rec.Entry.Aliases, rec.Entry.Variants = nil, nil, nil // Their files stay local
+	for i, name := range e.Files() {
+		sum, size, err := fileSHA256(filepath.Join(outputDir, name))
+		if err != nil {
+			return nil, err
+		}
+		rec.Files = append(rec.Files, storedFile{
+			Name:   fmt.Sprintf("%d%s", i, filepath.Ext(name)),
+			Size:   size,
+			SHA256: sum,
+		})
+	}
+	return rec, nil
+}
+
+// localNames returns the names of the record's files in an output directory.
+func (rec *storedRecord) localNames() []string {
+	names := make([]string, len(rec.Files))
+	for i, f := range rec.Files {
+		names[i] = hashName(rec.Entry.Hash, i, len(rec.Files), filepath.Ext(f.Name))
+	}
+	return names
+}
+
+// valid reports whether the record describes the entry for hash.
+func (rec *storedRecord) valid(hash string) bool {
+	if rec.Entry.Hash != hash || len(rec.Files) != len(rec.Entry.Files()) {
+		return false
+	}
+	for _, f := range rec.Files {
+		if f.Name != filepath.Base(f.Name) || f.Name == recordName {
+			return false
+		}
+	}
+	return true
+}
+
+// SetRemote makes the cache read through and write through to r with Pull
+// and Push.
+func (c *Cache) SetRemote(r *Remote) {
+	c.remote = r
+}
+
+// SetStore makes the cache read through and write through to s with Pull and
+// Push. The store is consulted before any remote cache.
+func (c *Cache) SetStore(s *Store) {
+	c.store = s
+}
+
+// Pull looks up hash in the store, then in the remote cache, and if it's
+// there, copies its files into outputDir, named after hash, and records the
+// entry. It returns nil if neither has an entry for
+// hash. A remote download whose checksum doesn't match is an error, and
+// leaves no file behind. Entries pulled from the remote cache are added to
+// the store.
+func (c *Cache) Pull(ctx context.Context, hash, outputDir string) (*Entry, error) {
+	var storeErr error
+	if c.store != nil {
+		rec, files, err := c.store.get(hash, outputDir)
+		if err == nil && rec != nil {
+			return c.pulled(rec, files), nil
+		}
+		storeErr = err
+	}
+	if c.remote == nil {
+		return nil, storeErr
+	}
+
+	rec, err := c.remote.get(ctx, hash)
+	if err != nil || rec == nil {
+		return nil, errors.Join(storeErr, err)
+	}
+	files := rec.localNames()
+	for i, f := range rec.Files {
+		if err := c.remote.download(ctx, hash, f, filepath.Join(outputDir, files[i])); err != nil {
+			return nil, err
+		}
+	}
+	e := c.pulled(rec, files)
+	if c.store != nil {
+		// Best effort: the files are in outputDir either way.
+		_ = c.store.put(*e, outputDir)
+	}
+	return e, nil
+}
+
+// pulled records an entry pulled into the output directory as files.
+func (c *Cache) pulled(rec *storedRecord, files []string) *Entry {
+	e := rec.Entry
+	e.Checksums = make([]Checksum, len(rec.Files))
+	for i, f := range rec.Files {
+		e.Checksums[i] = Checksum{SHA256: f.SHA256, Size: f.Size}
+	}
+	e.LastAccessed = time.Now()
+	e.Revisions, e.Aliases, e.Variants = nil, nil, nil
+	if local := c.Lookup(e.Hash); local != nil {
+		// Best effort: variants left behind are overwritten when made again.
+		_ = c.dropVariants(local)
+		e.Revisions, e.Aliases = local.Revisions, local.Aliases
+	}
+	e.OutputFile = files[0]
+	e.OutputFiles = nil
+	if len(files) > 1 {
+		e.OutputFiles = files
+	}
+	c.put(e)
+	c.markDirty(e.Hash)
+	delete(c.removed, e.Hash)
+	return c.Lookup(e.Hash)
+}
+
+// Push adds e and its files from outputDir to the store and uploads them to
+// the remote cache, whichever are set.
+func (c *Cache) Push(ctx context.Context, e Entry, outputDir string) error {
+	var errs []error
+	if c.store != nil {
+		if err := c.store.put(e, outputDir); err != nil {
+			errs = append(errs, fmt.Errorf("store: %w", err))
+		}
+	}
+	if c.remote != nil {
+		if err := c.remote.put(ctx, e, outputDir); err != nil {
+			errs = append(errs, fmt.Errorf("remote cache: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fileSHA256 returns the hex SHA-256 and size of a file.
+func fileSHA256(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,276 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/kevinmichaelchen/replicate-images/internal/atomicfile"
+)
+
+// ProjectsFileName lists the output directories that use a Store.
+const ProjectsFileName = "projects.json"
+
+// storeGCGrace protects entries added to a Store this recently from GC, so a
+// run that has stored an image but not yet recorded it isn't raced.
+const storeGCGrace = time.Hour
+
+// Store is a user-level cache shared by every project on the machine. Each
+// entry is kept under objects/<hash>/, as its files plus a record of the
+// entry, and output directories get hardlinks to the files (or copies, across
+// filesystems), so an image is generated and stored once.
+type Store struct {
+	dir string
+}
+
+// StoredObject is an entry in a Store.
+type StoredObject struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"` // Bytes used by its files
+}
+
+// DefaultStoreDir returns the store in the user's cache directory:
+// $XDG_CACHE_HOME/replicate-images/store on Linux.
+func DefaultStoreDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "replicate-images", "store"), nil
+}
+
+// OpenStore opens the store in dir, creating it if needed.
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create store: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Dir returns the store's directory.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+func (s *Store) objectDir(hash string) string {
+	return filepath.Join(s.dir, "objects", hash)
+}
+
+// get links the files of the entry for hash into outputDir, returning its
+// record and the filenames used, or a nil record if the store has no such
+// entry.
+func (s *Store) get(hash, outputDir string) (*storedRecord, []string, error) {
+	data, err := os.ReadFile(filepath.Join(s.objectDir(hash), recordName))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var rec storedRecord
+	if err := json.Unmarshal(data, &rec); err != nil || !rec.valid(hash) {
+		return nil, nil, fmt.Errorf("invalid store record for %s", hash)
+	}
+
+	files := rec.localNames()
+	for i, f := range rec.Files {
+		if err := linkOrCopy(filepath.Join(s.objectDir(hash), f.Name), filepath.Join(outputDir, files[i])); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &rec, files, nil
+}
+
+// put links e's files from outputDir into the store and records it, unless
+// it's already there.
+func (s *Store) put(e Entry, outputDir string) error {
+	dir := s.objectDir(e.Hash)
+	if _, err := os.Stat(filepath.Join(dir, recordName)); err == nil {
+		return nil
+	}
+	rec, err := newRecord(e, outputDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, f := range rec.Files {
+		if err := linkOrCopy(filepath.Join(outputDir, e.Files()[i]), filepath.Join(dir, f.Name)); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, recordName), data, 0644)
+}
+
+// link replaces a file with a hardlink; tests swap it to simulate links
+// across filesystems.
+var link = atomicfile.Link
+
+// linkOrCopy makes dst a hardlink to src, or a copy if they're on different
+// filesystems, replacing dst atomically.
+func linkOrCopy(src, dst string) error {
+	// Renaming a link onto the same file is a no-op that leaves it behind.
+	if si, err := os.Stat(src); err == nil {
+		if di, err := os.Stat(dst); err == nil && os.SameFile(si, di) {
+			return nil
+		}
+	}
+	if err := link(src, dst); err != nil {
+		return copyFile(src, dst)
+	}
+	return nil
+}
+
+// lock takes the store's advisory lock and returns a function that releases
+// it.
+func (s *Store) lock() (func(), error) {
+	l := flock.New(filepath.Join(s.dir, LockFileName))
+	if err := l.Lock(); err != nil {
+		return nil, fmt.Errorf("failed to lock store: %w", err)
+	}
+	return func() { _ = l.Unlock() }, nil
+}
+
+// Projects returns the output directories registered with the store.
+func (s *Store) Projects() ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, ProjectsFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var projects []string
+	if err := json.Unmarshal(data, &projects); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", ProjectsFileName, err)
+	}
+	return projects, nil
+}
+
+// Register records outputDir as a project whose cache references the store,
+// so GC keeps its entries.
+func (s *Store) Register(outputDir string) error {
+	abs, err := filepath.Abs(outputDir)
+	if err != nil {
+		return err
+	}
+	return s.updateProjects(func(projects []string) []string {
+		if slices.Contains(projects, abs) {
+			return projects
+		}
+		return append(projects, abs)
+	})
+}
+
+// updateProjects rewrites the project list with update, under the lock.
+func (s *Store) updateProjects(update func([]string) []string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	projects, err := s.Projects()
+	if err != nil {
+		return err
+	}
+	updated := update(slices.Clone(projects))
+	if slices.Equal(projects, updated) {
+		return nil
+	}
+	data, err := json.MarshalIndent(updated, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(s.dir, ProjectsFileName), data, 0644)
+}
+
+// GC deletes the entries that no registered project's cache references,
+// returning them. Projects whose output directory no longer exists are
+// unregistered. With dryRun, nothing is changed.
+func (s *Store) GC(dryRun bool) ([]StoredObject, error) {
+	projects, err := s.Projects()
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool)
+	var gone []string
+	for _, dir := range projects {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			gone = append(gone, dir)
+			continue
+		}
+		c, err := loadProject(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cache of %s: %w", dir, err)
+		}
+		for _, e := range c.Entries {
+			referenced[e.Hash] = true
+		}
+	}
+	if !dryRun && len(gone) > 0 {
+		err := s.updateProjects(func(projects []string) []string {
+			return slices.DeleteFunc(projects, func(p string) bool { return slices.Contains(gone, p) })
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dirs, err := os.ReadDir(filepath.Join(s.dir, "objects"))
+	if err != nil {
+		return nil, err
+	}
+	var removed []StoredObject
+	for _, d := range dirs {
+		if !d.IsDir() || referenced[d.Name()] {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(info.ModTime()) < storeGCGrace {
+			continue
+		}
+
+		obj := StoredObject{Hash: d.Name()}
+		dir := s.objectDir(d.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if info, err := f.Info(); err == nil {
+				obj.Size += info.Size()
+			}
+		}
+		if !dryRun {
+			if err := os.RemoveAll(dir); err != nil {
+				return nil, err
+			}
+		}
+		removed = append(removed, obj)
+	}
+	return removed, nil
+}
+
+// loadProject loads a project's cache with whichever backend it uses.
+func loadProject(dir string) (*Cache, error) {
+	backend, err := DetectBackend(dir)
+	if err != nil {
+		return nil, err
+	}
+	return LoadBackend(dir, backend)
+}
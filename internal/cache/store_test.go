@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLinkOrCopy(t *testing.T) {
+	tests := []struct {
+		name      string
+		crossDev  bool // Whether links fail as they do across filesystems
+		wantLinks bool
+	}{
+		{"same filesystem", false, true},
+		{"across filesystems", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.crossDev {
+				defer func(l func(string, string) error) { link = l }(link)
+				link = func(src, dst string) error {
+					return &os.LinkError{Op: "link", Old: src, New: dst, Err: syscall.EXDEV}
+				}
+			}
+			dir := t.TempDir()
+			src, dst := filepath.Join(dir, "src.webp"), filepath.Join(dir, "dst.webp")
+			for name, content := range map[string]string{src: "stored", dst: "old"} {
+				if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := linkOrCopy(src, dst); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(dst); string(got) != "stored" {
+				t.Errorf("dst holds %q, want stored", got)
+			}
+			si, _ := os.Stat(src)
+			di, _ := os.Stat(dst)
+			if linked := os.SameFile(si, di); linked != tt.wantLinks {
+				t.Errorf("dst linked = %v, want %v", linked, tt.wantLinks)
+			}
+			// Linking again is a no-op rather than an error.
+			if err := linkOrCopy(src, dst); err != nil {
+				t.Errorf("linkOrCopy again: %v", err)
+			}
+		})
+	}
+}
+
+// openStore opens a store in a temporary directory.
+func openStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRegister(t *testing.T) {
+	s := openStore(t)
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	for _, d := range []string{dir, ".", dir} {
+		if err := s.Register(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	projects, err := s.Projects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(projects, []string{dir}) {
+		t.Errorf("Projects = %v, want only %s", projects, dir)
+	}
+}
+
+// storedEntry pushes an entry for prompt, with one file, into s from a
+// project in dir, returning its hash.
+func storedEntry(t *testing.T, s *Store, dir, prompt string) string {
+	t.Helper()
+	c := load(t, dir, BackendJSON)
+	c.SetStore(s)
+	e := withFile(t, c, prompt, testKey(prompt).Hash()+".webp", "image "+prompt)
+	if err := c.Push(context.Background(), *e, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return e.Hash
+}
+
+func TestStoreGC(t *testing.T) {
+	s := openStore(t)
+	kept, gone := t.TempDir(), filepath.Join(t.TempDir(), "gone")
+	if err := os.Mkdir(gone, 0755); err != nil {
+		t.Fatal(err)
+	}
+	referenced := storedEntry(t, s, kept, "referenced")
+	orphan := storedEntry(t, s, gone, "orphan")
+	recent := storedEntry(t, s, gone, "recent")
+	for _, d := range []string{kept, gone} {
+		if err := s.Register(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Its project is deleted, and it's past the grace period.
+	if err := os.RemoveAll(gone); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * storeGCGrace)
+	if err := os.Chtimes(s.objectDir(orphan), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		removed, err := s.GC(dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(removed) != 1 || removed[0].Hash != orphan || removed[0].Size == 0 {
+			t.Errorf("GC(%v) = %+v, want only %s", dryRun, removed, orphan)
+		}
+		_, err = os.Stat(s.objectDir(orphan))
+		if dryRun && err != nil {
+			t.Errorf("GC(true) removed %s", orphan)
+		}
+		if projects, _ := s.Projects(); dryRun && len(projects) != 2 {
+			t.Errorf("GC(true) unregistered projects: %v", projects)
+		}
+		if !dryRun && !os.IsNotExist(err) {
+			t.Errorf("GC(false) kept %s", orphan)
+		}
+	}
+	for _, hash := range []string{referenced, recent} {
+		if _, err := os.Stat(s.objectDir(hash)); err != nil {
+			t.Errorf("GC removed %s: %v", hash, err)
+		}
+	}
+	if projects, _ := s.Projects(); !slices.Equal(projects, []string{kept}) {
+		t.Errorf("Projects = %v, want the deleted project unregistered", projects)
+	}
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Variant is a downscaled copy of an entry's images, e.g. for responsive web
+// pages. Its files are named <name>@<width>w<ext> after the output files, and
+// every alias of the entry gets its own, named after the alias's files.
+type Variant struct {
+	Width int      `json:"width"`
+	Files []string `json:"files"` // In the order of Entry.Files
+}
+
+// VariantFile returns the name of an output file's variant at width.
+func VariantFile(name string, width int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s@%dw%s", strings.TrimSuffix(name, ext), width, ext)
+}
+
+// Variant returns the entry's variant at width, or nil if it has none.
+func (e *Entry) Variant(width int) *Variant {
+	for i := range e.Variants {
+		if e.Variants[i].Width == width {
+			return &e.Variants[i]
+		}
+	}
+	return nil
+}
+
+// variantFiles returns the files of the entry's variants followed by their
+// links for its aliases.
+func (e *Entry) variantFiles() []string {
+	var files []string
+	for _, v := range e.Variants {
+		files = append(files, v.Files...)
+	}
+	for _, a := range e.Aliases {
+		files = append(files, aliasVariantFiles(a, e.Variants)...)
+	}
+	return files
+}
+
+// AliasVariant returns the variant at width as named for alias a.
+func AliasVariant(a Alias, width int) Variant {
+	v := Variant{Width: width, Files: make([]string, len(a.Files))}
+	for i, f := range a.Files {
+		v.Files[i] = VariantFile(f, width)
+	}
+	return v
+}
+
+// aliasVariantFiles returns the files of every variant in variants as named
+// for alias a.
+func aliasVariantFiles(a Alias, variants []Variant) []string {
+	var files []string
+	for _, v := range variants {
+		files = append(files, AliasVariant(a, v.Width).Files...)
+	}
+	return files
+}
+
+// AddVariant records v as the variant of the entry for hash at v.Width,
+// replacing any earlier one, and links it for each of the entry's aliases.
+// The caller writes v's files first.
+func (c *Cache) AddVariant(hash string, v Variant) error {
+	e := c.Lookup(hash)
+	if e == nil {
+		return fmt.Errorf("no cache entry for %s", hash)
+	}
+	if len(v.Files) != len(e.Files()) {
+		return fmt.Errorf("variant at %dw has %d files for %d images", v.Width, len(v.Files), len(e.Files()))
+	}
+	for _, a := range e.Aliases {
+		for i, f := range AliasVariant(a, v.Width).Files {
+			if err := linkOrCopy(filepath.Join(c.dir, v.Files[i]), filepath.Join(c.dir, f)); err != nil {
+				return fmt.Errorf("failed to link %s: %w", f, err)
+			}
+		}
+	}
+
+	if old := e.Variant(v.Width); old != nil {
+		*old = v
+	} else {
+		e.Variants = append(e.Variants, v)
+		slices.SortFunc(e.Variants, func(a, b Variant) int { return a.Width - b.Width })
+	}
+	c.markDirty(hash)
+	return nil
+}
+
+// dropVariants deletes the variants of e, and their links for its aliases,
+// since they no longer match its images.
+func (c *Cache) dropVariants(e *Entry) error {
+	if len(e.Variants) == 0 {
+		return nil
+	}
+	for _, f := range e.variantFiles() {
+		if err := os.Remove(filepath.Join(c.dir, f)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	e.Variants = nil
+	c.markDirty(e.Hash)
+	return nil
+}
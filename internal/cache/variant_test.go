@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVariantFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		width int
+		want  string
+	}{
+		{"cat.webp", 640, "cat@640w.webp"},
+		{"cat-1.jpg", 320, "cat-1@320w.jpg"},
+		{"noext", 100, "noext@100w"},
+	}
+	for _, tt := range tests {
+		if got := VariantFile(tt.name, tt.width); got != tt.want {
+			t.Errorf("VariantFile(%q, %d) = %q, want %q", tt.name, tt.width, got, tt.want)
+		}
+	}
+}
+
+// withVariant records a variant of the entry for prompt at width, writing its
+// file first.
+func withVariant(t *testing.T, c *Cache, prompt string, width int, content string) Variant {
+	t.Helper()
+	e := c.Lookup(testKey(prompt).Hash())
+	v := Variant{Width: width, Files: []string{VariantFile(e.OutputFile, width)}}
+	if err := os.WriteFile(filepath.Join(c.dir, v.Files[0]), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddVariant(e.Hash, v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestAddVariant(t *testing.T) {
+	c := load(t, t.TempDir(), BackendJSON)
+	hash := withFile(t, c, "a", testKey("a").Hash()+".webp", "image").Hash
+	if err := c.AddAlias(hash, Alias{Name: "cat", Files: []string{"cat.webp"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	withVariant(t, c, "a", 640, "640 wide")
+	withVariant(t, c, "a", 320, "320 wide")
+	withVariant(t, c, "a", 640, "640 again")
+
+	e := c.Lookup(hash)
+	if len(e.Variants) != 2 || e.Variants[0].Width != 320 || e.Variants[1].Width != 640 {
+		t.Fatalf("Variants = %+v, want 320 and 640, narrowest first", e.Variants)
+	}
+	// Aliases get their own names for each variant.
+	for name, want := range map[string]string{"cat@320w.webp": "320 wide", "cat@640w.webp": "640 again"} {
+		if got := read(c, name); got != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+	}
+
+	if err := c.AddVariant(hash, Variant{Width: 100, Files: []string{"a.webp", "b.webp"}}); err == nil {
+		t.Error("AddVariant with the wrong number of files succeeded")
+	}
+	if err := c.AddVariant("0000000000000000", Variant{Width: 100, Files: []string{"a.webp"}}); err == nil {
+		t.Error("AddVariant of a missing entry succeeded")
+	}
+}
+
+func TestArchiveDropsVariants(t *testing.T) {
+	c := load(t, t.TempDir(), BackendJSON)
+	hash := withFile(t, c, "a", testKey("a").Hash()+".webp", "image").Hash
+	if err := c.AddAlias(hash, Alias{Name: "cat", Files: []string{"cat.webp"}}); err != nil {
+		t.Fatal(err)
+	}
+	v := withVariant(t, c, "a", 320, "320 wide")
+
+	if _, err := c.Archive(hash); err != nil {
+		t.Fatal(err)
+	}
+	if e := c.Lookup(hash); len(e.Variants) != 0 {
+		t.Errorf("Variants = %+v, want none once regenerated", e.Variants)
+	}
+	for _, f := range []string{v.Files[0], "cat@320w.webp"} {
+		if exists(c, f) {
+			t.Errorf("%s still exists", f)
+		}
+	}
+}
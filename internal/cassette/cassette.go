@@ -0,0 +1,267 @@
+// Package cassette records HTTP exchanges to files and replays them, so runs
+// against real APIs can be reproduced offline.
+package cassette
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// ErrNoMatch is returned when replaying a request that was never recorded.
+var ErrNoMatch = errors.New("no recorded response")
+
+// redacted replaces the values of sensitive headers in cassette files.
+const redacted = "REDACTED"
+
+// sensitiveHeaders are redacted before an interaction is written to disk.
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// Interaction is a single recorded request and its response.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request is the recorded part of an HTTP request.
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   Body        `json:"body"`
+}
+
+// Response is the recorded part of an HTTP response.
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   Body        `json:"body"`
+}
+
+// Body is stored as text when it is valid UTF-8, and as base64 otherwise.
+type Body struct {
+	Text   string `json:"text,omitempty"`
+	Base64 string `json:"base64,omitempty"`
+}
+
+func newBody(data []byte) Body {
+	if utf8.Valid(data) {
+		return Body{Text: string(data)}
+	}
+	return Body{Base64: base64.StdEncoding.EncodeToString(data)}
+}
+
+// Bytes returns the decoded body.
+func (b Body) Bytes() ([]byte, error) {
+	if b.Base64 != "" {
+		return base64.StdEncoding.DecodeString(b.Base64)
+	}
+	return []byte(b.Text), nil
+}
+
+// Recorder is an http.RoundTripper that saves every exchange to a directory,
+// one JSON file per interaction, with credentials redacted.
+type Recorder struct {
+	dir  string
+	base http.RoundTripper
+	seq  atomic.Int64
+}
+
+// NewRecorder records exchanges made through base into dir, numbering files
+// after any interactions already recorded there.
+func NewRecorder(dir string, base http.RoundTripper) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cassette directory: %w", err)
+	}
+	files, err := cassetteFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{dir: dir, base: base}
+	for _, f := range files {
+		var n int64
+		if _, err := fmt.Sscanf(filepath.Base(f), "%d-", &n); err == nil && n > r.seq.Load() {
+			r.seq.Store(n)
+		}
+	}
+	return r, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	in := Interaction{
+		Request: Request{
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Header: redact(req.Header),
+			Body:   newBody(reqBody),
+		},
+		Response: Response{
+			Status: resp.StatusCode,
+			Header: redact(resp.Header),
+			Body:   newBody(respBody),
+		},
+	}
+	data, err := json.MarshalIndent(in, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%06d-%s-%s.json", r.seq.Add(1), strings.ToLower(req.Method), req.URL.Hostname())
+	if err := os.WriteFile(filepath.Join(r.dir, name), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to record interaction: %w", err)
+	}
+	return resp, nil
+}
+
+// Replayer is an http.RoundTripper that answers requests from a recorded
+// directory without touching the network. Requests are matched by method,
+// URL and body; repeated requests (e.g. polling) get their recorded responses
+// in order, and the last one once those run out.
+type Replayer struct {
+	mu      sync.Mutex
+	pending map[string][]Interaction
+	last    map[string]Interaction
+}
+
+// NewReplayer loads every interaction recorded in dir.
+func NewReplayer(dir string) (*Replayer, error) {
+	files, err := cassetteFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recorded interactions in %s", dir)
+	}
+
+	r := &Replayer{
+		pending: make(map[string][]Interaction),
+		last:    make(map[string]Interaction),
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var in Interaction
+		if err := json.Unmarshal(data, &in); err != nil {
+			return nil, fmt.Errorf("invalid cassette %s: %w", f, err)
+		}
+		body, err := in.Request.Body.Bytes()
+		if err != nil {
+			return nil, fmt.Errorf("invalid cassette %s: %w", f, err)
+		}
+		key := matchKey(in.Request.Method, in.Request.URL, in.Request.Header.Get("Content-Type"), body)
+		r.pending[key] = append(r.pending[key], in)
+	}
+	return r, nil
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	key := matchKey(req.Method, req.URL.String(), req.Header.Get("Content-Type"), body)
+
+	r.mu.Lock()
+	in, ok := r.last[key]
+	if queue := r.pending[key]; len(queue) > 0 {
+		in, ok = queue[0], true
+		r.pending[key] = queue[1:]
+		r.last[key] = in
+	}
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w for %s %s", ErrNoMatch, req.Method, req.URL)
+	}
+
+	respBody, err := in.Response.Body.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.Response.Status, http.StatusText(in.Response.Status)),
+		StatusCode:    in.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        in.Response.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       req,
+	}, nil
+}
+
+// matchKey identifies equivalent requests. Multipart bodies are left out,
+// since their boundaries are random.
+func matchKey(method, url, contentType string, body []byte) string {
+	if strings.HasPrefix(contentType, "multipart/") {
+		body = nil
+	}
+	sum := sha256.Sum256(body)
+	return method + " " + url + " " + hex.EncodeToString(sum[:])
+}
+
+// readRequestBody reads the request body and restores it for the real transport.
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	data, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+// redact returns a copy of h with credentials replaced.
+func redact(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range sensitiveHeaders {
+		if h.Get(k) != "" {
+			h.Set(k, redacted)
+		}
+	}
+	return h
+}
+
+// cassetteFiles lists recorded interactions in recording order.
+func cassetteFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
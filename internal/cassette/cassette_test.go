@@ -0,0 +1,183 @@
+package cassette
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// binary is a response body that isn't valid UTF-8, like an image.
+var binary = []byte{0x89, 'P', 'N', 'G', 0xff, 0x00}
+
+// exchange is a request made through a cassette and the body it expects.
+type exchange struct {
+	method, path, body string
+	want               string
+}
+
+// record serves every exchange from a test server through a Recorder in dir,
+// returning the server's URL, which is closed by then. The server answers with
+// the request's method, path, body and how many times it has been called, so
+// replayed responses can be told apart.
+func record(t *testing.T, dir string, exchanges []exchange) string {
+	t.Helper()
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/image.png" {
+			_, _ = w.Write(binary)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=secret")
+		_, _ = fmt.Fprintf(w, "%s %s %s #%d", r.Method, r.URL.Path, body, calls)
+	}))
+	defer srv.Close()
+
+	rec, err := NewRecorder(dir, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rec}
+	for _, ex := range exchanges {
+		if got := roundTrip(t, client, ex, srv.URL); got != ex.want {
+			t.Fatalf("recorded %s %s = %q, want %q", ex.method, ex.path, got, ex.want)
+		}
+	}
+	return srv.URL
+}
+
+func roundTrip(t *testing.T, client *http.Client, ex exchange, base string) string {
+	t.Helper()
+	got, err := do(client, ex, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func do(client *http.Client, ex exchange, base string) (string, error) {
+	req, err := http.NewRequest(ex.method, base+ex.path, strings.NewReader(ex.body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer r8_secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := io.ReadAll(resp.Body)
+	return string(data), err
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	exchanges := []exchange{
+		{"POST", "/predictions", `{"prompt":"a cat"}`, `POST /predictions {"prompt":"a cat"} #1`},
+		{"POST", "/predictions", `{"prompt":"a dog"}`, `POST /predictions {"prompt":"a dog"} #2`},
+		{"GET", "/predictions/1", "", "GET /predictions/1  #3"},
+		{"GET", "/predictions/1", "", "GET /predictions/1  #4"},
+		{"GET", "/image.png", "", string(binary)},
+	}
+	srvURL := record(t, dir, exchanges)
+
+	files, err := cassetteFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(exchanges) {
+		t.Fatalf("recorded %d files, want %d", len(files), len(exchanges))
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "secret") {
+			t.Errorf("%s contains a credential:\n%s", filepath.Base(f), data)
+		}
+	}
+
+	rep, err := NewReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rep}
+	// Requests are matched by body rather than order, and repeats get their
+	// responses in turn.
+	for _, i := range []int{1, 0, 2, 3, 4} {
+		ex := exchanges[i]
+		if got := roundTrip(t, client, ex, srvURL); got != ex.want {
+			t.Errorf("replayed %s %s %s = %q, want %q", ex.method, ex.path, ex.body, got, ex.want)
+		}
+	}
+
+	t.Run("repeat after the last", func(t *testing.T) {
+		ex := exchanges[3]
+		if got := roundTrip(t, client, ex, srvURL); got != ex.want {
+			t.Errorf("replayed %s %s = %q, want the last response %q", ex.method, ex.path, got, ex.want)
+		}
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		for _, ex := range []exchange{
+			{method: "POST", path: "/predictions", body: `{"prompt":"a bird"}`},
+			{method: "GET", path: "/predictions/2"},
+			{method: "DELETE", path: "/predictions/1"},
+		} {
+			if _, err := do(client, ex, srvURL); !errors.Is(err, ErrNoMatch) {
+				t.Errorf("%s %s %s = %v, want ErrNoMatch", ex.method, ex.path, ex.body, err)
+			}
+		}
+	})
+}
+
+func TestRecorderAppends(t *testing.T) {
+	dir := t.TempDir()
+	ex := exchange{"GET", "/predictions/1", "", "GET /predictions/1  #1"}
+	record(t, dir, []exchange{ex})
+	record(t, dir, []exchange{ex})
+
+	files, err := cassetteFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || !strings.HasPrefix(filepath.Base(files[1]), "000002-") {
+		t.Errorf("files = %v, want the second recording numbered after the first", files)
+	}
+}
+
+func TestNewReplayerEmpty(t *testing.T) {
+	if _, err := NewReplayer(t.TempDir()); err == nil {
+		t.Error("NewReplayer of an empty directory succeeded")
+	}
+}
+
+func TestMatchKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		a, b        string
+		same        bool
+	}{
+		{"same body", "application/json", `{"a":1}`, `{"a":1}`, true},
+		{"different body", "application/json", `{"a":1}`, `{"a":2}`, false},
+		{"multipart", "multipart/form-data; boundary=x", "--x\r\n1", "--y\r\n2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := matchKey("POST", "http://api/files", tt.contentType, []byte(tt.a))
+			b := matchKey("POST", "http://api/files", tt.contentType, []byte(tt.b))
+			if (a == b) != tt.same {
+				t.Errorf("keys alike = %v, want %v", a == b, tt.same)
+			}
+		})
+	}
+}
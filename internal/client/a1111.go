@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/models"
+	"github.com/kevinmichaelchen/replicate-images/internal/retry"
+)
+
+const defaultA1111URL = "http://127.0.0.1:7860"
+
+// A1111 generates images with a self-hosted AUTOMATIC1111 Stable Diffusion
+// web UI (started with --api).
+type A1111 struct {
+	baseURL string
+	http    *http.Client
+	retry   retry.Policy
+}
+
+var _ Generator = (*A1111)(nil)
+
+// NewA1111 creates an A1111 generator. cfg.BaseURL defaults to a local server.
+func NewA1111(cfg Config) *A1111 {
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = defaultA1111URL
+	}
+	return &A1111{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    &http.Client{Transport: cfg.transport()},
+		retry:   cfg.Retry,
+	}
+}
+
+// GenerateImages runs txt2img, or img2img when the request has a reference
+// image (inpainting when it also has a mask). Params are sent as-is (e.g.
+// width, height, steps, cfg_scale, seed, denoising_strength); num_outputs maps
+// to batch_size and a non-empty model selects the checkpoint. Canceling ctx
+// interrupts the server's current generation.
+func (a *A1111) GenerateImages(ctx context.Context, req Request) (Result, error) {
+	payload := models.Inputs(req.Model, req.Params)
+	payload["prompt"] = req.Prompt
+	if n, ok := payload["num_outputs"]; ok {
+		delete(payload, "num_outputs")
+		payload["batch_size"] = n
+	}
+	if _, ok := payload["override_settings"]; !ok && req.Model != "" {
+		payload["override_settings"] = map[string]any{"sd_model_checkpoint": req.Model}
+	}
+
+	result := Result{Attempts: 1}
+	endpoint := "txt2img"
+	if req.Image != "" {
+		image, retries, err := inlineImage(ctx, a.http, a.retry, req.Image)
+		result.Attempts += retries
+		if err != nil {
+			return result, err
+		}
+		endpoint = "img2img"
+		payload["init_images"] = []string{image}
+	}
+	if req.Mask != "" {
+		if req.Image == "" {
+			return result, fmt.Errorf("a mask needs a reference image")
+		}
+		mask, retries, err := inlineImage(ctx, a.http, a.retry, req.Mask)
+		result.Attempts += retries
+		if err != nil {
+			return result, err
+		}
+		payload[maskParam] = mask
+	}
+
+	var resp struct {
+		Images []string `json:"images"`
+	}
+	retries, err := do(ctx, a.retry, func(ctx context.Context) error {
+		return postJSON(ctx, a.http, a.baseURL+"/sdapi/v1/"+endpoint, nil, payload, &resp)
+	})
+	result.Attempts += retries
+	if err != nil {
+		if ctx.Err() != nil {
+			a.interrupt(ctx)
+		}
+		return result, fmt.Errorf("%s failed: %w", endpoint, err)
+	}
+	if len(resp.Images) == 0 {
+		return result, fmt.Errorf("no images in %s response", endpoint)
+	}
+
+	result.Images, err = decodeBase64Images(resp.Images)
+	return result, err
+}
+
+// interrupt stops the generation the server is running, after the caller has
+// given up on it. It's best effort: the caller is already failing.
+func (a *A1111) interrupt(ctx context.Context) {
+	ctx, stop := context.WithTimeout(context.WithoutCancel(ctx), cancelTimeout)
+	defer stop()
+	var resp any
+	_ = postJSON(ctx, a.http, a.baseURL+"/sdapi/v1/interrupt", nil, struct{}{}, &resp)
+}
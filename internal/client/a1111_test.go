@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// apiCall is a request received by an apiServer.
+type apiCall struct {
+	Path    string
+	Header  http.Header
+	Payload map[string]any
+}
+
+// apiServer answers every request with status and body, recording the last
+// one in call.
+func apiServer(t *testing.T, status int, body string, call *apiCall) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*call = apiCall{Path: r.URL.Path, Header: r.Header}
+		_ = json.NewDecoder(r.Body).Decode(&call.Payload)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// b64 encodes s as a provider returns inline images.
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestA1111(t *testing.T) {
+	images := `{"images": ["` + b64("one") + `", "` + b64("two") + `"]}`
+	tests := []struct {
+		name        string
+		req         Request
+		status      int
+		body        string
+		wantPath    string
+		wantPayload map[string]any // Checked keys only
+		wantImages  []string
+		wantErr     string
+	}{
+		{
+			name:     "txt2img",
+			req:      Request{Model: "sd_xl_base_1.0", Prompt: "a cat", Params: map[string]any{"num_outputs": 2, "steps": 20}},
+			status:   http.StatusOK,
+			body:     images,
+			wantPath: "/sdapi/v1/txt2img",
+			wantPayload: map[string]any{
+				"prompt":            "a cat",
+				"batch_size":        2.0,
+				"num_outputs":       nil,
+				"steps":             20.0,
+				"override_settings": map[string]any{"sd_model_checkpoint": "sd_xl_base_1.0"},
+			},
+			wantImages: []string{"one", "two"},
+		},
+		{
+			name:     "inpainting",
+			req:      Request{Prompt: "a cat", Image: "data:image/png;base64,aW1n", Mask: "data:image/png;base64,bWFzaw=="},
+			status:   http.StatusOK,
+			body:     images,
+			wantPath: "/sdapi/v1/img2img",
+			wantPayload: map[string]any{
+				"init_images":       []any{"data:image/png;base64,aW1n"},
+				"mask":              "data:image/png;base64,bWFzaw==",
+				"override_settings": nil,
+			},
+			wantImages: []string{"one", "two"},
+		},
+		{
+			name:    "api error",
+			req:     Request{Prompt: "a cat"},
+			status:  http.StatusUnprocessableEntity,
+			body:    `{"detail": "Invalid sampler"}`,
+			wantErr: "422: {\"detail\": \"Invalid sampler\"}",
+		},
+		{
+			name:    "no images",
+			req:     Request{Prompt: "a cat"},
+			status:  http.StatusOK,
+			body:    `{"images": []}`,
+			wantErr: "no images in txt2img response",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var call apiCall
+			srv := apiServer(t, tt.status, tt.body, &call)
+			got, err := NewA1111(Config{BaseURL: srv.URL + "/"}).GenerateImages(context.Background(), tt.req)
+			checkResult(t, got, err, tt.wantImages, tt.wantErr)
+			if tt.wantPath != "" && call.Path != tt.wantPath {
+				t.Errorf("called %s, want %s", call.Path, tt.wantPath)
+			}
+			checkPayload(t, call.Payload, tt.wantPayload)
+		})
+	}
+}
+
+// checkResult compares a generation's images, or its error, with the wanted
+// ones.
+func checkResult(t *testing.T, got Result, err error, wantImages []string, wantErr string) {
+	t.Helper()
+	if wantErr != "" {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("error = %v, want one containing %q", err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images []string
+	for _, img := range got.Images {
+		images = append(images, string(img.Data))
+	}
+	if !reflect.DeepEqual(images, wantImages) {
+		t.Errorf("images = %q, want %q", images, wantImages)
+	}
+}
+
+// checkPayload checks the keys of want in a request payload; a nil value
+// means the key must be absent.
+func checkPayload(t *testing.T, payload, want map[string]any) {
+	t.Helper()
+	for k, v := range want {
+		got, ok := payload[k]
+		if v == nil && ok {
+			t.Errorf("payload has %s = %v, want none", k, got)
+		}
+		if v != nil && !reflect.DeepEqual(got, v) {
+			t.Errorf("payload %s = %#v, want %#v", k, got, v)
+		}
+	}
+}
@@ -3,57 +3,251 @@ package client
 import (
 	"context"
 	"fmt"
-	"io"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/kevinmichaelchen/replicate-images/internal/models"
+	"github.com/kevinmichaelchen/replicate-images/internal/retry"
 	"github.com/replicate/replicate-go"
 )
 
+// Client generates images with Replicate. It is the default Generator.
 type Client struct {
-	r *replicate.Client
+	r     *replicate.Client
+	http  *http.Client
+	retry retry.Policy
 }
 
 // New creates a new Replicate client using REPLICATE_API_TOKEN from environment.
-func New() (*Client, error) {
-	r, err := replicate.NewClient(replicate.WithTokenFromEnv())
+// The API base URL is cfg.BaseURL, then REPLICATE_BASE_URL, then api.replicate.com.
+func New(cfg Config) (*Client, error) {
+	httpClient := &http.Client{Transport: &hintTransport{base: cfg.transport()}}
+	token := replicate.WithTokenFromEnv()
+	if cfg.Token != "" {
+		token = replicate.WithToken(cfg.Token)
+	}
+	// internal/retry is the only retry layer, so that --retries is exact and
+	// Attempts counts every request.
+	opts := []replicate.ClientOption{token, replicate.WithHTTPClient(httpClient), replicate.WithRetryPolicy(0, &replicate.ConstantBackoff{})}
+
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = os.Getenv("REPLICATE_BASE_URL")
+	}
+	if baseURL != "" {
+		opts = append(opts, replicate.WithBaseURL(baseURL))
+	}
+
+	r, err := replicate.NewClient(opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create replicate client: %w", err)
 	}
-	return &Client{r: r}, nil
+	return &Client{r: r, http: httpClient, retry: cfg.Retry}, nil
+}
+
+var _ AsyncGenerator = (*Client)(nil)
+
+// Done reports whether the prediction has reached a terminal state.
+func (p *Prediction) Done() bool {
+	return replicate.Status(p.Status).Terminated()
+}
+
+// Succeeded reports whether the prediction finished successfully.
+func (p *Prediction) Succeeded() bool {
+	return p.Status == string(replicate.Succeeded)
 }
 
-// GenerateImage runs a text-to-image model and returns the image data.
-func (c *Client) GenerateImage(ctx context.Context, modelID, prompt string) ([]byte, string, error) {
-	input := replicate.PredictionInput{
-		"prompt": prompt,
+// pollInterval is how often a running prediction is checked for completion.
+const pollInterval = time.Second
+
+// maxDataURLSize is the largest local reference image sent inline as a data
+// URL. Larger files are uploaded with the files API.
+const maxDataURLSize = 256 << 10
+
+// GenerateImages runs a text-to-image model and returns every image it produced.
+// Rate limits and transient failures are retried according to the client's policy.
+// Canceling ctx cancels the prediction, unless it has already succeeded: its
+// images are paid for, so they're downloaded regardless.
+func (c *Client) GenerateImages(ctx context.Context, req Request) (Result, error) {
+	result := Result{Attempts: 1}
+
+	p, retries, err := c.createPrediction(ctx, req)
+	result.Attempts += retries
+	if err != nil {
+		return result, err
 	}
 
-	// Apply model-specific defaults
-	if model, ok := models.Get(modelID); ok {
-		for k, v := range model.Defaults {
-			input[k] = v
+	for !p.Done() {
+		select {
+		case <-ctx.Done():
+			c.cancel(ctx, p.ID)
+			return result, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+		id := p.ID
+		p, retries, err = c.getPrediction(ctx, id)
+		result.Attempts += retries
+		if err != nil {
+			if ctx.Err() != nil {
+				c.cancel(ctx, id)
+			}
+			return result, err
 		}
 	}
 
-	output, err := c.r.Run(ctx, modelID, input, nil)
+	if !p.Succeeded() {
+		return result, fmt.Errorf("prediction %s %s: %s", p.ID, p.Status, p.Error)
+	}
+
+	images, retries, err := c.download(context.WithoutCancel(ctx), p.URLs)
+	result.Attempts += retries
+	result.Images = images
+	return result, err
+}
+
+// cancel stops a prediction the caller has given up on, so it doesn't keep
+// running and billing. It's best effort: the caller is already failing.
+func (c *Client) cancel(ctx context.Context, id string) {
+	ctx, stop := context.WithTimeout(context.WithoutCancel(ctx), cancelTimeout)
+	defer stop()
+	_, _ = c.r.CancelPrediction(ctx, id)
+}
+
+// CreatePrediction starts a prediction without waiting for it to finish.
+func (c *Client) CreatePrediction(ctx context.Context, req Request) (*Prediction, error) {
+	p, retries, err := c.createPrediction(ctx, req)
 	if err != nil {
-		return nil, "", fmt.Errorf("prediction failed: %w", err)
+		return nil, err
 	}
+	p.Attempts = retries + 1
+	return p, nil
+}
 
-	// Extract image URL from output - format varies by model
-	imageURL, err := extractImageURL(output)
+// GetPrediction fetches the current state of a prediction.
+func (c *Client) GetPrediction(ctx context.Context, id string) (*Prediction, error) {
+	p, retries, err := c.getPrediction(ctx, id)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
+	p.Attempts = retries + 1
+	return p, nil
+}
+
+// Download fetches every image URL.
+func (c *Client) Download(ctx context.Context, urls []string) (Result, error) {
+	images, retries, err := c.download(ctx, urls)
+	return Result{Images: images, Attempts: retries + 1}, err
+}
 
-	// Download the image
-	data, err := downloadImage(ctx, imageURL)
+func (c *Client) createPrediction(ctx context.Context, req Request) (*Prediction, int, error) {
+	input := replicate.PredictionInput(models.Inputs(req.Model, req.Params))
+	input["prompt"] = req.Prompt
+
+	id, err := replicate.ParseIdentifier(req.Model)
 	if err != nil {
-		return nil, "", err
+		return nil, 0, fmt.Errorf("invalid model %q: %w", req.Model, err)
 	}
 
-	return data, imageURL, nil
+	var uploads int
+	if req.Image != "" {
+		uri, retries, err := c.imageURI(ctx, req.Image)
+		if err != nil {
+			return nil, retries, err
+		}
+		uploads = retries
+		setImageInput(input, req, uri)
+	}
+	if req.Mask != "" {
+		uri, retries, err := c.imageURI(ctx, req.Mask)
+		uploads += retries
+		if err != nil {
+			return nil, uploads, err
+		}
+		input[maskParam] = uri
+	}
+
+	var p *replicate.Prediction
+	retries, err := doCreate(ctx, c.retry, func(ctx context.Context) (err error) {
+		if id.Version != nil {
+			p, err = c.r.CreatePrediction(ctx, *id.Version, input, nil, false)
+		} else {
+			p, err = c.r.CreatePredictionWithModel(ctx, id.Owner, id.Name, input, nil, false)
+		}
+		return err
+	})
+	retries += uploads
+	if err != nil {
+		return nil, retries, fmt.Errorf("prediction failed: %w", err)
+	}
+	pred, err := toPrediction(p)
+	return pred, retries, err
+}
+
+// imageURI returns a URI Replicate can fetch a reference image from. URLs are
+// passed through, small local files are sent inline as data URLs and larger
+// ones are uploaded with the files API.
+func (c *Client) imageURI(ctx context.Context, ref string) (string, int, error) {
+	if IsURL(ref) {
+		return ref, 0, nil
+	}
+	info, err := os.Stat(ref)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read image: %w", err)
+	}
+	if info.Size() <= maxDataURLSize {
+		uri, err := dataURL(ref)
+		return uri, 0, err
+	}
+
+	var f *replicate.File
+	retries, err := do(ctx, c.retry, func(ctx context.Context) (err error) {
+		f, err = c.r.CreateFileFromPath(ctx, ref, nil)
+		return err
+	})
+	if err != nil {
+		return "", retries, fmt.Errorf("failed to upload %s: %w", ref, err)
+	}
+	uri, ok := f.URLs["get"]
+	if !ok {
+		return "", retries, fmt.Errorf("no URL for uploaded file %s", f.ID)
+	}
+	return uri, retries, nil
+}
+
+func (c *Client) getPrediction(ctx context.Context, id string) (*Prediction, int, error) {
+	var p *replicate.Prediction
+	retries, err := do(ctx, c.retry, func(ctx context.Context) (err error) {
+		p, err = c.r.GetPrediction(ctx, id)
+		return err
+	})
+	if err != nil {
+		return nil, retries, fmt.Errorf("failed to get prediction %s: %w", id, err)
+	}
+	pred, err := toPrediction(p)
+	return pred, retries, err
+}
+
+func (c *Client) download(ctx context.Context, urls []string) ([]Image, int, error) {
+	return downloadImages(ctx, c.http, c.retry, urls)
+}
+
+// toPrediction converts a Replicate prediction, extracting image URLs once
+// it has succeeded.
+func toPrediction(p *replicate.Prediction) (*Prediction, error) {
+	pred := &Prediction{ID: p.ID, Status: string(p.Status)}
+	if p.Error != nil {
+		pred.Error = fmt.Sprint(p.Error)
+	}
+	if p.Status == replicate.Succeeded {
+		// Extract image URLs from output - format varies by model
+		urls, err := extractImageURLs(p.Output)
+		if err != nil {
+			return nil, err
+		}
+		pred.URLs = urls
+	}
+	return pred, nil
 }
 
 // SearchModels searches for models by query and returns them sorted by popularity.
@@ -86,21 +280,40 @@ func (m ModelInfo) FullName() string {
 	return fmt.Sprintf("%s/%s", m.Owner, m.Name)
 }
 
-// extractImageURL handles various output formats from different Replicate models.
+// extractImageURLs returns every image URL in a model's output.
 // Known formats:
 //   - string: direct URL (e.g., "https://...")
-//   - []any: array of URLs, take first (e.g., ["https://..."])
+//   - []any: array of URLs or objects (e.g., ["https://...", "https://..."])
 //   - map[string]any: object with URL field (e.g., {"url": "https://..."})
+func extractImageURLs(output any) ([]string, error) {
+	arr, ok := output.([]any)
+	if !ok {
+		u, err := extractImageURL(output)
+		if err != nil {
+			return nil, err
+		}
+		return []string{u}, nil
+	}
+	if len(arr) == 0 {
+		return nil, fmt.Errorf("empty output array from model")
+	}
+	urls := make([]string, 0, len(arr))
+	for _, item := range arr {
+		// Each element could be string or map
+		u, err := extractImageURL(item)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// extractImageURL extracts a single URL from a string or object output.
 func extractImageURL(output any) (string, error) {
 	switch v := output.(type) {
 	case string:
 		return v, nil
-	case []any:
-		if len(v) == 0 {
-			return "", fmt.Errorf("empty output array from model")
-		}
-		// First element could be string or map
-		return extractImageURL(v[0])
 	case map[string]any:
 		// Try common field names
 		for _, key := range []string{"url", "image", "output", "uri"} {
@@ -115,22 +328,3 @@ func extractImageURL(output any) (string, error) {
 		return "", fmt.Errorf("unexpected output format %T: %v", output, output)
 	}
 }
-
-func downloadImage(ctx context.Context, url string) ([]byte, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to download image: %w", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("download failed with status: %d", resp.StatusCode)
-	}
-
-	return io.ReadAll(resp.Body)
-}
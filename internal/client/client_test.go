@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestImageURI(t *testing.T) {
+	var uploads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/files" {
+			http.NotFound(w, r)
+			return
+		}
+		uploads.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprint(w, `{"id": "f1", "urls": {"get": "https://api.replicate.com/v1/files/f1"}}`)
+	}))
+	defer srv.Close()
+	c, err := New(Config{Token: "test", BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	small, large := filepath.Join(dir, "small.png"), filepath.Join(dir, "large.png")
+	if err := os.WriteFile(small, []byte("\x89PNG\r\n\x1a\nsmall"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(large, bytes.Repeat([]byte{0}, maxDataURLSize+1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		ref         string
+		wantPrefix  string
+		wantUploads int32
+		wantErr     bool
+	}{
+		{"url", "https://example.com/cat.png", "https://example.com/cat.png", 0, false},
+		{"data url", "data:image/png;base64,aW1n", "data:image/png;base64,aW1n", 0, false},
+		{"small file", small, "data:image/png;base64,", 0, false},
+		{"large file", large, "https://api.replicate.com/v1/files/f1", 1, false},
+		{"missing file", filepath.Join(dir, "missing.png"), "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploads.Store(0)
+			got, _, err := c.imageURI(context.Background(), tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("imageURI = %q, %v; want error %v", got, err, tt.wantErr)
+			}
+			if !strings.HasPrefix(got, tt.wantPrefix) {
+				t.Errorf("imageURI = %q, want %q...", got, tt.wantPrefix)
+			}
+			if n := uploads.Load(); n != tt.wantUploads {
+				t.Errorf("uploaded %d files, want %d", n, tt.wantUploads)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/models"
+)
+
+const (
+	fakeDefaultSize = 256
+	fakeMaxSize     = 2048
+	fakeGrid        = 8
+	fakeURLScheme   = "fake://"
+)
+
+// Fake generates deterministic placeholder images without any network access.
+// The same request always yields the same images, so caching, batching and
+// conversion can be exercised offline. Predictions complete immediately.
+type Fake struct{}
+
+var _ AsyncGenerator = Fake{}
+
+// GenerateImages returns placeholder images derived from a hash of the request.
+func (f Fake) GenerateImages(ctx context.Context, req Request) (Result, error) {
+	p, err := f.CreatePrediction(ctx, req)
+	if err != nil {
+		return Result{Attempts: 1}, err
+	}
+	return f.Download(ctx, p.URLs)
+}
+
+// CreatePrediction returns an already succeeded prediction. Its ID and image
+// URLs encode everything needed to render the images again.
+func (f Fake) CreatePrediction(ctx context.Context, req Request) (*Prediction, error) {
+	inputs := models.Inputs(req.Model, req.Params)
+	inputs["prompt"] = req.Prompt
+	inputs["model"] = req.Model
+	if req.Image != "" {
+		setImageInput(inputs, req, req.Image)
+	}
+	if req.Mask != "" {
+		inputs[maskParam] = req.Mask
+	}
+	data, err := json.Marshal(inputs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid input: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	seed := hex.EncodeToString(sum[:16])
+
+	id := fmt.Sprintf("fake-%s-%d-%d-%d", seed, intParam(inputs, "num_outputs", 1),
+		intParam(inputs, "width", fakeDefaultSize), intParam(inputs, "height", fakeDefaultSize))
+	return f.GetPrediction(ctx, id)
+}
+
+// GetPrediction decodes a fake prediction ID.
+func (Fake) GetPrediction(_ context.Context, id string) (*Prediction, error) {
+	var seed string
+	var n, w, h int
+	parts := strings.Split(id, "-")
+	if len(parts) == 5 && parts[0] == "fake" {
+		seed = parts[1]
+		n, _ = strconv.Atoi(parts[2])
+		w, _ = strconv.Atoi(parts[3])
+		h, _ = strconv.Atoi(parts[4])
+	}
+	if seed == "" || n < 1 || w < 1 || h < 1 {
+		return nil, fmt.Errorf("not a fake prediction: %q", id)
+	}
+
+	p := &Prediction{ID: id, Status: "succeeded", Attempts: 1}
+	for i := range n {
+		p.URLs = append(p.URLs, fmt.Sprintf("%s%s/%d/%dx%d", fakeURLScheme, seed, i, w, h))
+	}
+	return p, nil
+}
+
+// Download renders the images for fake:// URLs.
+func (Fake) Download(_ context.Context, urls []string) (Result, error) {
+	result := Result{Attempts: 1}
+	for _, u := range urls {
+		var seed string
+		var i, w, h int
+		path := strings.TrimPrefix(u, fakeURLScheme)
+		if s, rest, ok := strings.Cut(path, "/"); ok && path != u {
+			seed = s
+			_, _ = fmt.Sscanf(rest, "%d/%dx%d", &i, &w, &h)
+		}
+		if seed == "" || w < 1 || h < 1 {
+			return result, fmt.Errorf("not a fake image URL: %q", u)
+		}
+
+		data, err := placeholder(seed, i, min(w, fakeMaxSize), min(h, fakeMaxSize))
+		if err != nil {
+			return result, err
+		}
+		result.Images = append(result.Images, Image{Data: data, URL: u})
+	}
+	return result, nil
+}
+
+// placeholder renders a PNG grid of colored blocks derived from seed and the
+// image index.
+func placeholder(seed string, index, w, h int) ([]byte, error) {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", seed, index)))
+
+	// Expand the hash into one color per grid cell.
+	colors := make([]color.RGBA, fakeGrid*fakeGrid)
+	for i := range colors {
+		b := sha256.Sum256(append(sum[:], byte(i)))
+		colors[i] = color.RGBA{R: b[0], G: b[1], B: b[2], A: 255}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.SetRGBA(x, y, colors[(y*fakeGrid/h)*fakeGrid+x*fakeGrid/w])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// intParam returns an integer input, or def if it's missing or not a number.
+func intParam(inputs map[string]any, key string, def int) int {
+	switch v := inputs[key].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return def
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFake(t *testing.T) {
+	ctx := context.Background()
+	base := Request{Prompt: "a cat", Model: "black-forest-labs/flux-schnell"}
+	want, err := Fake{}.GenerateImages(ctx, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		req    Request
+		n      int
+		w, h   int
+		sameAs bool // Whether the first image matches base's
+	}{
+		{"same request", base, 1, 256, 256, true},
+		{"other prompt", Request{Prompt: "a dog", Model: base.Model}, 1, 256, 256, false},
+		{"other model", Request{Prompt: "a cat", Model: "stability-ai/sdxl"}, 1, 256, 256, false},
+		{"num_outputs", Request{Prompt: "a cat", Model: base.Model, Params: map[string]any{"num_outputs": 3}}, 3, 256, 256, false},
+		{"size", Request{Prompt: "a cat", Model: base.Model, Params: map[string]any{"width": 64, "height": 32.0}}, 1, 64, 32, false},
+		{"size capped", Request{Prompt: "a cat", Model: base.Model, Params: map[string]any{"width": 5000}}, 1, fakeMaxSize, 256, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Fake{}.GenerateImages(ctx, tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Images) != tt.n {
+				t.Fatalf("got %d images, want %d", len(got.Images), tt.n)
+			}
+			for i, img := range got.Images {
+				cfg, err := png.DecodeConfig(bytes.NewReader(img.Data))
+				if err != nil {
+					t.Fatalf("image %d: %v", i, err)
+				}
+				if cfg.Width != tt.w || cfg.Height != tt.h {
+					t.Errorf("image %d is %dx%d, want %dx%d", i, cfg.Width, cfg.Height, tt.w, tt.h)
+				}
+			}
+			if same := bytes.Equal(got.Images[0].Data, want.Images[0].Data); same != tt.sameAs {
+				t.Errorf("first image matches base = %v, want %v", same, tt.sameAs)
+			}
+		})
+	}
+}
+
+func TestFakePrediction(t *testing.T) {
+	ctx := context.Background()
+	p, err := Fake{}.CreatePrediction(ctx, Request{Prompt: "a cat", Params: map[string]any{"num_outputs": 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Succeeded() || len(p.URLs) != 2 {
+		t.Fatalf("CreatePrediction = %+v, want a succeeded prediction with 2 images", p)
+	}
+
+	got, err := Fake{}.GetPrediction(ctx, p.ID)
+	if err != nil || got.ID != p.ID || len(got.URLs) != 2 {
+		t.Errorf("GetPrediction(%s) = %+v, %v; want the same prediction", p.ID, got, err)
+	}
+	for _, id := range []string{"", "abc123", "fake-x-0-1-1", "fake-x-1-1"} {
+		if _, err := (Fake{}).GetPrediction(ctx, id); err == nil {
+			t.Errorf("GetPrediction(%q) succeeded", id)
+		}
+	}
+	for _, u := range []string{"https://example.com/a.png", "fake://seed/0/0x0"} {
+		if _, err := (Fake{}).Download(ctx, []string{u}); err == nil {
+			t.Errorf("Download(%q) succeeded", u)
+		}
+	}
+}
+
+func TestBaseURLFromEnv(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"id": "abc", "status": "starting"}`)
+	}))
+	defer srv.Close()
+	t.Setenv("REPLICATE_BASE_URL", srv.URL)
+
+	c, err := New(Config{Token: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetPrediction(context.Background(), "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("the server at REPLICATE_BASE_URL got %d requests, want 1", requests.Load())
+	}
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/models"
+	"github.com/kevinmichaelchen/replicate-images/internal/retry"
+)
+
+// Provider names accepted by NewGenerator.
+const (
+	ProviderReplicate = "replicate"
+	ProviderA1111     = "a1111"
+	ProviderOpenAI    = "openai"
+	ProviderFake      = "fake"
+)
+
+// cancelTimeout bounds the request that stops remote work after the caller's
+// context is done.
+const cancelTimeout = 10 * time.Second
+
+// Providers lists every supported provider; the first is the default.
+var Providers = []string{ProviderReplicate, ProviderA1111, ProviderOpenAI, ProviderFake}
+
+// Generator produces images from a prompt.
+type Generator interface {
+	// GenerateImages runs a generation to completion and returns every image.
+	// Result.Attempts is set even when an error is returned. If ctx is
+	// canceled, remote work is stopped where the provider allows it.
+	GenerateImages(ctx context.Context, req Request) (Result, error)
+}
+
+// AsyncGenerator is a Generator whose predictions can be created, polled and
+// downloaded as separate steps.
+type AsyncGenerator interface {
+	Generator
+	CreatePrediction(ctx context.Context, req Request) (*Prediction, error)
+	GetPrediction(ctx context.Context, id string) (*Prediction, error)
+	Download(ctx context.Context, urls []string) (Result, error)
+}
+
+// Config configures a Generator.
+type Config struct {
+	Provider  string            // One of Providers; empty means Replicate
+	BaseURL   string            // API endpoint; empty uses the provider's default (or REPLICATE_BASE_URL)
+	Token     string            // Replicate API token; empty reads REPLICATE_API_TOKEN
+	Retry     retry.Policy      // How rate limits and transient failures are retried
+	Transport http.RoundTripper // For every API call and download; nil uses http.DefaultTransport
+}
+
+// transport returns the configured transport, or the default one.
+func (cfg Config) transport() http.RoundTripper {
+	if cfg.Transport != nil {
+		return cfg.Transport
+	}
+	return http.DefaultTransport
+}
+
+// NewGenerator creates the Generator for cfg.Provider.
+func NewGenerator(cfg Config) (Generator, error) {
+	switch cfg.Provider {
+	case "", ProviderReplicate:
+		return New(cfg)
+	case ProviderA1111:
+		return NewA1111(cfg), nil
+	case ProviderOpenAI:
+		return NewOpenAI(cfg), nil
+	case ProviderFake:
+		return Fake{}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q (supported: %v)", cfg.Provider, Providers)
+	}
+}
+
+// DefaultModel returns the model used by a provider when none is specified.
+func DefaultModel(provider string) string {
+	switch provider {
+	case ProviderA1111:
+		return "" // Whatever checkpoint the server has loaded
+	case ProviderOpenAI:
+		return defaultOpenAIModel
+	default:
+		return models.Default
+	}
+}
+
+// Request describes a single image generation.
+type Request struct {
+	Model  string         // Model identifier, as understood by the provider
+	Prompt string         // Text prompt
+	Params map[string]any // Extra model inputs, merged over the registry defaults
+
+	Image      string // Reference image for image-to-image: a local path or URL
+	ImageParam string // Input that receives Image; empty uses the model's registry value
+	Mask       string // Inpainting mask for Image: a local path or URL
+}
+
+// maskParam is the input that takes an inpainting mask.
+const maskParam = "mask"
+
+// IsURL reports whether an image reference is a URL (including a data URL)
+// rather than a local path.
+func IsURL(ref string) bool {
+	return strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") || strings.HasPrefix(ref, "data:")
+}
+
+// setImageInput sets the model input that takes req's reference image to uri.
+func setImageInput(input map[string]any, req Request, uri string) {
+	param, list := models.ImageParam(req.Model)
+	if req.ImageParam != "" {
+		param, list = req.ImageParam, false
+	}
+	if list {
+		input[param] = []string{uri}
+	} else {
+		input[param] = uri
+	}
+}
+
+// Image is a single generated image.
+type Image struct {
+	Data []byte
+	URL  string // Where the image was downloaded from, if it was
+}
+
+// Result is the outcome of a generation or download.
+type Result struct {
+	Images   []Image
+	Attempts int // Requests made, counting retries; set even when an error is returned
+}
+
+// Prediction is the state of a remote prediction.
+type Prediction struct {
+	ID       string
+	Status   string   // starting, processing, succeeded, failed or canceled
+	URLs     []string // Image URLs, once succeeded
+	Error    string   // Failure reason, if any
+	Attempts int      // Requests made to fetch this state, counting retries
+}
+
+// downloadImages fetches every URL, retrying each according to policy.
+// It returns the total number of retries made.
+func downloadImages(ctx context.Context, httpClient *http.Client, policy retry.Policy, urls []string) ([]Image, int, error) {
+	var total int
+	images := make([]Image, 0, len(urls))
+	for _, imageURL := range urls {
+		var data []byte
+		retries, err := do(ctx, policy, func(ctx context.Context) (err error) {
+			data, err = downloadImage(ctx, httpClient, imageURL)
+			return err
+		})
+		total += retries
+		if err != nil {
+			return nil, total, err
+		}
+		images = append(images, Image{Data: data, URL: imageURL})
+	}
+	return images, total, nil
+}
+
+func downloadImage(ctx context.Context, httpClient *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError("download", resp)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// dataURL reads a local image into a base64 data URL.
+func dataURL(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+	return encodeDataURL(data), nil
+}
+
+// encodeDataURL encodes image data as a base64 data URL.
+func encodeDataURL(data []byte) string {
+	return "data:" + http.DetectContentType(data) + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// inlineImage returns an image reference as a data URL, downloading it first
+// if it's remote. It returns the number of download retries made.
+func inlineImage(ctx context.Context, httpClient *http.Client, policy retry.Policy, ref string) (string, int, error) {
+	switch {
+	case strings.HasPrefix(ref, "data:"):
+		return ref, 0, nil
+	case IsURL(ref):
+		images, retries, err := downloadImages(ctx, httpClient, policy, []string{ref})
+		if err != nil {
+			return "", retries, err
+		}
+		return encodeDataURL(images[0].Data), retries, nil
+	default:
+		uri, err := dataURL(ref)
+		return uri, 0, err
+	}
+}
+
+// postJSON sends body as JSON to url and decodes the JSON response into out.
+func postJSON(ctx context.Context, httpClient *http.Client, url string, header http.Header, body, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError("request", resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// decodeBase64Images decodes base64-encoded image data, as returned inline by
+// the a1111 and openai APIs.
+func decodeBase64Images(encoded []string) ([]Image, error) {
+	images := make([]Image, 0, len(encoded))
+	for i, e := range encoded {
+		data, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image %d: %w", i, err)
+		}
+		images = append(images, Image{Data: data})
+	}
+	return images, nil
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetImageInput(t *testing.T) {
+	const uri = "https://example.com/cat.png"
+	tests := []struct {
+		name string
+		req  Request
+		want map[string]any
+	}{
+		{"default", Request{Model: "stability-ai/sdxl"}, map[string]any{"image": uri}},
+		{"unknown model", Request{Model: "acme/model"}, map[string]any{"image": uri}},
+		{"registry param", Request{Model: "black-forest-labs/flux-1.1-pro"}, map[string]any{"image_prompt": uri}},
+		{"registry list", Request{Model: "google/nano-banana-pro"}, map[string]any{"image_input": []string{uri}}},
+		{"override", Request{Model: "google/nano-banana-pro", ImageParam: "init_image"}, map[string]any{"init_image": uri}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := map[string]any{}
+			setImageInput(input, tt.req, uri)
+			if !reflect.DeepEqual(input, tt.want) {
+				t.Errorf("input = %v, want %v", input, tt.want)
+			}
+		})
+	}
+}
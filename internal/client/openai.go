@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/models"
+	"github.com/kevinmichaelchen/replicate-images/internal/retry"
+)
+
+const (
+	defaultOpenAIURL   = "https://api.openai.com/v1"
+	defaultOpenAIModel = "gpt-image-1"
+)
+
+// OpenAI generates images with an OpenAI-compatible images API, authenticated
+// with OPENAI_API_KEY when set.
+type OpenAI struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+	retry   retry.Policy
+}
+
+var _ Generator = (*OpenAI)(nil)
+
+// NewOpenAI creates an OpenAI generator. cfg.BaseURL defaults to api.openai.com.
+func NewOpenAI(cfg Config) *OpenAI {
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = defaultOpenAIURL
+	}
+	return &OpenAI{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  os.Getenv("OPENAI_API_KEY"),
+		http:    &http.Client{Transport: cfg.transport()},
+		retry:   cfg.Retry,
+	}
+}
+
+// GenerateImages calls the images/generations endpoint. Params are sent as-is
+// (e.g. size, quality); num_outputs maps to n. Reference images and masks,
+// which need the multipart images/edits endpoint, aren't supported.
+func (o *OpenAI) GenerateImages(ctx context.Context, req Request) (Result, error) {
+	if req.Image != "" || req.Mask != "" {
+		return Result{}, fmt.Errorf("the openai provider does not support reference images or masks")
+	}
+
+	payload := models.Inputs(req.Model, req.Params)
+	payload["prompt"] = req.Prompt
+	if req.Model != "" {
+		payload["model"] = req.Model
+	}
+	if n, ok := payload["num_outputs"]; ok {
+		delete(payload, "num_outputs")
+		payload["n"] = n
+	}
+
+	header := http.Header{}
+	if o.apiKey != "" {
+		header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+
+	var resp struct {
+		Data []struct {
+			B64JSON string `json:"b64_json"`
+			URL     string `json:"url"`
+		} `json:"data"`
+	}
+	retries, err := doCreate(ctx, o.retry, func(ctx context.Context) error {
+		return postJSON(ctx, o.http, o.baseURL+"/images/generations", header, payload, &resp)
+	})
+	result := Result{Attempts: retries + 1}
+	if err != nil {
+		return result, fmt.Errorf("image generation failed: %w", err)
+	}
+	if len(resp.Data) == 0 {
+		return result, fmt.Errorf("no images in response")
+	}
+
+	// Images come back inline (b64_json) or as URLs, depending on the
+	// model and response_format.
+	var encoded, urls []string
+	for _, d := range resp.Data {
+		if d.B64JSON != "" {
+			encoded = append(encoded, d.B64JSON)
+		} else {
+			urls = append(urls, d.URL)
+		}
+	}
+
+	if result.Images, err = decodeBase64Images(encoded); err != nil {
+		return result, err
+	}
+	downloaded, retries, err := downloadImages(ctx, o.http, o.retry, urls)
+	result.Attempts += retries
+	result.Images = append(result.Images, downloaded...)
+	return result, err
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAI(t *testing.T) {
+	download := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("downloaded"))
+	}))
+	defer download.Close()
+
+	tests := []struct {
+		name        string
+		req         Request
+		status      int
+		body        string
+		wantPayload map[string]any // Checked keys only
+		wantImages  []string
+		wantErr     string
+	}{
+		{
+			name:   "inline images",
+			req:    Request{Model: "gpt-image-1", Prompt: "a cat", Params: map[string]any{"num_outputs": 2, "size": "1024x1536", "quality": "high"}},
+			status: http.StatusOK,
+			body:   `{"data": [{"b64_json": "` + b64("one") + `"}, {"b64_json": "` + b64("two") + `"}]}`,
+			wantPayload: map[string]any{
+				"model":       "gpt-image-1",
+				"prompt":      "a cat",
+				"n":           2.0,
+				"num_outputs": nil,
+				"size":        "1024x1536",
+				"quality":     "high",
+			},
+			wantImages: []string{"one", "two"},
+		},
+		{
+			name:        "image urls",
+			req:         Request{Prompt: "a cat"},
+			status:      http.StatusOK,
+			body:        `{"data": [{"url": "` + download.URL + `/0.png"}]}`,
+			wantPayload: map[string]any{"model": nil, "n": nil},
+			wantImages:  []string{"downloaded"},
+		},
+		{
+			name:    "api error",
+			req:     Request{Prompt: "a cat", Params: map[string]any{"size": "7x7"}},
+			status:  http.StatusBadRequest,
+			body:    `{"error": {"message": "Invalid size '7x7'."}}`,
+			wantErr: "400: {\"error\": {\"message\": \"Invalid size '7x7'.\"}}",
+		},
+		{
+			name:    "reference image",
+			req:     Request{Prompt: "a cat", Image: "data:image/png;base64,aW1n"},
+			wantErr: "does not support reference images",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OPENAI_API_KEY", "sk-test")
+			var call apiCall
+			srv := apiServer(t, tt.status, tt.body, &call)
+			got, err := NewOpenAI(Config{BaseURL: srv.URL}).GenerateImages(context.Background(), tt.req)
+			checkResult(t, got, err, tt.wantImages, tt.wantErr)
+			if tt.status == 0 {
+				if call.Path != "" {
+					t.Errorf("called %s for an unsupported request", call.Path)
+				}
+				return
+			}
+			if call.Path != "/images/generations" {
+				t.Errorf("called %s, want /images/generations", call.Path)
+			}
+			if auth := call.Header.Get("Authorization"); auth != "Bearer sk-test" {
+				t.Errorf("Authorization = %q, want the API key", auth)
+			}
+			checkPayload(t, call.Payload, tt.wantPayload)
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/cassette"
+	"github.com/kevinmichaelchen/replicate-images/internal/retry"
+	"github.com/replicate/replicate-go"
+)
+
+// statusError is an unexpected HTTP response status.
+type statusError struct {
+	op         string
+	code       int
+	retryAfter time.Duration
+	body       string
+}
+
+func newStatusError(op string, resp *http.Response) *statusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &statusError{
+		op:         op,
+		code:       resp.StatusCode,
+		retryAfter: retry.ParseRetryAfter(resp.Header.Get("Retry-After")),
+		body:       strings.TrimSpace(string(body)),
+	}
+}
+
+func (e *statusError) Error() string {
+	if e.body != "" {
+		return fmt.Sprintf("%s failed with status: %d: %s", e.op, e.code, e.body)
+	}
+	return fmt.Sprintf("%s failed with status: %d", e.op, e.code)
+}
+
+// do runs fn under policy, retrying the failures classify marks transient,
+// and returns the number of retries made. fn's context carries a hint through
+// which the HTTP transport reports any Retry-After header, since replicate-go
+// doesn't expose it.
+func do(ctx context.Context, policy retry.Policy, fn func(ctx context.Context) error) (int, error) {
+	return doClassified(ctx, policy, classify, fn)
+}
+
+// doCreate is do for requests that start billed work, such as creating a
+// prediction, which are only retried as classifyCreate allows.
+func doCreate(ctx context.Context, policy retry.Policy, fn func(ctx context.Context) error) (int, error) {
+	return doClassified(ctx, policy, classifyCreate, fn)
+}
+
+func doClassified(ctx context.Context, policy retry.Policy, classify func(error, time.Duration) error, fn func(ctx context.Context) error) (int, error) {
+	attempts, err := policy.Do(ctx, func(ctx context.Context) error {
+		hint := &retryHint{}
+		return classify(fn(context.WithValue(ctx, retryHintKey{}, hint)), hint.get())
+	})
+	if err != nil && attempts > 1 {
+		err = fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+	}
+	return attempts - 1, err
+}
+
+// classify marks rate limits, server errors and network failures as
+// transient. Cancellation and replay misses are never retried.
+func classify(err error, retryAfter time.Duration) error {
+	if err == nil || final(err) {
+		return err
+	}
+	if code, after := httpStatus(err, retryAfter); code != 0 {
+		if retry.RetryableStatus(code) {
+			return retry.Transient(err, after)
+		}
+		return err
+	}
+
+	// Connection refused, reset, timeouts and the like
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return retry.Transient(err, 0)
+	}
+	return err
+}
+
+// classifyCreate marks failures as transient only if the server can't have
+// started the work: the connection was never made, or it was rate limited
+// and asked to be retried later. After a timeout, a reset connection or a
+// server error, the work may have started, and retrying would pay for it
+// twice.
+func classifyCreate(err error, retryAfter time.Duration) error {
+	if err == nil || final(err) {
+		return err
+	}
+	if code, after := httpStatus(err, retryAfter); code == http.StatusTooManyRequests && after > 0 {
+		return retry.Transient(err, after)
+	}
+	if notSent(err) {
+		return retry.Transient(err, 0)
+	}
+	return err
+}
+
+// final reports whether err must never be retried: cancellation and replay
+// misses. HTTP timeouts match context.DeadlineExceeded too, so a deadline is
+// only final outside a network error; retry.Policy stops once the caller's
+// context is done either way.
+func final(err error) bool {
+	var urlErr *url.Error
+	return errors.Is(err, context.Canceled) || errors.Is(err, cassette.ErrNoMatch) ||
+		(errors.Is(err, context.DeadlineExceeded) && !errors.As(err, &urlErr))
+}
+
+// httpStatus returns the HTTP status of an API or download error, or 0 for
+// other errors, and the Retry-After it came with.
+func httpStatus(err error, retryAfter time.Duration) (int, time.Duration) {
+	var apiErr *replicate.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status, retryAfter
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code, statusErr.retryAfter
+	}
+	return 0, 0
+}
+
+// notSent reports whether err means a request never reached the server: its
+// host couldn't be resolved or the connection was refused.
+func notSent(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+type retryHintKey struct{}
+
+// retryHint records the Retry-After of the last response within a request.
+type retryHint struct {
+	mu    sync.Mutex
+	after time.Duration
+}
+
+func (h *retryHint) set(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.after = d
+}
+
+func (h *retryHint) get() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.after
+}
+
+// hintTransport reports Retry-After headers to the retryHint in the request
+// context, and removes them, since replicate-go would otherwise wait for them
+// itself before returning the error.
+type hintTransport struct {
+	base http.RoundTripper
+}
+
+func (t *hintTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if hint, ok := req.Context().Value(retryHintKey{}).(*retryHint); ok {
+		if d := retry.ParseRetryAfter(resp.Header.Get("Retry-After")); d > 0 {
+			hint.set(d)
+		}
+		resp.Header.Del("Retry-After")
+	}
+	return resp, nil
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/cassette"
+	"github.com/kevinmichaelchen/replicate-images/internal/retry"
+	"github.com/replicate/replicate-go"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"nil", nil, false},
+		{"canceled", context.Canceled, false},
+		{"deadline", fmt.Errorf("poll: %w", context.DeadlineExceeded), false},
+		{"replay miss", fmt.Errorf("replay: %w", cassette.ErrNoMatch), false},
+		{"api rate limit", &replicate.APIError{Status: http.StatusTooManyRequests}, true},
+		{"api server error", &replicate.APIError{Status: http.StatusBadGateway}, true},
+		{"api invalid input", &replicate.APIError{Status: http.StatusUnprocessableEntity}, false},
+		{"download server error", &statusError{op: "download", code: http.StatusServiceUnavailable}, true},
+		{"download not found", &statusError{op: "download", code: http.StatusNotFound}, false},
+		{"network", &url.Error{Op: "Get", URL: "http://localhost", Err: errors.New("connection refused")}, true},
+		{"timeout", &url.Error{Op: "Get", URL: "http://localhost", Err: context.DeadlineExceeded}, true},
+		{"other", errors.New("no images in output"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classify(tt.err, 0)
+			if got := retry.IsTransient(err); got != tt.transient {
+				t.Errorf("classify(%v) transient = %v, want %v", tt.err, got, tt.transient)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("classify(%v) = %v, want it wrapped", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestClassifyCreate(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		name       string
+		err        error
+		retryAfter time.Duration
+		transient  bool
+	}{
+		{"nil", nil, 0, false},
+		{"canceled", context.Canceled, 0, false},
+		{"rate limit with retry-after", &replicate.APIError{Status: http.StatusTooManyRequests}, time.Second, true},
+		{"rate limit without retry-after", &replicate.APIError{Status: http.StatusTooManyRequests}, 0, false},
+		{"server error", &replicate.APIError{Status: http.StatusBadGateway}, 0, false},
+		{"openai rate limit", &statusError{op: "generate", code: http.StatusTooManyRequests, retryAfter: time.Second}, 0, true},
+		{"connection refused", &url.Error{Op: "Post", URL: "http://localhost", Err: dial}, 0, true},
+		{"dns", &url.Error{Op: "Post", URL: "http://nowhere", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nowhere"}}}, 0, true},
+		{"read timeout", &url.Error{Op: "Post", URL: "http://localhost", Err: errors.New("timeout awaiting response headers")}, 0, false},
+		{"reset", &url.Error{Op: "Post", URL: "http://localhost", Err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyCreate(tt.err, tt.retryAfter)
+			if got := retry.IsTransient(err); got != tt.transient {
+				t.Errorf("classifyCreate(%v) transient = %v, want %v", tt.err, got, tt.transient)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("classifyCreate(%v) = %v, want it wrapped", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestCreatePredictionTimeout(t *testing.T) {
+	var posts, gets atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			posts.Add(1)
+		} else {
+			gets.Add(1)
+		}
+		// Accepted, but answered too late
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"id": "abc", "status": "starting"}`)
+	}))
+	defer srv.Close()
+
+	c, err := New(Config{
+		BaseURL:   srv.URL,
+		Token:     "test",
+		Transport: &http.Transport{ResponseHeaderTimeout: 20 * time.Millisecond},
+		Retry:     retry.Policy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.CreatePrediction(context.Background(), Request{Model: "owner/model", Prompt: "a cat"}); err == nil {
+		t.Fatal("CreatePrediction succeeded")
+	}
+	if got := posts.Load(); got != 1 {
+		t.Errorf("made %d POST requests, want 1: the prediction may already exist", got)
+	}
+
+	// Looking it up is safe to retry.
+	if _, err := c.GetPrediction(context.Background(), "abc"); err == nil {
+		t.Fatal("GetPrediction succeeded")
+	}
+	if got := gets.Load(); got != 3 {
+		t.Errorf("made %d GET requests, want 3", got)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int // Rate limited responses before success
+		retries      int
+		wantRequests int32
+		wantErr      bool
+	}{
+		{"no failures", 0, 2, 1, false},
+		{"recovers", 2, 2, 3, false},
+		{"gives up", 5, 2, 3, true},
+		{"retries disabled", 1, 0, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if requests.Add(1) <= int32(tt.failures) {
+					w.Header().Set("Retry-After", "1")
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusTooManyRequests)
+					_, _ = fmt.Fprint(w, `{"status": 429, "detail": "throttled"}`)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = fmt.Fprint(w, `{"id": "abc", "status": "processing"}`)
+			}))
+			defer srv.Close()
+
+			c, err := New(Config{
+				BaseURL: srv.URL,
+				Token:   "test",
+				Retry:   retry.Policy{MaxRetries: tt.retries, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := c.GetPrediction(context.Background(), "abc")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetPrediction = %v, want error %v", err, tt.wantErr)
+			}
+			// replicate-go must not retry on its own, or honor Retry-After.
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("made %d requests, want %d", got, tt.wantRequests)
+			}
+			if err == nil && p.Attempts != int(tt.wantRequests) {
+				t.Errorf("Attempts = %d, want %d", p.Attempts, tt.wantRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package convert
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/kevinmichaelchen/replicate-images/internal/atomicfile"
+	_ "golang.org/x/image/webp" // Decode WEBP sources for PNG and JPEG output
+)
+
+// Output formats accepted by NewOptions.
+const (
+	FormatWebP = "webp"
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+)
+
+// Formats lists every supported output format; the first is the default.
+var Formats = []string{FormatWebP, FormatPNG, FormatJPEG}
+
+// DefaultJPEGQuality is used for JPEG output without a quality.
+const DefaultJPEGQuality = 90
+
+// Options selects how images are saved.
+//
+// Quality is the encoder quality, from 1 to 100. WEBP without a quality is
+// lossless, and with one is lossy, encoded with cwebp since no lossy WEBP
+// encoder is available in pure Go. PNG is always lossless.
+type Options struct {
+	Format  string
+	Quality int // 0 for PNG and lossless WEBP
+}
+
+// NewOptions validates a format and quality and normalizes them, so that
+// equivalent options compare equal: format defaults to WEBP, "jpg" is JPEG,
+// and JPEG quality defaults to DefaultJPEGQuality. A quality for PNG is an
+// error rather than being ignored, as is one for WEBP when cwebp isn't
+// installed.
+func NewOptions(format string, quality int) (Options, error) {
+	format = strings.ToLower(format)
+	switch format {
+	case "":
+		format = FormatWebP
+	case "jpg":
+		format = FormatJPEG
+	case FormatWebP, FormatPNG, FormatJPEG:
+	default:
+		return Options{}, fmt.Errorf("unknown format %q (supported: %v)", format, Formats)
+	}
+	if quality < 0 || quality > 100 {
+		return Options{}, fmt.Errorf("invalid quality %d: want 1-100", quality)
+	}
+	switch {
+	case format == FormatPNG && quality != 0:
+		return Options{}, fmt.Errorf("quality doesn't apply to %s: it's always lossless", format)
+	case format == FormatWebP && quality != 0:
+		if _, err := exec.LookPath(CWebP); err != nil {
+			return Options{}, fmt.Errorf("lossy %s needs %s from libwebp on PATH; omit quality for lossless %s", format, CWebP, format)
+		}
+	case format == FormatJPEG && quality == 0:
+		quality = DefaultJPEGQuality
+	}
+	return Options{Format: format, Quality: quality}, nil
+}
+
+// Ext returns the file extension for the options' format.
+func (o Options) Ext() string {
+	switch o.Format {
+	case FormatPNG:
+		return ".png"
+	case FormatJPEG:
+		return ".jpg"
+	default:
+		return ".webp"
+	}
+}
+
+// Encode converts image data to the options' format. Data that is already
+// in a lossless target format is returned unchanged.
+func Encode(data []byte, o Options) ([]byte, error) {
+	contentType := http.DetectContentType(data)
+	switch {
+	case (o.Format == FormatWebP || o.Format == "") && o.Quality == 0:
+		converted, _, err := ToWebP(data)
+		return converted, err
+	case o.Format == FormatPNG && contentType == "image/png":
+		return data, nil
+	case o.Format == FormatWebP && (contentType == "image/png" || contentType == "image/jpeg"):
+		return encodeLossyWebP(data, o.Quality)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return encodeImage(img, o)
+}
+
+// encodeImage encodes a decoded image in the options' format.
+func encodeImage(img image.Image, o Options) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch o.Format {
+	case FormatPNG:
+		err = png.Encode(&buf, img)
+	case FormatJPEG:
+		err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: o.Quality})
+	default:
+		if o.Quality == 0 {
+			err = nativewebp.Encode(&buf, img, nil)
+			break
+		}
+		// cwebp reads encoded images, so hand it a lossless PNG.
+		if err = png.Encode(&buf, img); err == nil {
+			return encodeLossyWebP(buf.Bytes(), o.Quality)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", o.Format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Save converts image data with Encode and writes it to path. An existing
+// file is replaced rather than overwritten, since it may be a hardlink into
+// the shared store.
+func Save(data []byte, path string, o Options) error {
+	converted, err := Encode(data, o)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, converted, 0644)
+}
+
+// flatten composites img onto white, since JPEG has no alpha channel.
+func flatten(img image.Image) image.Image {
+	if img.ColorModel() == color.YCbCrModel || img.ColorModel() == color.GrayModel {
+		return img
+	}
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, image.White, image.Point{}, draw.Src)
+	draw.Draw(out, b, img, b.Min, draw.Over)
+	return out
+}
@@ -0,0 +1,232 @@
+package convert
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeCWebP puts a cwebp on PATH that records its arguments in the returned
+// file and writes a lossless WEBP of out.
+func fakeCWebP(t *testing.T, out []byte) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake cwebp is a shell script")
+	}
+	dir := t.TempDir()
+	args, webp := filepath.Join(dir, "args"), filepath.Join(dir, "out.webp")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" > %q
+while [ $# -gt 0 ]; do
+	if [ "$1" = -o ]; then cp %q "$2"; fi
+	shift
+done
+`, args, webp)
+	if err := os.WriteFile(filepath.Join(dir, CWebP), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	converted, _, err := ToWebP(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(webp, converted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return args
+}
+
+func TestNewOptions(t *testing.T) {
+	fakeCWebP(t, testPNG(t, 2, 2))
+	tests := []struct {
+		format  string
+		quality int
+		want    Options
+		wantErr bool
+	}{
+		{"", 0, Options{Format: FormatWebP}, false},
+		{"webp", 0, Options{Format: FormatWebP}, false},
+		{"WEBP", 0, Options{Format: FormatWebP}, false},
+		{"png", 0, Options{Format: FormatPNG}, false},
+		{"jpeg", 0, Options{Format: FormatJPEG, Quality: DefaultJPEGQuality}, false},
+		{"jpg", 75, Options{Format: FormatJPEG, Quality: 75}, false},
+		{"JPG", 100, Options{Format: FormatJPEG, Quality: 100}, false},
+		{"jpeg", 1, Options{Format: FormatJPEG, Quality: 1}, false},
+		{"jpeg", 101, Options{}, true},
+		{"jpeg", -1, Options{}, true},
+		{"webp", 80, Options{Format: FormatWebP, Quality: 80}, false},
+		{"webp", 101, Options{}, true},
+		{"png", 90, Options{}, true},
+		{"gif", 0, Options{}, true},
+	}
+	for _, tt := range tests {
+		got, err := NewOptions(tt.format, tt.quality)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("NewOptions(%q, %d) = %+v, %v; want %+v, error %v", tt.format, tt.quality, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if _, err := NewOptions("webp", 80); err == nil {
+		t.Error("NewOptions of lossy WEBP without cwebp succeeded")
+	}
+}
+
+func TestExt(t *testing.T) {
+	tests := []struct {
+		o    Options
+		want string
+	}{
+		{Options{}, ".webp"},
+		{Options{Format: FormatWebP}, ".webp"},
+		{Options{Format: FormatPNG}, ".png"},
+		{Options{Format: FormatJPEG, Quality: 90}, ".jpg"},
+	}
+	for _, tt := range tests {
+		if got := tt.o.Ext(); got != tt.want {
+			t.Errorf("%+v.Ext() = %q, want %q", tt.o, got, tt.want)
+		}
+	}
+}
+
+// testPNG returns a w×h PNG, transparent on its left half and red on its right.
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := w / 2; x < w; x++ {
+			img.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncode(t *testing.T) {
+	src := testPNG(t, 16, 8)
+	tests := []struct {
+		format string
+		want   string // As image.Decode names it
+	}{
+		{FormatWebP, "webp"},
+		{FormatPNG, "png"},
+		{FormatJPEG, "jpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			o, err := NewOptions(tt.format, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := Encode(src, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, format, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tt.want || img.Bounds().Dx() != 16 || img.Bounds().Dy() != 8 {
+				t.Errorf("encoded a %dx%d %s, want a 16x8 %s", img.Bounds().Dx(), img.Bounds().Dy(), format, tt.want)
+			}
+
+			// JPEG has no alpha, so transparency is flattened onto white.
+			r, g, b, a := img.At(0, 0).RGBA()
+			if tt.format == FormatJPEG && (r>>8 < 250 || g>>8 < 250 || b>>8 < 250) {
+				t.Errorf("transparent pixel = %d,%d,%d, want white", r>>8, g>>8, b>>8)
+			}
+			if tt.format != FormatJPEG && a != 0 {
+				t.Errorf("transparent pixel has alpha %d, want it kept", a>>8)
+			}
+		})
+	}
+
+	if got, err := Encode(src, Options{Format: FormatPNG}); err != nil || !bytes.Equal(got, src) {
+		t.Errorf("Encode of a PNG as PNG changed it: %v", err)
+	}
+	if _, err := Encode([]byte("not an image"), Options{Format: FormatJPEG, Quality: 90}); err == nil {
+		t.Error("Encode of garbage succeeded")
+	}
+}
+
+func TestEncodeLossyWebP(t *testing.T) {
+	src := testPNG(t, 16, 8)
+	webp, _, err := ToWebP(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"png", src},
+		{"webp", webp}, // Decoded and handed to cwebp as a PNG
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := fakeCWebP(t, src)
+			data, err := Encode(tt.data, Options{Format: FormatWebP, Quality: 80})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, format, err := image.DecodeConfig(bytes.NewReader(data)); err != nil || format != "webp" {
+				t.Errorf("encoded %s, %v; want webp", format, err)
+			}
+			recorded, err := os.ReadFile(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(recorded), "-quiet -q 80 ") {
+				t.Errorf("cwebp ran with %q, want quality 80", recorded)
+			}
+		})
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if _, err := Encode(src, Options{Format: FormatWebP, Quality: 80}); err == nil {
+		t.Error("Encode of lossy WEBP without cwebp succeeded")
+	}
+}
+
+func TestSaveReplacesLinks(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "shared.png")
+	path := filepath.Join(dir, "cat.png")
+	if err := os.WriteFile(shared, []byte("stored image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(shared, path); err != nil {
+		t.Skipf("hardlinks not supported: %v", err)
+	}
+
+	src := testPNG(t, 4, 4)
+	if err := Save(src, path, Options{Format: FormatPNG}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, src) {
+		t.Error("Save didn't write the image")
+	}
+	if got, _ := os.ReadFile(shared); string(got) != "stored image" {
+		t.Errorf("Save wrote through a hardlink: the other name holds %q", got)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("saved file mode = %v, want 0644", info.Mode().Perm())
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
@@ -0,0 +1,40 @@
+package convert
+
+import (
+	"fmt"
+	"image"
+	"os"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/atomicfile"
+	"golang.org/x/image/draw"
+)
+
+// SaveResized writes the image at src, scaled down to width with its aspect
+// ratio kept, to dst in the options' format. It resamples with Catmull-Rom,
+// which keeps downscaled images sharp. If the image is no wider than width,
+// nothing is written and it returns false, since upscaling adds nothing.
+func SaveResized(src, dst string, width int, o Options) (bool, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode %s: %w", src, err)
+	}
+
+	b := img.Bounds()
+	if b.Dx() <= width {
+		return false, nil
+	}
+	height := max(1, (b.Dy()*width+b.Dx()/2)/b.Dx())
+	scaled := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, b, draw.Src, nil)
+
+	data, err := encodeImage(scaled, o)
+	if err != nil {
+		return false, err
+	}
+	return true, atomicfile.WriteFile(dst, data, 0644)
+}
@@ -0,0 +1,80 @@
+package convert
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveResized(t *testing.T) {
+	tests := []struct {
+		name         string
+		w, h         int
+		width        int
+		format       string
+		written      bool
+		wantW, wantH int
+		wantFormat   string // As image.Decode names it
+	}{
+		{"halved", 64, 32, 32, FormatWebP, true, 32, 16, "webp"},
+		{"rounded", 100, 33, 50, FormatPNG, true, 50, 17, "png"},
+		{"thin", 400, 1, 10, FormatJPEG, true, 10, 1, "jpeg"},
+		{"same width", 64, 32, 64, FormatWebP, false, 0, 0, ""},
+		{"upscale", 64, 32, 128, FormatWebP, false, 0, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src.png")
+			if err := os.WriteFile(src, testPNG(t, tt.w, tt.h), 0644); err != nil {
+				t.Fatal(err)
+			}
+			o, err := NewOptions(tt.format, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dst := filepath.Join(dir, "dst"+o.Ext())
+			written, err := SaveResized(src, dst, tt.width, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != tt.written {
+				t.Fatalf("SaveResized = %v, want %v", written, tt.written)
+			}
+			if !written {
+				if _, err := os.Stat(dst); !os.IsNotExist(err) {
+					t.Errorf("SaveResized wrote %s without resizing", dst)
+				}
+				return
+			}
+
+			f, err := os.Open(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = f.Close() }()
+			cfg, format, err := image.DecodeConfig(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != tt.wantW || cfg.Height != tt.wantH || format != tt.wantFormat {
+				t.Errorf("wrote a %dx%d %s, want a %dx%d %s", cfg.Width, cfg.Height, format, tt.wantW, tt.wantH, tt.wantFormat)
+			}
+		})
+	}
+}
+
+func TestSaveResizedInvalid(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.png")
+	if err := os.WriteFile(garbage, []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []string{garbage, filepath.Join(dir, "missing.png")} {
+		if _, err := SaveResized(src, filepath.Join(dir, "dst.webp"), 16, Options{Format: FormatWebP}); err == nil {
+			t.Errorf("SaveResized(%s) succeeded", filepath.Base(src))
+		}
+	}
+}
@@ -9,6 +9,9 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/HugoSmits86/nativewebp"
@@ -39,15 +42,35 @@ func ToWebP(data []byte) ([]byte, bool, error) {
 	return buf.Bytes(), true, nil
 }
 
-// SaveWebP saves image data as WEBP to the specified path.
-// Converts if necessary.
-func SaveWebP(data []byte, path string) error {
-	converted, _, err := ToWebP(data)
+// CWebP is the libwebp command lossy WEBP is encoded with.
+const CWebP = "cwebp"
+
+// encodeLossyWebP encodes PNG or JPEG data as lossy WEBP at quality, from 1
+// to 100, with cwebp.
+func encodeLossyWebP(data []byte, quality int) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "replicate-images-*")
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer func() { _ = os.RemoveAll(dir) }()
 
-	return os.WriteFile(path, converted, 0644)
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out.webp")
+	if err := os.WriteFile(in, data, 0600); err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(CWebP, "-quiet", "-q", strconv.Itoa(quality), in, "-o", out)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to encode webp with %s: %w: %s", CWebP, err, strings.TrimSpace(stderr.String()))
+	}
+	return os.ReadFile(out)
+}
+
+// SaveWebP saves image data as lossless WEBP to the specified path.
+// Converts if necessary.
+func SaveWebP(data []byte, path string) error {
+	return Save(data, path, Options{Format: FormatWebP})
 }
 
 // IsWebP checks if the data is already in WEBP format.
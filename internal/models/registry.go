@@ -1,14 +1,21 @@
 // Package models defines supported image generation models and their configurations.
 package models
 
+import "strings"
+
 // Model represents a supported image generation model.
 type Model struct {
 	ID          string         // e.g., "black-forest-labs/flux-schnell"
 	Name        string         // Human-friendly name
 	Description string         // What the model is good at
 	Defaults    map[string]any // Default input parameters beyond prompt
+	ImageParam  string         // Input that takes a reference image, if not "image"
+	ImageList   bool           // ImageParam takes a list of images
 }
 
+// DefaultImageParam is the reference image input of models that don't set one.
+const DefaultImageParam = "image"
+
 // Supported models registry.
 var Supported = []Model{
 	{
@@ -22,6 +29,7 @@ var Supported = []Model{
 		Name:        "FLUX 1.1 Pro",
 		Description: "Higher quality than Schnell, slower. Best for final outputs.",
 		Defaults:    nil,
+		ImageParam:  "image_prompt",
 	},
 	{
 		ID:          "stability-ai/sdxl",
@@ -36,6 +44,8 @@ var Supported = []Model{
 		Defaults: map[string]any{
 			"aspect_ratio": "1:1",
 		},
+		ImageParam: "image_input",
+		ImageList:  true,
 	},
 }
 
@@ -71,3 +81,33 @@ func List() []string {
 	}
 	return ids
 }
+
+// IsPinned reports whether id names a specific version, as owner/name:version,
+// rather than whatever version of the model is latest.
+func IsPinned(id string) bool {
+	return strings.Contains(id, ":")
+}
+
+// Inputs returns the model's default input parameters overlaid with params.
+// The returned map is a fresh copy and never aliases the registry defaults.
+func Inputs(id string, params map[string]any) map[string]any {
+	inputs := make(map[string]any)
+	if m, ok := registry[id]; ok {
+		for k, v := range m.Defaults {
+			inputs[k] = v
+		}
+	}
+	for k, v := range params {
+		inputs[k] = v
+	}
+	return inputs
+}
+
+// ImageParam returns the input name for a reference image and whether it
+// takes a list.
+func ImageParam(id string) (string, bool) {
+	if m, ok := registry[id]; ok && m.ImageParam != "" {
+		return m.ImageParam, m.ImageList
+	}
+	return DefaultImageParam, false
+}
@@ -0,0 +1,139 @@
+// Package pending tracks asynchronous predictions that haven't been fetched yet.
+package pending
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/atomicfile"
+	"github.com/kevinmichaelchen/replicate-images/internal/cache"
+)
+
+const FileName = "pending.json"
+
+// Prediction is a submitted prediction whose images haven't been downloaded.
+type Prediction struct {
+	ID        string    `json:"id"`
+	Hash      string    `json:"hash"`
+	Key       cache.Key `json:"key"`
+	Provider  string    `json:"provider"`        // Provider that runs the prediction
+	Names     []string  `json:"names,omitempty"` // Prompt names to save the images under
+	Sizes     []int     `json:"sizes,omitempty"` // Widths to save scaled-down copies at
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddName records another prompt name for the prediction's images. It reports
+// whether the name is new.
+func (p *Prediction) AddName(name string) bool {
+	if name == "" || slices.Contains(p.Names, name) {
+		return false
+	}
+	p.Names = append(p.Names, name)
+	return true
+}
+
+type Store struct {
+	Predictions []Prediction `json:"predictions"`
+	path        string
+}
+
+// Load reads pending predictions from the output directory.
+// A missing file yields an empty store.
+func Load(outputDir string) (*Store, error) {
+	path := filepath.Join(outputDir, FileName)
+	s := &Store{
+		Predictions: []Prediction{},
+		path:        path,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	s.path = path
+	return s, nil
+}
+
+// Save writes the store to disk atomically. Reserved predictions, which
+// haven't been created yet, are left out.
+func (s *Store) Save() error {
+	saved := Store{Predictions: make([]Prediction, 0, len(s.Predictions))}
+	for _, p := range s.Predictions {
+		if p.ID != "" {
+			saved.Predictions = append(saved.Predictions, p)
+		}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.path, data, 0644)
+}
+
+// Add records a newly created prediction.
+func (s *Store) Add(p Prediction) {
+	s.Predictions = append(s.Predictions, p)
+}
+
+// Remove forgets a prediction by ID.
+func (s *Store) Remove(id string) {
+	for i := range s.Predictions {
+		if s.Predictions[i].ID == id {
+			s.Predictions = append(s.Predictions[:i], s.Predictions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Reserve records a prediction without an ID before it's created, so that
+// LookupHash finds it and the same key isn't submitted twice. Complete it
+// with Created, or drop it with Release if it couldn't be created.
+func (s *Store) Reserve(p Prediction) {
+	p.ID = ""
+	s.Predictions = append(s.Predictions, p)
+}
+
+// Created records the ID and status of the reserved prediction for hash.
+func (s *Store) Created(hash, id, status string) {
+	if p := s.reserved(hash); p != nil {
+		p.ID, p.Status = id, status
+	}
+}
+
+// Release drops the reserved prediction for hash.
+func (s *Store) Release(hash string) {
+	s.Predictions = slices.DeleteFunc(s.Predictions, func(p Prediction) bool {
+		return p.ID == "" && p.Hash == hash
+	})
+}
+
+// reserved finds the reserved prediction for hash.
+func (s *Store) reserved(hash string) *Prediction {
+	for i := range s.Predictions {
+		if s.Predictions[i].ID == "" && s.Predictions[i].Hash == hash {
+			return &s.Predictions[i]
+		}
+	}
+	return nil
+}
+
+// LookupHash finds a pending or reserved prediction for a cache hash.
+func (s *Store) LookupHash(hash string) *Prediction {
+	for i := range s.Predictions {
+		if s.Predictions[i].Hash == hash {
+			return &s.Predictions[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package pending
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kevinmichaelchen/replicate-images/internal/cache"
+)
+
+// prediction returns a pending prediction for prompt.
+func prediction(id, prompt string) Prediction {
+	key := cache.NewKey(prompt, "black-forest-labs/flux-schnell", nil)
+	return Prediction{
+		ID:        id,
+		Hash:      key.Hash(),
+		Key:       key,
+		Provider:  "replicate",
+		Status:    "starting",
+		CreatedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Predictions) != 0 {
+		t.Fatalf("Load of a missing file = %+v, want no predictions", s.Predictions)
+	}
+
+	a, b, c := prediction("a", "cat"), prediction("b", "dog"), prediction("c", "fox")
+	a.Names, a.Sizes = []string{"hero", "thumb"}, []int{320}
+	for _, p := range []Prediction{a, b, c} {
+		s.Add(p)
+	}
+	s.Remove("b")
+	s.Remove("missing")
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Prediction{a, c}; !reflect.DeepEqual(loaded.Predictions, want) {
+		t.Errorf("loaded %+v, want %+v", loaded.Predictions, want)
+	}
+	if got := loaded.LookupHash(c.Hash); got == nil || got.ID != "c" {
+		t.Errorf("LookupHash = %+v, want c", got)
+	}
+	if got := loaded.LookupHash(b.Hash); got != nil {
+		t.Errorf("LookupHash of a removed prediction = %+v", got)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".*.tmp")); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, FileName), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(dir); err == nil {
+		t.Error("Load of invalid JSON succeeded")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := prediction("", "cat"), prediction("", "dog")
+	s.Reserve(a)
+	s.Reserve(b)
+
+	// Reserved predictions are found, but not saved until created.
+	if got := s.LookupHash(a.Hash); got == nil || got.ID != "" {
+		t.Fatalf("LookupHash of a reservation = %+v", got)
+	}
+	if !s.LookupHash(a.Hash).AddName("hero") || s.LookupHash(a.Hash).AddName("hero") || s.LookupHash(a.Hash).AddName("") {
+		t.Error("AddName didn't add each name once")
+	}
+	s.Created(a.Hash, "a", "starting")
+	s.Release(b.Hash)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Predictions) != 1 {
+		t.Fatalf("loaded %+v, want only the created prediction", loaded.Predictions)
+	}
+	if got := loaded.Predictions[0]; got.ID != "a" || !reflect.DeepEqual(got.Names, []string{"hero"}) {
+		t.Errorf("loaded %+v, want a named hero", got)
+	}
+	if s.LookupHash(b.Hash) != nil {
+		t.Error("a released reservation is still found")
+	}
+}
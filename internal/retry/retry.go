@@ -0,0 +1,107 @@
+// Package retry retries transient failures with exponential backoff and jitter.
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy controls how transient failures are retried.
+type Policy struct {
+	MaxRetries int           // Retries after the first attempt; 0 disables retrying
+	BaseDelay  time.Duration // Delay before the first retry, doubled for each one after
+	MaxDelay   time.Duration // Upper bound for any single delay, including Retry-After
+}
+
+// DefaultPolicy is used when no policy is configured.
+var DefaultPolicy = Policy{
+	MaxRetries: 3,
+	BaseDelay:  time.Second,
+	MaxDelay:   time.Minute,
+}
+
+// Do calls fn until it succeeds, fails with a non-transient error, runs out
+// of retries or ctx is done. It returns the number of attempts made.
+func (p Policy) Do(ctx context.Context, fn func(ctx context.Context) error) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return attempt, nil
+		}
+
+		var t *transientError
+		if !errors.As(err, &t) || attempt > p.MaxRetries || ctx.Err() != nil {
+			return attempt, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(p.delay(attempt, t.after)):
+		}
+	}
+}
+
+// delay returns how long to wait before retry n (1-based). A server-requested
+// delay takes precedence over the backoff schedule.
+func (p Policy) delay(n int, after time.Duration) time.Duration {
+	if after > 0 {
+		return min(after, p.MaxDelay)
+	}
+	d := p.MaxDelay
+	if n < 32 {
+		if backoff := p.BaseDelay << (n - 1); backoff >= 0 && backoff < d {
+			d = backoff
+		}
+	}
+	// Equal jitter: half fixed, half random, to spread out concurrent retries.
+	half := d / 2
+	return half + rand.N(half+1) //nolint:gosec // jitter doesn't need a secure source
+}
+
+// transientError marks an error as worth retrying.
+type transientError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+// Transient marks err as retryable. If after is positive, it is used as the
+// delay before the next attempt (e.g. from a Retry-After header).
+func Transient(err error, after time.Duration) error {
+	return &transientError{err: err, after: after}
+}
+
+// IsTransient reports whether err was marked retryable.
+func IsTransient(err error) bool {
+	var t *transientError
+	return errors.As(err, &t)
+}
+
+// RetryableStatus reports whether an HTTP status code indicates a transient failure.
+func RetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= 500
+}
+
+// ParseRetryAfter parses a Retry-After header, given either as seconds or as
+// an HTTP date. It returns 0 if the header is missing or invalid.
+func ParseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
@@ -0,0 +1,132 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fastPolicy retries without waiting long.
+var fastPolicy = Policy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+func TestDo(t *testing.T) {
+	errFatal := errors.New("bad request")
+	errFlaky := Transient(errors.New("rate limited"), 0)
+
+	tests := []struct {
+		name         string
+		errs         []error // Returned by successive attempts; nil after the last
+		wantAttempts int
+		wantErr      error
+	}{
+		{"success", nil, 1, nil},
+		{"fatal", []error{errFatal}, 1, errFatal},
+		{"recovers", []error{errFlaky, errFlaky}, 3, nil},
+		{"gives up", []error{errFlaky, errFlaky, errFlaky, errFlaky}, 3, errFlaky},
+		{"fatal after transient", []error{errFlaky, errFatal}, 2, errFatal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			attempts, err := fastPolicy.Do(context.Background(), func(context.Context) error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if attempts != tt.wantAttempts || calls != tt.wantAttempts {
+				t.Errorf("Do made %d attempts (reported %d), want %d", calls, attempts, tt.wantAttempts)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Do = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := Policy{MaxRetries: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	attempts, err := policy.Do(ctx, func(context.Context) error {
+		cancel()
+		return Transient(errors.New("unavailable"), 0)
+	})
+	if attempts != 1 || err == nil {
+		t.Errorf("Do = %d, %v; want 1 attempt and the error", attempts, err)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	p := Policy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	tests := []struct {
+		name     string
+		n        int
+		after    time.Duration
+		min, max time.Duration
+	}{
+		{"first", 1, 0, 500 * time.Millisecond, time.Second},
+		{"third", 3, 0, 2 * time.Second, 4 * time.Second},
+		{"capped", 10, 0, 5 * time.Second, 10 * time.Second},
+		{"overflow", 100, 0, 5 * time.Second, 10 * time.Second},
+		{"retry after", 1, 3 * time.Second, 3 * time.Second, 3 * time.Second},
+		{"retry after capped", 1, time.Hour, 10 * time.Second, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 20 {
+				if d := p.delay(tt.n, tt.after); d < tt.min || d > tt.max {
+					t.Fatalf("delay(%d, %v) = %v, want %v-%v", tt.n, tt.after, d, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryableStatus(t *testing.T) {
+	tests := []struct {
+		code int
+		want bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusNotFound, false},
+		{http.StatusUnprocessableEntity, false},
+		{http.StatusRequestTimeout, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		if got := RetryableStatus(tt.code); got != tt.want {
+			t.Errorf("RetryableStatus(%d) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		min, max time.Duration
+	}{
+		{"missing", "", 0, 0},
+		{"seconds", "30", 30 * time.Second, 30 * time.Second},
+		{"padded", " 5 ", 5 * time.Second, 5 * time.Second},
+		{"negative", "-5", 0, 0},
+		{"invalid", "soon", 0, 0},
+		{"date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{"past date", "Mon, 02 Jan 2006 15:04:05 GMT", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d := ParseRetryAfter(tt.header); d < tt.min || d > tt.max {
+				t.Errorf("ParseRetryAfter(%q) = %v, want %v-%v", tt.header, d, tt.min, tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+#!/bin/bash
+# Offline end-to-end test using the fake provider. Safe to run in CI:
+# no network access or API token needed, and it costs nothing.
+set -euo pipefail
+
+SCRIPT_DIR="$(cd "$(dirname "$0")" && pwd)"
+ROOT_DIR="$(dirname "$SCRIPT_DIR")"
+BIN="$ROOT_DIR/replicate-images"
+WORK="$(mktemp -d)"
+trap 'rm -rf "$WORK"' EXIT
+
+cd "$ROOT_DIR"
+
+echo "=== Building ==="
+go build -o "$BIN" ./cmd/replicate-images
+
+cat > "$WORK/prompts.yaml" << 'EOF2'
+prompts:
+  - prompt: "offline test one"
+    name: one
+  - prompt: "offline test two"
+    count: 2
+    params:
+      width: 64
+      height: 32
+EOF2
+
+echo ""
+echo "=== Test: batch generates ==="
+OUTPUT=$("$BIN" --provider fake batch --json -o "$WORK/out" "$WORK/prompts.yaml")
+if [ "$(echo "$OUTPUT" | grep -c '"status":"generated"')" -ne 2 ]; then
+  echo "$OUTPUT"
+  echo "✗ Expected 2 generations" && exit 1
+fi
+for f in one.webp; do
+  [ -s "$WORK/out/$f" ] || { echo "✗ Missing $f" && exit 1; }
+done
+echo "✓ Passed"
+
+echo ""
+echo "=== Test: batch cache hit ==="
+OUTPUT=$("$BIN" --provider fake batch --json -o "$WORK/out" "$WORK/prompts.yaml")
+if [ "$(echo "$OUTPUT" | grep -c '"cached":true')" -ne 2 ]; then
+  echo "$OUTPUT"
+  echo "✗ Expected 2 cache hits" && exit 1
+fi
+echo "✓ Passed"
+
+echo ""
+echo "=== Test: deterministic output ==="
+"$BIN" --provider fake -q -o "$WORK/a" "same prompt"
+"$BIN" --provider fake -q -o "$WORK/b" "same prompt"
+if ! cmp -s "$WORK/a/"*.webp "$WORK/b/"*.webp; then
+  echo "✗ Fake images differ" && exit 1
+fi
+echo "✓ Passed"
+
+echo ""
+echo "=== Test: async submit and fetch ==="
+"$BIN" --provider fake --async -q -o "$WORK/async" "async prompt"
+OUTPUT=$("$BIN" --provider fake fetch --json -o "$WORK/async")
+if ! echo "$OUTPUT" | grep -q '"status":"generated"'; then
+  echo "$OUTPUT"
+  echo "✗ Fetch didn't generate" && exit 1
+fi
+echo "✓ Passed"
+
+echo ""
+echo "=== All tests passed ==="
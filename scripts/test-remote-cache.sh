@@ -0,0 +1,32 @@
+#!/bin/bash
+# Tests the remote cache (put, get and checksum mismatch) against a local
+# MinIO in Docker. Set AWS_ENDPOINT_URL to use an already running
+# S3-compatible server instead.
+set -euo pipefail
+
+SCRIPT_DIR="$(cd "$(dirname "$0")" && pwd)"
+ROOT_DIR="$(dirname "$SCRIPT_DIR")"
+cd "$ROOT_DIR"
+
+export AWS_ACCESS_KEY_ID="${AWS_ACCESS_KEY_ID:-minio}"
+export AWS_SECRET_ACCESS_KEY="${AWS_SECRET_ACCESS_KEY:-minio123}"
+export REPLICATE_IMAGES_TEST_REMOTE="${REPLICATE_IMAGES_TEST_REMOTE:-s3://replicate-images-test/cache}"
+
+if [ -z "${AWS_ENDPOINT_URL:-}" ]; then
+  echo "=== Starting MinIO ==="
+  CONTAINER=$(docker run -d --rm -p 9000 \
+    -e MINIO_ROOT_USER="$AWS_ACCESS_KEY_ID" \
+    -e MINIO_ROOT_PASSWORD="$AWS_SECRET_ACCESS_KEY" \
+    minio/minio server /data)
+  trap 'docker stop "$CONTAINER" > /dev/null' EXIT
+  export AWS_ENDPOINT_URL="http://$(docker port "$CONTAINER" 9000 | head -n 1)"
+
+  for _ in $(seq 30); do
+    curl -sf "$AWS_ENDPOINT_URL/minio/health/ready" > /dev/null && break
+    sleep 1
+  done
+fi
+
+echo ""
+echo "=== Test: remote cache against $AWS_ENDPOINT_URL ==="
+go test -count=1 -run '^TestRemote$' -v ./internal/cache